@@ -2,9 +2,11 @@ package balenakeys
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"sync"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
@@ -25,6 +27,39 @@ type balenaBackend struct {
 	*framework.Backend
 	lock   sync.RWMutex
 	client *balenaClient
+
+	// cacheLock serializes checkouts and releases of cached tokens
+	cacheLock sync.Mutex
+
+	// poolLock serializes changes to the storage entries of pooled tokens
+	poolLock sync.Mutex
+
+	// teamLock serializes changes to team grants and their reconciliation
+	teamLock sync.Mutex
+
+	// moveLock serializes changes to device moves and their repair
+	moveLock sync.Mutex
+
+	// membershipLock serializes the lease counting of fleet memberships
+	membershipLock sync.Mutex
+
+	// overrideLock serializes changes to device overrides and their repair
+	overrideLock sync.Mutex
+
+	// pinLock serializes changes to release pins and their repair
+	pinLock sync.Mutex
+
+	// publicURLLock serializes the lease counting of device public URLs
+	publicURLLock sync.Mutex
+
+	// supportLock serializes grants of support access and their revocation
+	supportLock sync.Mutex
+
+	// syncLock serializes changes to KV syncs and their runs
+	syncLock sync.Mutex
+
+	// managedVarLock serializes changes to managed variables and their rotation
+	managedVarLock sync.Mutex
 }
 
 // backend defines the target API backend
@@ -43,20 +78,53 @@ func backend() *balenaBackend {
 			SealWrapStorage: []string{
 				"config",
 				"role/*",
+				roleVersionStoragePrefix + "*",
+				tokenCacheStoragePrefix + "*",
+				keyPoolStoragePrefix + "*",
+				provisionBatchStoragePrefix + "*",
+				deviceOverrideStoragePrefix + "*",
+				managedVarStateStoragePrefix + "*",
 			},
 		},
 		Paths: framework.PathAppend(
+			pathRoleVersions(&b),
 			pathRole(&b),
+			pathProvisionBatch(&b),
+			pathSync(&b),
+			pathManagedVar(&b),
+			pathBuildSecrets(&b),
 			[]*framework.Path{
 				pathConfig(&b),
 				pathCredentials(&b),
+				pathProvision(&b),
+				pathSupportAccess(&b),
+				pathPublicURL(&b),
+				pathDeviceOverride(&b),
+				pathReleasePin(&b),
+				pathDeviceMove(&b),
+				pathScan(&b),
 			},
 		),
 		Secrets: []*framework.Secret{
 			b.balenaToken(),
+			b.balenaDeviceKey(),
+			b.balenaProvisioningKey(),
+			b.balenaSSHKey(),
+			b.balenaRegistryToken(),
+			b.balenaFleetMembership(),
+			b.balenaTeamMembership(),
+			b.balenaOpenBalenaUser(),
+			b.balenaEphemeralDevice(),
+			b.balenaEphemeralFleet(),
+			b.balenaSupportAccess(),
+			b.balenaPublicURL(),
+			b.balenaDeviceOverride(),
+			b.balenaReleasePin(),
+			b.balenaDeviceMove(),
 		},
-		BackendType: logical.TypeLogical,
-		Invalidate:  b.invalidate,
+		BackendType:  logical.TypeLogical,
+		Invalidate:   b.invalidate,
+		PeriodicFunc: b.periodicFunc,
 	}
 	return &b
 }
@@ -77,6 +145,45 @@ func (b *balenaBackend) invalidate(ctx context.Context, key string) {
 	}
 }
 
+// periodicFunc runs the backend's background maintenance
+func (b *balenaBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	var merr *multierror.Error
+
+	if err := b.refillKeyPools(ctx, req.Storage); err != nil {
+		merr = multierror.Append(merr, fmt.Errorf("error refilling key pools: %w", err))
+	}
+
+	if err := b.revokeUsedProvisioningKeys(ctx, req.Storage); err != nil {
+		merr = multierror.Append(merr, fmt.Errorf("error revoking used provisioning keys: %w", err))
+	}
+
+	if err := b.reconcileTeamGrants(ctx, req.Storage); err != nil {
+		merr = multierror.Append(merr, fmt.Errorf("error reconciling team grants: %w", err))
+	}
+
+	if err := b.reconcileDeviceMoves(ctx, req.Storage); err != nil {
+		merr = multierror.Append(merr, fmt.Errorf("error reconciling device moves: %w", err))
+	}
+
+	if err := b.reconcileDeviceOverrides(ctx, req.Storage); err != nil {
+		merr = multierror.Append(merr, fmt.Errorf("error reconciling device overrides: %w", err))
+	}
+
+	if err := b.reconcileReleasePins(ctx, req.Storage); err != nil {
+		merr = multierror.Append(merr, fmt.Errorf("error reconciling release pins: %w", err))
+	}
+
+	if err := b.reconcileSyncs(ctx, req.Storage); err != nil {
+		merr = multierror.Append(merr, fmt.Errorf("error syncing kv secrets: %w", err))
+	}
+
+	if err := b.reconcileManagedVars(ctx, req.Storage); err != nil {
+		merr = multierror.Append(merr, fmt.Errorf("error rotating managed variables: %w", err))
+	}
+
+	return merr.ErrorOrNil()
+}
+
 // getClient locks the backend as it configures and creates a
 // a new client for the target API
 func (b *balenaBackend) getClient(ctx context.Context, s logical.Storage, bToken string) (*balenaClient, error) {
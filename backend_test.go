@@ -2,7 +2,12 @@ package balenakeys
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/hashicorp/go-hclog"
@@ -35,6 +40,83 @@ func getTestBackend(tb testing.TB) (*balenaBackend, logical.Storage) {
 	return b.(*balenaBackend), config.StorageView
 }
 
+// testBalenaServer fakes the parts of the balena API a test needs.
+// Handlers are keyed by method and path, such as "GET v6/device".
+type testBalenaServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	handlers map[string]http.HandlerFunc
+	requests []string
+}
+
+// newTestBalenaServer starts a fake balena API that is shut down
+// when the test completes.
+func newTestBalenaServer(tb testing.TB, handlers map[string]http.HandlerFunc) *testBalenaServer {
+	tb.Helper()
+
+	srv := &testBalenaServer{handlers: handlers}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Method + " " + strings.TrimPrefix(r.URL.Path, "/")
+
+		srv.mu.Lock()
+		srv.requests = append(srv.requests, key)
+		handler, ok := srv.handlers[key]
+		srv.mu.Unlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}))
+	tb.Cleanup(srv.Close)
+
+	return srv
+}
+
+// called reports whether the fake API received a request for key
+func (s *testBalenaServer) called(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.requests {
+		if r == key {
+			return true
+		}
+	}
+	return false
+}
+
+// testJSON returns a handler that responds with v encoded as JSON
+func testJSON(v interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+}
+
+// testBackendWithServer returns a test backend configured to
+// talk to the fake balena API, with a role of the given settings.
+func testBackendWithServer(t *testing.T, srv *testBalenaServer, role map[string]interface{}) (*balenaBackend, logical.Storage) {
+	t.Helper()
+
+	b, s := getTestBackend(t)
+
+	err := testConfigCreate(t, b, s, map[string]interface{}{
+		"url": srv.URL,
+	})
+	require.NoError(t, err)
+
+	if role != nil {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, role)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	}
+
+	return b, s
+}
+
 // runAcceptanceTests will separate unit tests from
 // acceptance tests, which will make active requests
 // to your target API.
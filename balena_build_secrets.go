@@ -0,0 +1,240 @@
+package balenakeys
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	buildSecretsStoragePrefix = "build-secrets/"
+
+	// buildSecretsDir is where balena's build-time secrets feature reads
+	// secret files from, relative to the project root
+	buildSecretsDir = ".balena/secrets/"
+
+	// buildSecretsYAMLFile holds the build-secrets section of balena.yml in
+	// the archive, next to the project's own balena.yml rather than over it
+	buildSecretsYAMLFile = ".balena/build-secrets.yml"
+)
+
+// buildSecretNameRegex matches service names and secret file names
+var buildSecretNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// balenaBuildSecrets selects the KV secret values rendered as balena build
+// secrets. Files maps a secret file, as "dest" for every service or
+// "service/dest" for one, to a KV value given as "path#key".
+type balenaBuildSecrets struct {
+	Name      string            `json:"name"`
+	KVMount   string            `json:"kv_mount"`
+	KVVersion int               `json:"kv_version"`
+	Files     map[string]string `json:"files"`
+}
+
+// balenaBuildSecretFile is one rendered secret file
+type balenaBuildSecretFile struct {
+	Service string
+	Source  string
+	Dest    string
+	KVPath  string
+	KVKey   string
+}
+
+// buildSecretFiles parses the files of a definition, in a stable order
+func buildSecretFiles(files map[string]string) ([]balenaBuildSecretFile, error) {
+	if len(files) == 0 {
+		return nil, errors.New("at least one file is required")
+	}
+
+	targets := make([]string, 0, len(files))
+	for target := range files {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	sources := map[string]string{}
+	parsed := make([]balenaBuildSecretFile, 0, len(files))
+	for _, target := range targets {
+		var f balenaBuildSecretFile
+
+		f.Dest = target
+		if service, dest, ok := strings.Cut(target, "/"); ok {
+			if !buildSecretNameRegex.MatchString(service) {
+				return nil, fmt.Errorf("invalid service name in %q", target)
+			}
+			f.Service, f.Dest = service, dest
+		}
+
+		if !buildSecretNameRegex.MatchString(f.Dest) {
+			return nil, fmt.Errorf("invalid secret file name in %q", target)
+		}
+
+		// each service's files get their own name in the flat secrets
+		// directory
+		f.Source = f.Dest
+		if f.Service != "" {
+			f.Source = f.Service + "-" + f.Dest
+		}
+
+		if other, ok := sources[f.Source]; ok {
+			return nil, fmt.Errorf("files %q and %q would both be written to %s%s", other, target, buildSecretsDir, f.Source)
+		}
+		sources[f.Source] = target
+
+		path, key, ok := strings.Cut(files[target], "#")
+		path = strings.Trim(path, "/")
+		if !ok || path == "" || key == "" {
+			return nil, fmt.Errorf("kv value of %q must be given as path#key", target)
+		}
+		f.KVPath, f.KVKey = path, key
+
+		parsed = append(parsed, f)
+	}
+
+	return parsed, nil
+}
+
+// checkBuildSecretsAllowed returns an error naming the first KV secret of
+// the files that the config's allowed_kv_paths does not allow
+func checkBuildSecretsAllowed(config *balenaConfig, kvMount string, files []balenaBuildSecretFile) error {
+	for _, f := range files {
+		if !kvPathAllowed(config, kvMount, f.KVPath) {
+			return fmt.Errorf("kv secret %s/%s of %q is not allowed by allowed_kv_paths", kvMount, f.KVPath, f.Dest)
+		}
+	}
+
+	return nil
+}
+
+// renderBuildSecrets reads the KV values of a definition and packs them
+// into a tar archive, together with the balena.yml section mapping them to
+// the builds.
+func renderBuildSecrets(ctx context.Context, vault *api.Client, secrets *balenaBuildSecrets) ([]byte, []balenaBuildSecretFile, error) {
+	files, err := buildSecretFiles(secrets.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kv := map[string]map[string]string{}
+	contents := make([][]byte, len(files))
+	for i, f := range files {
+		data, ok := kv[f.KVPath]
+		if !ok {
+			data, err = readKV(ctx, vault, secrets.KVMount, f.KVPath, secrets.KVVersion)
+			if err != nil {
+				return nil, nil, err
+			}
+			kv[f.KVPath] = data
+		}
+
+		value, ok := data[f.KVKey]
+		if !ok {
+			return nil, nil, fmt.Errorf("kv secret %q has no key %q", f.KVPath, f.KVKey)
+		}
+		contents[i] = []byte(value)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	now := time.Now()
+	write := func(name string, content []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0o600,
+			Size:    int64(len(content)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+
+	for i, f := range files {
+		if err := write(buildSecretsDir+f.Source, contents[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := write(buildSecretsYAMLFile, buildSecretsYAML(files)); err != nil {
+		return nil, nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	return buf.Bytes(), files, nil
+}
+
+// buildSecretsYAML renders the build-secrets section of balena.yml. The
+// names are restricted by buildSecretNameRegex, so they need no quoting.
+func buildSecretsYAML(files []balenaBuildSecretFile) []byte {
+	var global []balenaBuildSecretFile
+	services := map[string][]balenaBuildSecretFile{}
+	var names []string
+	for _, f := range files {
+		if f.Service == "" {
+			global = append(global, f)
+			continue
+		}
+		if _, ok := services[f.Service]; !ok {
+			names = append(names, f.Service)
+		}
+		services[f.Service] = append(services[f.Service], f)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("build-secrets:\n")
+
+	entries := func(indent string, files []balenaBuildSecretFile) {
+		for _, f := range files {
+			fmt.Fprintf(&b, "%s- source: %s\n%s  dest: %s\n", indent, f.Source, indent, f.Dest)
+		}
+	}
+
+	if len(global) > 0 {
+		b.WriteString("  global:\n")
+		entries("    ", global)
+	}
+
+	if len(names) > 0 {
+		b.WriteString("  services:\n")
+		for _, name := range names {
+			fmt.Fprintf(&b, "    %s:\n", name)
+			entries("      ", services[name])
+		}
+	}
+
+	return []byte(b.String())
+}
+
+// getBuildSecrets returns a build secrets definition, or nil if there is none
+func getBuildSecrets(ctx context.Context, s logical.Storage, name string) (*balenaBuildSecrets, error) {
+	entry, err := s.Get(ctx, buildSecretsStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var secrets balenaBuildSecrets
+	if err := entry.DecodeJSON(&secrets); err != nil {
+		return nil, fmt.Errorf("error reading build secrets: %w", err)
+	}
+
+	return &secrets, nil
+}
@@ -0,0 +1,175 @@
+package balenakeys
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// deviceUUIDRegex matches balena device UUIDs, which are lower case hex
+var deviceUUIDRegex = regexp.MustCompile(`^[0-9a-f]{7,62}$`)
+
+// balenaDevice is the subset of a balena device this backend works with
+type balenaDevice struct {
+	ID       int           `json:"id"`
+	UUID     string        `json:"uuid"`
+	Fleets   []balenaFleet `json:"belongs_to__application"`
+	IsOnline bool          `json:"is_online"`
+}
+
+// fleet returns the fleet the device belongs to
+func (d *balenaDevice) fleet() balenaFleet {
+	if len(d.Fleets) == 0 {
+		return balenaFleet{}
+	}
+	return d.Fleets[0]
+}
+
+// getDevice looks up a device by UUID, returning nil when the
+// account cannot see such a device
+func getDevice(ctx context.Context, c *balenaClient, deviceUUID string) (*balenaDevice, error) {
+	if !deviceUUIDRegex.MatchString(deviceUUID) {
+		return nil, fmt.Errorf("invalid device uuid %q", deviceUUID)
+	}
+
+	var devices struct {
+		D []balenaDevice `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/device?$select=id,uuid,is_online&$expand=belongs_to__application($select=id,slug)&$filter=uuid%%20eq%%20%%27%s%%27", deviceUUID), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Do(req, &devices); err != nil {
+		return nil, fmt.Errorf("error getting balena device: %w", err)
+	}
+
+	if len(devices.D) == 0 {
+		return nil, nil
+	}
+
+	return &devices.D[0], nil
+}
+
+// roleDevice looks up a device the role may act on, returning an error
+// response when the device is missing or outside the role's allow-lists
+func roleDevice(ctx context.Context, c *balenaClient, role *balenaRoleEntry, deviceUUID string) (*balenaDevice, *logical.Response, error) {
+	if deviceUUID == "" {
+		return nil, logical.ErrorResponse("device_uuid is required"), nil
+	}
+
+	if !deviceAllowed(role.AllowedDeviceUUIDs, deviceUUID) {
+		return nil, logical.ErrorResponse("device %q is not allowed by role %q", deviceUUID, role.Name), nil
+	}
+
+	device, err := getDevice(ctx, c, deviceUUID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if device == nil {
+		return nil, logical.ErrorResponse("device %q not found", deviceUUID), nil
+	}
+
+	if !fleetAllowed(role.AllowedFleets, device.fleet()) {
+		return nil, logical.ErrorResponse("fleet of device %q is not allowed by role %q", deviceUUID, role.Name), nil
+	}
+
+	return device, nil, nil
+}
+
+// roleDevices returns the devices a request selects, either the single
+// device given as deviceUUID or the devices in fleet carrying tag. A tag
+// is given as "key" or "key=value". Devices outside the role's
+// allow-lists are rejected with an error response.
+func roleDevices(ctx context.Context, c *balenaClient, role *balenaRoleEntry, deviceUUID string, fleetName string, tag string) ([]balenaDevice, *logical.Response, error) {
+	if (deviceUUID == "") == (tag == "") {
+		return nil, logical.ErrorResponse("exactly one of device_uuid and tag is required"), nil
+	}
+
+	if deviceUUID != "" {
+		device, resp, err := roleDevice(ctx, c, role, deviceUUID)
+		if resp != nil || err != nil {
+			return nil, resp, err
+		}
+		return []balenaDevice{*device}, nil, nil
+	}
+
+	if fleetName == "" {
+		return nil, logical.ErrorResponse("fleet is required to select devices by tag"), nil
+	}
+
+	fleet, err := getFleet(ctx, c, fleetName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fleet == nil {
+		return nil, logical.ErrorResponse("fleet %q not found", fleetName), nil
+	}
+
+	if !fleetAllowed(role.AllowedFleets, *fleet) {
+		return nil, logical.ErrorResponse("fleet %q is not allowed by role %q", fleet.Slug, role.Name), nil
+	}
+
+	tagKey, tagValue, hasValue := strings.Cut(tag, "=")
+	devices, err := listTaggedDevices(ctx, c, fleet.ID, tagKey, tagValue, hasValue)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(devices) == 0 {
+		return nil, logical.ErrorResponse("no devices in fleet %q have tag %q", fleet.Slug, tag), nil
+	}
+
+	for _, device := range devices {
+		if !deviceAllowed(role.AllowedDeviceUUIDs, device.UUID) {
+			return nil, logical.ErrorResponse("device %q is not allowed by role %q", device.UUID, role.Name), nil
+		}
+	}
+
+	return devices, nil, nil
+}
+
+// listTaggedDevices returns the devices of a fleet that carry a tag, with
+// the given value when hasValue is set
+func listTaggedDevices(ctx context.Context, c *balenaClient, fleetID int, tagKey string, tagValue string, hasValue bool) ([]balenaDevice, error) {
+	tagFilter := fmt.Sprintf("t/tag_key%%20eq%%20%s", odataString(tagKey))
+	if hasValue {
+		tagFilter = fmt.Sprintf("(%s)%%20and%%20(t/value%%20eq%%20%s)", tagFilter, odataString(tagValue))
+	}
+
+	var devices struct {
+		D []balenaDevice `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/device?$select=id,uuid,is_online&$expand=belongs_to__application($select=id,slug)&$filter=(belongs_to__application%%20eq%%20%d)%%20and%%20(device_tag/any(t:%s))", fleetID, tagFilter), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Do(req, &devices); err != nil {
+		return nil, fmt.Errorf("error listing balena devices: %w", err)
+	}
+
+	return devices.D, nil
+}
+
+// deviceAllowed reports whether a device UUID is in a list of UUIDs.
+// An empty list allows every device.
+func deviceAllowed(allowed []string, deviceUUID string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, a := range allowed {
+		if strings.EqualFold(a, deviceUUID) {
+			return true
+		}
+	}
+	return false
+}
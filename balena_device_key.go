@@ -0,0 +1,186 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaDeviceKeyType = "balena_device_key"
+)
+
+// balenaDeviceKey defines a secret for a device API key and how it should
+// be revoked or renewed.
+func (b *balenaBackend) balenaDeviceKey() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaDeviceKeyType,
+		Fields: map[string]*framework.FieldSchema{
+			"token": {
+				Type:        framework.TypeString,
+				Description: "Balena device API key",
+			},
+			"device_uuid": {
+				Type:        framework.TypeString,
+				Description: "UUID of the device the key belongs to",
+			},
+		},
+		Revoke: roleLeaseRevoke(b.deviceKeyRevoke),
+		Renew:  b.tokenRenew,
+	}
+}
+
+// createDeviceKeyCreds creates a balena API key scoped to a single device and
+// returns it under a lease.
+func (b *balenaBackend) createDeviceKeyCreds(ctx context.Context, req *logical.Request, role *balenaRoleEntry, deviceUUID string, balenaName string, balenaDesc string, ttl time.Duration) (*logical.Response, error) {
+	if deviceUUID == "" {
+		return logical.ErrorResponse("device_uuid is required for %q roles", deviceKeyCredentialType), nil
+	}
+
+	if !deviceAllowed(role.AllowedDeviceUUIDs, deviceUUID) {
+		return logical.ErrorResponse("device %q is not allowed by role %q", deviceUUID, role.Name), nil
+	}
+
+	client, err := b.getClient(ctx, req.Storage, role.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := getDevice(ctx, client, deviceUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if device == nil {
+		return logical.ErrorResponse("device %q not found", deviceUUID), nil
+	}
+
+	if !fleetAllowed(role.AllowedFleets, device.fleet()) {
+		return logical.ErrorResponse("fleet of device %q is not allowed by role %q", deviceUUID, role.Name), nil
+	}
+
+	token, err := createDeviceToken(ctx, client, device.ID, balenaName, balenaDesc, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := b.Secret(balenaDeviceKeyType).Response(map[string]interface{}{
+		"token":       token.Token,
+		"token_id":    token.TokenID,
+		"key_name":    token.KeyName,
+		"key_desc":    balenaDesc,
+		"device_uuid": device.UUID,
+	}, map[string]interface{}{
+		"token_id":    token.TokenID,
+		"key_name":    token.KeyName,
+		"key_id":      token.KeyID,
+		"role":        role.Name,
+		"key_desc":    balenaDesc,
+		"device_uuid": device.UUID,
+		"ttl":         ttl,
+		"max_ttl":     role.MaxTTL,
+	})
+
+	if ttl > 0 {
+		resp.Secret.TTL = ttl
+	}
+
+	if role.MaxTTL > 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+
+	if err := trackRoleLease(ctx, req.Storage, resp); err != nil {
+		if delErr := deleteTokenID(ctx, client, token.KeyID); delErr != nil {
+			b.Logger().Error("error removing untracked device key", "key_id", token.KeyID, "error", delErr)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// deviceKeyRevoke deletes the device key from balena by the key ID recorded
+// when it was issued
+func (b *balenaBackend) deviceKeyRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName, ok := req.Secret.InternalData["role"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing role internal data")
+	}
+
+	keyID, ok := internalDataInt(req.Secret.InternalData["key_id"])
+	if !ok {
+		return nil, errors.New("secret is missing key_id internal data")
+	}
+
+	roleEntry, err := b.getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return nil, fmt.Errorf("error retrieving role: role %q not found", roleName)
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	if err := deleteTokenID(ctx, client, keyID); err != nil {
+		return nil, fmt.Errorf("error revoking device key: %w", err)
+	}
+
+	return nil, nil
+}
+
+// createDeviceToken calls the balena client to create an API key for a
+// device, created under its unique token ID so that its balena ID can be
+// looked up
+func createDeviceToken(ctx context.Context, c *balenaClient, deviceID int, balenaName string, balenaDesc string, ttl time.Duration) (*balenaToken, error) {
+	type balenaBody struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Expiry_date string `json:"expiryDate"`
+	}
+
+	tokenID := uuid.New().String()
+
+	if balenaName == "" {
+		balenaName = tokenID
+	}
+
+	req, err := c.NewRequest(ctx, "POST", fmt.Sprintf("api-key/device/%d/device-key", deviceID), "", balenaBody{
+		Name:        tokenID,
+		Description: balenaDesc,
+		Expiry_date: balenaExpiryDate(ttl),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var token string
+	if err := c.Do(req, &token); err != nil {
+		return nil, fmt.Errorf("error creating balena device token: %w", err)
+	}
+
+	if token == "" {
+		return nil, errors.New("error creating balena device token: empty key")
+	}
+
+	keyID, err := identifyToken(ctx, c, tokenID, balenaName, balenaDesc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &balenaToken{
+		TokenID: tokenID,
+		Token:   token,
+		KeyName: balenaName,
+		KeyID:   keyID,
+	}, nil
+}
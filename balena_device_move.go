@@ -0,0 +1,267 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaDeviceMoveType    = "balena_device_move"
+	deviceMoveStoragePrefix = "device-move/"
+)
+
+// balenaDeviceMove records a device a lease moved to another fleet, and the
+// fleet it has to be moved back to. A move stays recorded after the lease
+// ends until the device is back, so a failed return can be retried.
+type balenaDeviceMove struct {
+	ID          string    `json:"id"`
+	Role        string    `json:"role"`
+	DeviceID    int       `json:"device_id"`
+	DeviceUUID  string    `json:"device_uuid"`
+	FromFleetID int       `json:"from_fleet_id"`
+	FromFleet   string    `json:"from_fleet"`
+	ToFleetID   int       `json:"to_fleet_id"`
+	ToFleet     string    `json:"to_fleet"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	RevokedAt   time.Time `json:"revoked_at,omitempty"`
+}
+
+// active reports whether the move's lease is still in effect at now
+func (m *balenaDeviceMove) active(now time.Time) bool {
+	return m.RevokedAt.IsZero() && now.Before(m.ExpiresAt)
+}
+
+// balenaDeviceMove defines a secret for a device temporarily moved to
+// another fleet and how it should be revoked or renewed.
+func (b *balenaBackend) balenaDeviceMove() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaDeviceMoveType,
+		Fields: map[string]*framework.FieldSchema{
+			"device_uuid": {
+				Type:        framework.TypeString,
+				Description: "UUID of the moved device",
+			},
+			"from_fleet": {
+				Type:        framework.TypeString,
+				Description: "Slug of the fleet the device is moved back to when the lease ends",
+			},
+			"fleet": {
+				Type:        framework.TypeString,
+				Description: "Slug of the fleet the device was moved to",
+			},
+		},
+		Revoke: b.deviceMoveRevoke,
+		Renew:  b.deviceMoveRenew,
+	}
+}
+
+// deviceMoveRevoke marks the move revoked and moves the device back to its
+// original fleet. If that fails the move stays recorded, and the periodic
+// function keeps trying.
+func (b *balenaBackend) deviceMoveRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	moveID, ok := req.Secret.InternalData["move_id"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing move_id internal data")
+	}
+
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	move, err := getDeviceMove(ctx, req.Storage, moveID)
+	if err != nil {
+		return nil, err
+	}
+
+	if move == nil {
+		return nil, nil
+	}
+
+	move.RevokedAt = time.Now()
+	if err := putDeviceMove(ctx, req.Storage, move); err != nil {
+		return nil, err
+	}
+
+	if err := b.returnDevice(ctx, req.Storage, move); err != nil {
+		return nil, fmt.Errorf("error revoking device move: %w", err)
+	}
+
+	return nil, nil
+}
+
+// deviceMoveRenew extends the lease and moves the move's expiry with it
+func (b *balenaBackend) deviceMoveRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	resp, err := b.tokenRenew(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	moveID, ok := req.Secret.InternalData["move_id"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing move_id internal data")
+	}
+
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	move, err := getDeviceMove(ctx, req.Storage, moveID)
+	if err != nil {
+		return nil, err
+	}
+
+	if move == nil {
+		return nil, fmt.Errorf("device move %q not found", moveID)
+	}
+
+	move.ExpiresAt = renewedLeaseEnd(req, resp)
+
+	if err := putDeviceMove(ctx, req.Storage, move); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// reconcileDeviceMoves moves devices back whose lease ended but whose
+// return failed or was never attempted, such as when Vault gave up revoking
+// the lease or the move was recorded by a request that did not finish.
+func (b *balenaBackend) reconcileDeviceMoves(ctx context.Context, s logical.Storage) error {
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	moves, err := listDeviceMoves(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, move := range moves {
+		if move.active(now) {
+			continue
+		}
+
+		if move.RevokedAt.IsZero() {
+			move.RevokedAt = now
+			if err := putDeviceMove(ctx, s, move); err != nil {
+				return err
+			}
+		}
+
+		if err := b.returnDevice(ctx, s, move); err != nil {
+			b.Logger().Error("error moving device back to its fleet", "device_uuid", move.DeviceUUID, "fleet", move.FromFleet, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// returnDevice moves a device back to the fleet it was moved from and
+// forgets the move. A device that was deleted, or moved to a third fleet
+// outside of Vault, is left where it is.
+func (b *balenaBackend) returnDevice(ctx context.Context, s logical.Storage, move *balenaDeviceMove) error {
+	role, err := b.getRole(ctx, s, move.Role)
+	if err != nil {
+		return fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if role == nil {
+		return fmt.Errorf("error retrieving role: role %q not found", move.Role)
+	}
+
+	client, err := b.getClient(ctx, s, role.BalenaApiKey)
+	if err != nil {
+		return fmt.Errorf("error getting client: %w", err)
+	}
+
+	device, err := getDevice(ctx, client, move.DeviceUUID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case device == nil:
+		b.Logger().Warn("moved device no longer exists", "device_uuid", move.DeviceUUID)
+	case device.fleet().ID == move.ToFleetID:
+		if err := moveDevice(ctx, client, move.DeviceID, move.FromFleetID); err != nil {
+			return err
+		}
+	case device.fleet().ID != move.FromFleetID:
+		b.Logger().Warn("not moving back device moved to another fleet outside of Vault", "device_uuid", move.DeviceUUID, "fleet", device.fleet().Slug)
+	}
+
+	return s.Delete(ctx, deviceMoveStoragePrefix+move.ID)
+}
+
+// getDeviceMove returns a recorded device move, or nil if there is none
+func getDeviceMove(ctx context.Context, s logical.Storage, id string) (*balenaDeviceMove, error) {
+	entry, err := s.Get(ctx, deviceMoveStoragePrefix+id)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var move balenaDeviceMove
+	if err := entry.DecodeJSON(&move); err != nil {
+		return nil, fmt.Errorf("error reading device move: %w", err)
+	}
+
+	return &move, nil
+}
+
+// putDeviceMove records a device move in storage
+func putDeviceMove(ctx context.Context, s logical.Storage, move *balenaDeviceMove) error {
+	entry, err := logical.StorageEntryJSON(deviceMoveStoragePrefix+move.ID, move)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// listDeviceMoves returns every recorded device move
+func listDeviceMoves(ctx context.Context, s logical.Storage) ([]*balenaDeviceMove, error) {
+	ids, err := s.List(ctx, deviceMoveStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var moves []*balenaDeviceMove
+	for _, id := range ids {
+		move, err := getDeviceMove(ctx, s, id)
+		if err != nil {
+			return nil, err
+		}
+		if move != nil {
+			moves = append(moves, move)
+		}
+	}
+
+	return moves, nil
+}
+
+// moveDevice calls the balena client to move a device to another fleet
+func moveDevice(ctx context.Context, c *balenaClient, deviceID int, fleetID int) error {
+	type balenaBody struct {
+		Fleet int `json:"belongs_to__application"`
+	}
+
+	req, err := c.NewRequest(ctx, "PATCH", fmt.Sprintf("v6/device(%d)", deviceID), "", balenaBody{
+		Fleet: fleetID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error moving balena device: %w", err)
+	}
+
+	return nil
+}
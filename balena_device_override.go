@@ -0,0 +1,377 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaDeviceOverrideType     = "balena_device_override"
+	deviceOverrideStoragePrefix  = "device-override/"
+	deviceConfigVariableResource = "device_config_variable"
+	deviceEnvironmentVarResource = "device_environment_variable"
+)
+
+// envVarNameRegex matches the variable names balena accepts
+var envVarNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// balenaOverride records the variables a lease overrode on each
+// device and what they were before, so they can be restored on revocation.
+// Orphaned is set when the override failed to apply and could not be
+// undone, so no lease holds it and the periodic function retries the restore.
+type balenaOverride struct {
+	ID       string                 `json:"id"`
+	Role     string                 `json:"role"`
+	Devices  []balenaOverrideDevice `json:"devices"`
+	Orphaned bool                   `json:"orphaned"`
+}
+
+// balenaOverrideDevice holds the overridden variables of one device
+type balenaOverrideDevice struct {
+	ID   int                 `json:"id"`
+	UUID string              `json:"uuid"`
+	Vars []balenaOverrideVar `json:"vars"`
+}
+
+// balenaOverrideVar is one overridden variable. Resource is the
+// balena resource it lives in, and Previous its value before the override
+// when Existed is set.
+type balenaOverrideVar struct {
+	Resource string `json:"resource"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Existed  bool   `json:"existed"`
+	Previous string `json:"previous,omitempty"`
+}
+
+// balenaDeviceOverride defines a secret for temporary device variable
+// overrides and how it should be revoked or renewed.
+func (b *balenaBackend) balenaDeviceOverride() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaDeviceOverrideType,
+		Fields: map[string]*framework.FieldSchema{
+			"devices": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "UUIDs of the devices the variables were overridden on",
+			},
+		},
+		Revoke: b.deviceOverrideRevoke,
+		Renew:  b.tokenRenew,
+	}
+}
+
+// deviceOverrideRevoke restores the overridden variables and forgets the override
+func (b *balenaBackend) deviceOverrideRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	overrideID, ok := req.Secret.InternalData["override_id"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing override_id internal data")
+	}
+
+	b.overrideLock.Lock()
+	defer b.overrideLock.Unlock()
+
+	override, err := getDeviceOverride(ctx, req.Storage, overrideID)
+	if err != nil {
+		return nil, err
+	}
+
+	if override == nil {
+		return nil, nil
+	}
+
+	if err := b.removeDeviceOverride(ctx, req.Storage, override); err != nil {
+		return nil, fmt.Errorf("error revoking device override: %w", err)
+	}
+
+	return nil, nil
+}
+
+// reconcileDeviceOverrides retries restoring the variables of orphaned
+// device overrides, whose apply failed and whose restore failed right after it
+func (b *balenaBackend) reconcileDeviceOverrides(ctx context.Context, s logical.Storage) error {
+	b.overrideLock.Lock()
+	defer b.overrideLock.Unlock()
+
+	overrides, err := listDeviceOverrides(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	for _, override := range overrides {
+		if !override.Orphaned {
+			continue
+		}
+
+		if err := b.removeDeviceOverride(ctx, s, override); err != nil {
+			b.Logger().Error("error restoring orphaned device override", "override_id", override.ID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// removeDeviceOverride restores the overridden variables with the
+// override's role and forgets the override
+func (b *balenaBackend) removeDeviceOverride(ctx context.Context, s logical.Storage, override *balenaOverride) error {
+	roleEntry, err := b.getRole(ctx, s, override.Role)
+	if err != nil {
+		return fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return fmt.Errorf("error retrieving role: role %q not found", override.Role)
+	}
+
+	client, err := b.getClient(ctx, s, roleEntry.BalenaApiKey)
+	if err != nil {
+		return fmt.Errorf("error getting client: %w", err)
+	}
+
+	if err := restoreDeviceOverride(ctx, client, override); err != nil {
+		return err
+	}
+
+	return s.Delete(ctx, deviceOverrideStoragePrefix+override.ID)
+}
+
+// overriddenVar returns the device UUID and name of the first of vars that
+// a recorded override or managed variable canary already holds on one of
+// devices, or "" when none is held
+func overriddenVar(ctx context.Context, s logical.Storage, devices []balenaDevice, vars []balenaOverrideVar) (string, string, error) {
+	overrides, err := listDeviceOverrides(ctx, s)
+	if err != nil {
+		return "", "", err
+	}
+
+	type deviceVar struct {
+		deviceID int
+		resource string
+		name     string
+	}
+
+	// the canary devices of a managed variable's rotation hold its
+	// variable the same way
+	states, err := s.List(ctx, managedVarStateStoragePrefix)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, name := range states {
+		state, err := getManagedVarState(ctx, s, name)
+		if err != nil {
+			return "", "", err
+		}
+		if state.Canary != nil {
+			overrides = append(overrides, state.Canary)
+		}
+	}
+
+	overridden := make(map[deviceVar]bool)
+	for _, override := range overrides {
+		for _, device := range override.Devices {
+			for _, v := range device.Vars {
+				overridden[deviceVar{device.ID, v.Resource, v.Name}] = true
+			}
+		}
+	}
+
+	for _, device := range devices {
+		for _, v := range vars {
+			if overridden[deviceVar{device.ID, v.Resource, v.Name}] {
+				return device.UUID, v.Name, nil
+			}
+		}
+	}
+
+	return "", "", nil
+}
+
+// recordDeviceOverride looks up the current value of each variable that is
+// about to be overridden on the devices
+func recordDeviceOverride(ctx context.Context, c *balenaClient, override *balenaOverride, devices []balenaDevice, vars []balenaOverrideVar) error {
+	for _, device := range devices {
+		overrideDevice := balenaOverrideDevice{ID: device.ID, UUID: device.UUID}
+
+		for _, v := range vars {
+			current, err := getDeviceVar(ctx, c, v.Resource, device.ID, v.Name)
+			if err != nil {
+				return err
+			}
+
+			if current != nil {
+				v.Existed = true
+				v.Previous = current.Value
+			}
+			overrideDevice.Vars = append(overrideDevice.Vars, v)
+		}
+
+		override.Devices = append(override.Devices, overrideDevice)
+	}
+
+	return nil
+}
+
+// applyDeviceOverride sets each overridden variable to its new value
+func applyDeviceOverride(ctx context.Context, c *balenaClient, override *balenaOverride) error {
+	for _, device := range override.Devices {
+		for _, v := range device.Vars {
+			if err := setDeviceVar(ctx, c, v.Resource, device.ID, v.Name, v.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// restoreDeviceOverride puts back the previous value of each overridden
+// variable, and removes the variables the override created
+func restoreDeviceOverride(ctx context.Context, c *balenaClient, override *balenaOverride) error {
+	for _, device := range override.Devices {
+		for _, v := range device.Vars {
+			if v.Existed {
+				if err := setDeviceVar(ctx, c, v.Resource, device.ID, v.Name, v.Previous); err != nil {
+					return err
+				}
+				continue
+			}
+
+			current, err := getDeviceVar(ctx, c, v.Resource, device.ID, v.Name)
+			if err != nil {
+				return err
+			}
+
+			if current == nil {
+				continue
+			}
+
+			if err := deleteDeviceVar(ctx, c, v.Resource, current.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// getDeviceOverride returns a recorded device override, or nil if there is none
+func getDeviceOverride(ctx context.Context, s logical.Storage, id string) (*balenaOverride, error) {
+	entry, err := s.Get(ctx, deviceOverrideStoragePrefix+id)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var override balenaOverride
+	if err := entry.DecodeJSON(&override); err != nil {
+		return nil, fmt.Errorf("error reading device override: %w", err)
+	}
+
+	return &override, nil
+}
+
+// listDeviceOverrides returns every recorded device override
+func listDeviceOverrides(ctx context.Context, s logical.Storage) ([]*balenaOverride, error) {
+	ids, err := s.List(ctx, deviceOverrideStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var overrides []*balenaOverride
+	for _, id := range ids {
+		override, err := getDeviceOverride(ctx, s, id)
+		if err != nil {
+			return nil, err
+		}
+		if override != nil {
+			overrides = append(overrides, override)
+		}
+	}
+
+	return overrides, nil
+}
+
+// putDeviceOverride records a device override in storage
+func putDeviceOverride(ctx context.Context, s logical.Storage, override *balenaOverride) error {
+	entry, err := logical.StorageEntryJSON(deviceOverrideStoragePrefix+override.ID, override)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// getDeviceVar returns a device variable by name from resource, or nil
+// when the device has no such variable
+func getDeviceVar(ctx context.Context, c *balenaClient, resource string, deviceID int, name string) (*balenaEnvVar, error) {
+	var vars struct {
+		D []balenaEnvVar `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/%s?$select=id,name,value&$filter=(device%%20eq%%20%d)%%20and%%20(name%%20eq%%20%%27%s%%27)", resource, deviceID, name), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Do(req, &vars); err != nil {
+		return nil, fmt.Errorf("error getting balena device variable %q: %w", name, err)
+	}
+
+	if len(vars.D) == 0 {
+		return nil, nil
+	}
+
+	return &vars.D[0], nil
+}
+
+// setDeviceVar calls the balena client to create or update a device variable
+func setDeviceVar(ctx context.Context, c *balenaClient, resource string, deviceID int, name string, value string) error {
+	current, err := getDeviceVar(ctx, c, resource, deviceID, name)
+	if err != nil {
+		return err
+	}
+
+	type balenaBody struct {
+		Device int    `json:"device,omitempty"`
+		Name   string `json:"name,omitempty"`
+		Value  string `json:"value"`
+	}
+
+	method, path, body := "POST", "v6/"+resource, balenaBody{Device: deviceID, Name: name, Value: value}
+	if current != nil {
+		method, path, body = "PATCH", fmt.Sprintf("v6/%s(%d)", resource, current.ID), balenaBody{Value: value}
+	}
+
+	req, err := c.NewRequest(ctx, method, path, "", body)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error setting balena device variable %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// deleteDeviceVar calls the balena client to remove a device variable
+func deleteDeviceVar(ctx context.Context, c *balenaClient, resource string, varID int) error {
+	req, err := c.NewRequest(ctx, "DELETE", fmt.Sprintf("v6/%s(%d)", resource, varID), "", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error deleting balena device variable: %w", err)
+	}
+
+	return nil
+}
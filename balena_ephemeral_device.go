@@ -0,0 +1,139 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaEphemeralDeviceType = "balena_ephemeral_device"
+)
+
+// balenaEphemeralDevice defines a secret for a throwaway device registered
+// in a fleet and how it should be revoked or renewed.
+func (b *balenaBackend) balenaEphemeralDevice() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaEphemeralDeviceType,
+		Fields: map[string]*framework.FieldSchema{
+			"uuid": {
+				Type:        framework.TypeString,
+				Description: "UUID of the registered device",
+			},
+			"device_api_key": {
+				Type:        framework.TypeString,
+				Description: "API key the device authenticates with",
+			},
+		},
+		Revoke: roleLeaseRevoke(b.ephemeralDeviceRevoke),
+		Renew:  b.tokenRenew,
+	}
+}
+
+// createEphemeralDeviceCreds registers a device in the role's fleet that is
+// deleted again when the lease ends
+func (b *balenaBackend) createEphemeralDeviceCreds(ctx context.Context, req *logical.Request, role *balenaRoleEntry, ttl time.Duration) (*logical.Response, error) {
+	client, err := b.getClient(ctx, req.Storage, role.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fleet, err := getFleet(ctx, client, role.Fleet)
+	if err != nil {
+		return nil, err
+	}
+
+	if fleet == nil {
+		return logical.ErrorResponse("fleet %q not found", role.Fleet), nil
+	}
+
+	device, err := preregisterDevice(ctx, client, fleet.ID, role.DeviceType)
+	if err != nil {
+		return nil, err
+	}
+	b.noteOwnDevice(ctx, req.Storage, fleet.ID, device.ID)
+
+	resp := b.Secret(balenaEphemeralDeviceType).Response(map[string]interface{}{
+		"uuid":           device.UUID,
+		"device_id":      device.ID,
+		"device_api_key": device.DeviceApiKey,
+		"device_type":    role.DeviceType,
+		"fleet":          fleet.Slug,
+	}, map[string]interface{}{
+		"device_id": device.ID,
+		"uuid":      device.UUID,
+		"role":      role.Name,
+		"ttl":       ttl,
+		"max_ttl":   role.MaxTTL,
+	})
+
+	if ttl > 0 {
+		resp.Secret.TTL = ttl
+	}
+
+	if role.MaxTTL > 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+
+	// the role can't be deleted while the device still needs its balena key
+	// to be removed again
+	if err := trackRoleLease(ctx, req.Storage, resp); err != nil {
+		if delErr := deleteDevice(ctx, client, device.ID); delErr != nil {
+			b.Logger().Error("error removing untracked device", "device_uuid", device.UUID, "error", delErr)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// ephemeralDeviceRevoke deletes the device from balena
+func (b *balenaBackend) ephemeralDeviceRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName, ok := req.Secret.InternalData["role"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing role internal data")
+	}
+
+	deviceID, ok := internalDataInt(req.Secret.InternalData["device_id"])
+	if !ok {
+		return nil, errors.New("secret is missing device_id internal data")
+	}
+
+	roleEntry, err := b.getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return nil, fmt.Errorf("error retrieving role: role %q not found", roleName)
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	if err := deleteDevice(ctx, client, deviceID); err != nil {
+		return nil, fmt.Errorf("error revoking device: %w", err)
+	}
+
+	return nil, nil
+}
+
+// deleteDevice calls the balena client to delete a device
+func deleteDevice(ctx context.Context, c *balenaClient, deviceID int) error {
+	req, err := c.NewRequest(ctx, "DELETE", fmt.Sprintf("v6/device(%d)", deviceID), "", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error deleting balena device: %w", err)
+	}
+
+	return nil
+}
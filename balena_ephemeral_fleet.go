@@ -0,0 +1,339 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaEphemeralFleetType = "balena_ephemeral_fleet"
+	defaultFleetNameTemplate = "preview-{{random}}"
+)
+
+// fleetNameRegex matches the fleet names balena accepts
+var fleetNameRegex = regexp.MustCompile(`^[\w-]+$`)
+
+// balenaEphemeralFleet defines a secret for a throwaway fleet and how it
+// should be revoked or renewed.
+func (b *balenaBackend) balenaEphemeralFleet() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaEphemeralFleetType,
+		Fields: map[string]*framework.FieldSchema{
+			"fleet_id": {
+				Type:        framework.TypeInt,
+				Description: "ID of the created fleet",
+			},
+			"fleet": {
+				Type:        framework.TypeString,
+				Description: "Slug of the created fleet",
+			},
+			"provisioning_key": {
+				Type:        framework.TypeString,
+				Description: "Provisioning key scoped to the created fleet",
+			},
+		},
+		Revoke: roleLeaseRevoke(b.ephemeralFleetRevoke),
+		Renew:  b.tokenRenew,
+	}
+}
+
+// createEphemeralFleetCreds creates a fleet named from the role's template,
+// copies the template fleet's variables into it and returns a provisioning
+// key that only reaches the new fleet. The fleet, and with it the key, is
+// deleted again when the lease ends.
+func (b *balenaBackend) createEphemeralFleetCreds(ctx context.Context, req *logical.Request, role *balenaRoleEntry, suffix string, ttl time.Duration) (*logical.Response, error) {
+	name, err := fleetName(role.FleetNameTemplate, suffix)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if ttl <= 0 {
+		ttl = b.System().DefaultLeaseTTL()
+	}
+
+	client, err := b.getClient(ctx, req.Storage, role.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	orgID, err := getOrganizationID(ctx, client, role.Organization)
+	if err != nil {
+		return nil, err
+	}
+
+	if orgID == 0 {
+		return logical.ErrorResponse("organization %q not found", role.Organization), nil
+	}
+
+	deviceTypeID, err := getDeviceTypeID(ctx, client, role.DeviceType)
+	if err != nil {
+		return nil, err
+	}
+
+	if deviceTypeID == 0 {
+		return logical.ErrorResponse("device type %q not found", role.DeviceType), nil
+	}
+
+	var template *balenaFleet
+	if role.TemplateFleet != "" {
+		template, err = getFleet(ctx, client, role.TemplateFleet)
+		if err != nil {
+			return nil, err
+		}
+
+		if template == nil {
+			return logical.ErrorResponse("template fleet %q not found", role.TemplateFleet), nil
+		}
+	}
+
+	fleet, err := createFleet(ctx, client, name, orgID, deviceTypeID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key goes away with the fleet on revocation, so it only needs to
+	// outlive the longest the lease can be renewed to
+	keyLifetime := ttl
+	if role.MaxTTL > keyLifetime {
+		keyLifetime = role.MaxTTL
+	}
+
+	provisioningKey, err := setupEphemeralFleet(ctx, client, fleet, template, time.Now().Add(keyLifetime).Add(3*time.Hour))
+	if err != nil {
+		// don't leave a fleet behind without a lease
+		if delErr := deleteFleet(ctx, client, fleet.ID); delErr != nil {
+			b.Logger().Error("error removing partially created fleet", "fleet", fleet.Slug, "error", delErr)
+		}
+		return nil, err
+	}
+
+	resp := b.Secret(balenaEphemeralFleetType).Response(map[string]interface{}{
+		"fleet_id":         fleet.ID,
+		"fleet":            fleet.Slug,
+		"provisioning_key": provisioningKey.Token,
+	}, map[string]interface{}{
+		"fleet_id": fleet.ID,
+		"role":     role.Name,
+		"ttl":      ttl,
+		"max_ttl":  role.MaxTTL,
+	})
+
+	resp.Secret.TTL = ttl
+
+	if role.MaxTTL > 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+
+	// the role can't be deleted while the fleet still needs its balena key
+	// to be removed again
+	if err := trackRoleLease(ctx, req.Storage, resp); err != nil {
+		if delErr := deleteFleet(ctx, client, fleet.ID); delErr != nil {
+			b.Logger().Error("error removing untracked fleet", "fleet", fleet.Slug, "error", delErr)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// setupEphemeralFleet copies the template fleet's variables into a new fleet
+// and creates a provisioning key for it that expires at keyExpiry
+func setupEphemeralFleet(ctx context.Context, c *balenaClient, fleet *balenaFleet, template *balenaFleet, keyExpiry time.Time) (*balenaToken, error) {
+	if template != nil {
+		vars, err := listFleetEnvVars(ctx, c, template.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range vars {
+			if err := createFleetEnvVar(ctx, c, fleet.ID, v.Name, v.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return createProvisioningToken(ctx, c, fleet.ID, "", defaultProvisioningKeyDesc, keyExpiry)
+}
+
+// ephemeralFleetRevoke deletes the fleet from balena
+func (b *balenaBackend) ephemeralFleetRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName, ok := req.Secret.InternalData["role"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing role internal data")
+	}
+
+	fleetID, ok := internalDataInt(req.Secret.InternalData["fleet_id"])
+	if !ok {
+		return nil, errors.New("secret is missing fleet_id internal data")
+	}
+
+	roleEntry, err := b.getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return nil, fmt.Errorf("error retrieving role: role %q not found", roleName)
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	if err := deleteFleet(ctx, client, fleetID); err != nil {
+		return nil, fmt.Errorf("error revoking fleet: %w", err)
+	}
+
+	return nil, nil
+}
+
+// fleetName fills in a fleet name template. "{{suffix}}" is replaced with
+// the caller's suffix and "{{random}}" with a random value.
+func fleetName(template string, suffix string) (string, error) {
+	if template == "" {
+		template = defaultFleetNameTemplate
+	}
+
+	if strings.Contains(template, "{{suffix}}") && suffix == "" {
+		return "", errors.New("fleet_suffix is required by the role's fleet_name_template")
+	}
+
+	random, err := randomHex(4)
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.ReplaceAll(template, "{{suffix}}", suffix)
+	name = strings.ReplaceAll(name, "{{random}}", random)
+
+	if !fleetNameRegex.MatchString(name) {
+		return "", fmt.Errorf("invalid fleet name %q", name)
+	}
+
+	return name, nil
+}
+
+// getDeviceTypeID looks up a device type by slug, returning 0 when there
+// is no such device type
+func getDeviceTypeID(ctx context.Context, c *balenaClient, slug string) (int, error) {
+	if !fleetNameRegex.MatchString(slug) {
+		return 0, fmt.Errorf("invalid device type %q", slug)
+	}
+
+	var deviceTypes struct {
+		D []struct {
+			ID int `json:"id"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/device_type?$select=id&$filter=slug%%20eq%%20%s", odataString(slug)), "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Do(req, &deviceTypes); err != nil {
+		return 0, fmt.Errorf("error getting balena device type: %w", err)
+	}
+
+	if len(deviceTypes.D) == 0 {
+		return 0, nil
+	}
+
+	return deviceTypes.D[0].ID, nil
+}
+
+// createFleet calls the balena client to create a fleet in an organization
+func createFleet(ctx context.Context, c *balenaClient, name string, orgID int, deviceTypeID int) (*balenaFleet, error) {
+	type balenaBody struct {
+		AppName         string `json:"app_name"`
+		Organization    int    `json:"organization"`
+		IsForDeviceType int    `json:"is_for__device_type"`
+	}
+
+	req, err := c.NewRequest(ctx, "POST", "v6/application", "", balenaBody{
+		AppName:         name,
+		Organization:    orgID,
+		IsForDeviceType: deviceTypeID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var fleet balenaFleet
+	if err := c.Do(req, &fleet); err != nil {
+		return nil, fmt.Errorf("error creating balena fleet: %w", err)
+	}
+
+	return &fleet, nil
+}
+
+// deleteFleet calls the balena client to delete a fleet
+func deleteFleet(ctx context.Context, c *balenaClient, fleetID int) error {
+	req, err := c.NewRequest(ctx, "DELETE", fmt.Sprintf("v6/application(%d)", fleetID), "", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error deleting balena fleet: %w", err)
+	}
+
+	return nil
+}
+
+// balenaEnvVar is a fleet or device environment variable
+type balenaEnvVar struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// listFleetEnvVars returns the environment variables of a fleet
+func listFleetEnvVars(ctx context.Context, c *balenaClient, fleetID int) ([]balenaEnvVar, error) {
+	var vars struct {
+		D []balenaEnvVar `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/application_environment_variable?$select=id,name,value&$filter=application%%20eq%%20%d", fleetID), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Do(req, &vars); err != nil {
+		return nil, fmt.Errorf("error listing balena fleet variables: %w", err)
+	}
+
+	return vars.D, nil
+}
+
+// createFleetEnvVar calls the balena client to set an environment variable on a fleet
+func createFleetEnvVar(ctx context.Context, c *balenaClient, fleetID int, name string, value string) error {
+	type balenaBody struct {
+		Application int    `json:"application"`
+		Name        string `json:"name"`
+		Value       string `json:"value"`
+	}
+
+	req, err := c.NewRequest(ctx, "POST", "v6/application_environment_variable", "", balenaBody{
+		Application: fleetID,
+		Name:        name,
+		Value:       value,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error creating balena fleet variable %q: %w", name, err)
+	}
+
+	return nil
+}
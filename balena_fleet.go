@@ -0,0 +1,65 @@
+package balenakeys
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// fleetSlugRegex matches balena fleet slugs such as "myorg/myfleet"
+var fleetSlugRegex = regexp.MustCompile(`^[\w.-]+/[\w.-]+$`)
+
+// balenaFleet identifies a balena fleet (application)
+type balenaFleet struct {
+	ID   int    `json:"id"`
+	Slug string `json:"slug"`
+}
+
+// getFleet looks up a fleet by slug or numeric ID, returning nil when the
+// account cannot see such a fleet
+func getFleet(ctx context.Context, c *balenaClient, fleet string) (*balenaFleet, error) {
+	var filter string
+	if id, err := strconv.Atoi(fleet); err == nil {
+		filter = fmt.Sprintf("id%%20eq%%20%d", id)
+	} else if fleetSlugRegex.MatchString(fleet) {
+		filter = "slug%20eq%20" + odataString(strings.ToLower(fleet))
+	} else {
+		return nil, fmt.Errorf("invalid fleet %q", fleet)
+	}
+
+	var fleets struct {
+		D []balenaFleet `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", "v6/application?$select=id,slug&$filter="+filter, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Do(req, &fleets); err != nil {
+		return nil, fmt.Errorf("error getting balena fleet: %w", err)
+	}
+
+	if len(fleets.D) == 0 {
+		return nil, nil
+	}
+
+	return &fleets.D[0], nil
+}
+
+// fleetAllowed reports whether a fleet is in a list of fleet slugs or IDs.
+// An empty list allows every fleet.
+func fleetAllowed(allowed []string, fleet balenaFleet) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, a := range allowed {
+		if strings.EqualFold(a, fleet.Slug) || a == strconv.Itoa(fleet.ID) {
+			return true
+		}
+	}
+	return false
+}
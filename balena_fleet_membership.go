@@ -0,0 +1,501 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaFleetMembershipType    = "balena_fleet_membership"
+	defaultEntityMetadataKey     = "balena_username"
+	fleetMembershipStoragePrefix = "fleet-membership/"
+)
+
+// balenaFleetMembershipGrant records the leases sharing a fleet membership
+// that this backend created, so that it is only removed once the last of
+// them ends
+type balenaFleetMembershipGrant struct {
+	MembershipRole string   `json:"membership_role"`
+	Leases         []string `json:"leases"`
+}
+
+// membershipRoles lists the fleet membership roles a role can grant
+var membershipRoles = []string{"developer", "operator", "observer"}
+
+// balenaUsernameRegex matches balena usernames
+var balenaUsernameRegex = regexp.MustCompile(`^[\w.-]+$`)
+
+// balenaFleetMembership defines a secret for temporary fleet memberships
+// of a balena user and how they should be revoked or renewed.
+func (b *balenaBackend) balenaFleetMembership() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaFleetMembershipType,
+		Fields: map[string]*framework.FieldSchema{
+			"username": {
+				Type:        framework.TypeString,
+				Description: "Balena username the memberships were granted to",
+			},
+			"fleets": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Slugs of the fleets the user was made a member of",
+			},
+			"membership_role": {
+				Type:        framework.TypeString,
+				Description: "Fleet membership role granted to the user",
+			},
+		},
+		Revoke: roleLeaseRevoke(b.fleetMembershipRevoke),
+		Renew:  b.tokenRenew,
+	}
+}
+
+// createFleetMembershipCreds grants the balena user mapped to the requesting
+// Vault entity a membership on each requested fleet for the lease duration.
+// Memberships granted by another lease are shared with it and only removed
+// when both have ended, while memberships made by hand are left alone.
+func (b *balenaBackend) createFleetMembershipCreds(ctx context.Context, req *logical.Request, role *balenaRoleEntry, fleets []string, ttl time.Duration) (*logical.Response, error) {
+	username, resp, err := b.entityBalenaUsername(req, role)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	if len(fleets) == 0 {
+		fleets = role.AllowedFleets
+	}
+
+	client, err := b.getClient(ctx, req.Storage, role.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*balenaFleet
+	for _, f := range fleets {
+		fleet, err := getFleet(ctx, client, f)
+		if err != nil {
+			return nil, err
+		}
+
+		if fleet == nil {
+			return logical.ErrorResponse("fleet %q not found", f), nil
+		}
+
+		if !fleetAllowed(role.AllowedFleets, *fleet) {
+			return logical.ErrorResponse("fleet %q is not allowed by role %q", fleet.Slug, role.Name), nil
+		}
+		targets = append(targets, fleet)
+	}
+
+	userID, err := getUserID(ctx, client, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if userID == 0 {
+		return logical.ErrorResponse("balena user %q not found", username), nil
+	}
+
+	membershipRoleID, err := getMembershipRoleID(ctx, client, role.MembershipRole)
+	if err != nil {
+		return nil, err
+	}
+
+	b.membershipLock.Lock()
+	defer b.membershipLock.Unlock()
+
+	leaseRef := uuid.New().String()
+	granted := []string{}
+	existing := []string{}
+	membershipIDs := []int{}
+
+	// don't leave part of the grant behind without a lease
+	release := func() {
+		if err := b.releaseFleetMemberships(ctx, req.Storage, client, leaseRef, membershipIDs); err != nil {
+			b.Logger().Error("error removing partial fleet membership", "error", err)
+		}
+	}
+
+	for _, fleet := range targets {
+		id, err := getFleetMembership(ctx, client, userID, fleet.ID)
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		if id != 0 {
+			grant, err := getFleetMembershipGrant(ctx, req.Storage, id)
+			if err != nil {
+				release()
+				return nil, err
+			}
+
+			if grant == nil {
+				existing = append(existing, fleet.Slug)
+				continue
+			}
+
+			if grant.MembershipRole != role.MembershipRole {
+				release()
+				return logical.ErrorResponse("balena user %q is already a %s of fleet %q through another lease", username, grant.MembershipRole, fleet.Slug), nil
+			}
+
+			grant.Leases = append(grant.Leases, leaseRef)
+			if err := putFleetMembershipGrant(ctx, req.Storage, id, grant); err != nil {
+				release()
+				return nil, err
+			}
+
+			granted = append(granted, fleet.Slug)
+			membershipIDs = append(membershipIDs, id)
+			continue
+		}
+
+		id, err = createFleetMembership(ctx, client, userID, fleet.ID, membershipRoleID)
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		granted = append(granted, fleet.Slug)
+		membershipIDs = append(membershipIDs, id)
+
+		if err := putFleetMembershipGrant(ctx, req.Storage, id, &balenaFleetMembershipGrant{
+			MembershipRole: role.MembershipRole,
+			Leases:         []string{leaseRef},
+		}); err != nil {
+			if delErr := deleteFleetMembership(ctx, client, id); delErr != nil {
+				b.Logger().Error("error removing untracked fleet membership", "membership_id", id, "error", delErr)
+			}
+			membershipIDs = membershipIDs[:len(membershipIDs)-1]
+			release()
+			return nil, err
+		}
+	}
+
+	resp = b.Secret(balenaFleetMembershipType).Response(map[string]interface{}{
+		"username":        username,
+		"fleets":          granted,
+		"already_member":  existing,
+		"membership_role": role.MembershipRole,
+	}, map[string]interface{}{
+		"membership_ids":   membershipIDs,
+		"membership_lease": leaseRef,
+		"role":             role.Name,
+		"ttl":              ttl,
+		"max_ttl":          role.MaxTTL,
+	})
+
+	if ttl > 0 {
+		resp.Secret.TTL = ttl
+	}
+
+	if role.MaxTTL > 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+
+	if err := trackRoleLease(ctx, req.Storage, resp); err != nil {
+		release()
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// entityBalenaUsername returns the balena username stored in the metadata of
+// the requesting Vault entity under the role's entity_metadata_key
+func (b *balenaBackend) entityBalenaUsername(req *logical.Request, role *balenaRoleEntry) (string, *logical.Response, error) {
+	if req.EntityID == "" {
+		return "", logical.ErrorResponse("%s roles require a request made by a Vault entity", role.CredentialType), nil
+	}
+
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return "", nil, fmt.Errorf("error looking up entity: %w", err)
+	}
+
+	metadataKey := role.EntityMetadataKey
+	if metadataKey == "" {
+		metadataKey = defaultEntityMetadataKey
+	}
+
+	username := entity.GetMetadata()[metadataKey]
+	if username == "" {
+		return "", logical.ErrorResponse("entity has no %q metadata naming its balena user", metadataKey), nil
+	}
+
+	if !balenaUsernameRegex.MatchString(username) {
+		return "", logical.ErrorResponse("invalid balena username %q", username), nil
+	}
+
+	return username, nil, nil
+}
+
+// fleetMembershipRevoke releases the fleet memberships granted with the lease
+func (b *balenaBackend) fleetMembershipRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName, ok := req.Secret.InternalData["role"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing role internal data")
+	}
+
+	membershipIDs, ok := internalDataInts(req.Secret.InternalData["membership_ids"])
+	if !ok {
+		return nil, errors.New("secret is missing membership_ids internal data")
+	}
+
+	leaseRef, ok := req.Secret.InternalData["membership_lease"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing membership_lease internal data")
+	}
+
+	roleEntry, err := b.getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return nil, fmt.Errorf("error retrieving role: role %q not found", roleName)
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	b.membershipLock.Lock()
+	defer b.membershipLock.Unlock()
+
+	if err := b.releaseFleetMemberships(ctx, req.Storage, client, leaseRef, membershipIDs); err != nil {
+		return nil, fmt.Errorf("error revoking fleet membership: %w", err)
+	}
+
+	return nil, nil
+}
+
+// releaseFleetMemberships drops a lease from each of the fleet memberships
+// and removes the memberships no other lease shares. Memberships that were
+// already removed are skipped, so a failed release can be retried.
+func (b *balenaBackend) releaseFleetMemberships(ctx context.Context, s logical.Storage, c *balenaClient, leaseRef string, membershipIDs []int) error {
+	for _, id := range membershipIDs {
+		grant, err := getFleetMembershipGrant(ctx, s, id)
+		if err != nil {
+			return err
+		}
+
+		if grant == nil {
+			continue
+		}
+
+		leases := make([]string, 0, len(grant.Leases))
+		for _, lease := range grant.Leases {
+			if lease != leaseRef {
+				leases = append(leases, lease)
+			}
+		}
+
+		if len(leases) > 0 {
+			grant.Leases = leases
+			if err := putFleetMembershipGrant(ctx, s, id, grant); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := deleteFleetMembership(ctx, c, id); err != nil {
+			return err
+		}
+
+		if err := s.Delete(ctx, fleetMembershipStoragePath(id)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fleetMembershipStoragePath returns the storage path of a fleet membership grant
+func fleetMembershipStoragePath(membershipID int) string {
+	return fmt.Sprintf("%s%d", fleetMembershipStoragePrefix, membershipID)
+}
+
+// getFleetMembershipGrant returns the leases sharing a fleet membership,
+// or nil when the membership was not granted by this backend
+func getFleetMembershipGrant(ctx context.Context, s logical.Storage, membershipID int) (*balenaFleetMembershipGrant, error) {
+	entry, err := s.Get(ctx, fleetMembershipStoragePath(membershipID))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var grant balenaFleetMembershipGrant
+	if err := entry.DecodeJSON(&grant); err != nil {
+		return nil, fmt.Errorf("error reading fleet membership grant: %w", err)
+	}
+
+	return &grant, nil
+}
+
+// putFleetMembershipGrant records the leases sharing a fleet membership in storage
+func putFleetMembershipGrant(ctx context.Context, s logical.Storage, membershipID int, grant *balenaFleetMembershipGrant) error {
+	entry, err := logical.StorageEntryJSON(fleetMembershipStoragePath(membershipID), grant)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// internalDataInts returns a list of integers from secret internal data,
+// which holds []int before it is stored and []interface{} of float64 after
+func internalDataInts(v interface{}) ([]int, bool) {
+	switch ids := v.(type) {
+	case []int:
+		return ids, true
+	case []interface{}:
+		out := make([]int, 0, len(ids))
+		for _, id := range ids {
+			f, ok := id.(float64)
+			if !ok {
+				return nil, false
+			}
+			out = append(out, int(f))
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// internalDataInt returns an integer from secret internal data, which holds
+// an int before it is stored and a float64 after
+func internalDataInt(v interface{}) (int, bool) {
+	switch id := v.(type) {
+	case int:
+		return id, true
+	case float64:
+		return int(id), true
+	}
+	return 0, false
+}
+
+// getUserID looks up a balena user by username, returning 0 when
+// there is no such user
+func getUserID(ctx context.Context, c *balenaClient, username string) (int, error) {
+	var users struct {
+		D []struct {
+			ID int `json:"id"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/user?$select=id&$filter=username%%20eq%%20%s", odataString(username)), "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Do(req, &users); err != nil {
+		return 0, fmt.Errorf("error getting balena user: %w", err)
+	}
+
+	if len(users.D) == 0 {
+		return 0, nil
+	}
+
+	return users.D[0].ID, nil
+}
+
+// getMembershipRoleID looks up the ID of a fleet membership role by name
+func getMembershipRoleID(ctx context.Context, c *balenaClient, name string) (int, error) {
+	var roles struct {
+		D []struct {
+			ID int `json:"id"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/application_membership_role?$select=id&$filter=name%%20eq%%20%s", odataString(name)), "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Do(req, &roles); err != nil {
+		return 0, fmt.Errorf("error getting balena fleet membership role: %w", err)
+	}
+
+	if len(roles.D) == 0 {
+		return 0, fmt.Errorf("fleet membership role %q not found", name)
+	}
+
+	return roles.D[0].ID, nil
+}
+
+// getFleetMembership returns the ID of a user's membership of a fleet,
+// or 0 when the user is not a member
+func getFleetMembership(ctx context.Context, c *balenaClient, userID int, fleetID int) (int, error) {
+	var memberships struct {
+		D []struct {
+			ID int `json:"id"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/user_application_membership?$select=id&$filter=(user%%20eq%%20%d)%%20and%%20(is_member_of__application%%20eq%%20%d)", userID, fleetID), "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Do(req, &memberships); err != nil {
+		return 0, fmt.Errorf("error getting balena fleet membership: %w", err)
+	}
+
+	if len(memberships.D) == 0 {
+		return 0, nil
+	}
+
+	return memberships.D[0].ID, nil
+}
+
+// createFleetMembership calls the balena client to make a user a member of a fleet
+func createFleetMembership(ctx context.Context, c *balenaClient, userID int, fleetID int, roleID int) (int, error) {
+	type balenaBody struct {
+		User                      int `json:"user"`
+		IsMemberOfApplication     int `json:"is_member_of__application"`
+		ApplicationMembershipRole int `json:"application_membership_role"`
+	}
+
+	req, err := c.NewRequest(ctx, "POST", "v6/user_application_membership", "", balenaBody{
+		User:                      userID,
+		IsMemberOfApplication:     fleetID,
+		ApplicationMembershipRole: roleID,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var membership struct {
+		ID int `json:"id"`
+	}
+	if err := c.Do(req, &membership); err != nil {
+		return 0, fmt.Errorf("error creating balena fleet membership: %w", err)
+	}
+
+	return membership.ID, nil
+}
+
+// deleteFleetMembership calls the balena client to remove a fleet membership
+func deleteFleetMembership(ctx context.Context, c *balenaClient, membershipID int) error {
+	req, err := c.NewRequest(ctx, "DELETE", fmt.Sprintf("v6/user_application_membership(%d)", membershipID), "", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error deleting balena fleet membership: %w", err)
+	}
+
+	return nil
+}
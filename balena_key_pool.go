@@ -0,0 +1,325 @@
+package balenakeys
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	keyPoolStoragePrefix = "key-pool/"
+	defaultPoolMaxAge    = 24 * time.Hour
+	pooledKeyDesc        = "Vault Pooled Balena Token"
+)
+
+// balenaPooledToken is a pre-created balena key waiting in a role's pool
+// to be handed out.
+type balenaPooledToken struct {
+	Token     string    `json:"token"`
+	TokenID   string    `json:"token_id"`
+	KeyName   string    `json:"key_name"`
+	KeyID     int       `json:"key_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// pooledTokenPath returns the storage path of a pooled key
+func pooledTokenPath(role string, keyName string) string {
+	return keyPoolStoragePrefix + role + "/" + keyName
+}
+
+// poolLifetime returns how long a pooled key must stay valid in balena so
+// that it can still back a full lease when it is checked out at max age.
+func (b *balenaBackend) poolLifetime(role *balenaRoleEntry) time.Duration {
+	maxTTL := role.MaxTTL
+	if maxTTL <= 0 {
+		maxTTL = b.System().MaxLeaseTTL()
+	}
+	return role.PoolMaxAge + maxTTL
+}
+
+// checkoutPooledToken takes the oldest usable key out of the role's pool and
+// renames it for the caller. It returns nil when the pool is empty or the
+// key could not be renamed, so the caller creates a key instead.
+func (b *balenaBackend) checkoutPooledToken(ctx context.Context, s logical.Storage, role *balenaRoleEntry, balenaName string, balenaDesc string) (*balenaToken, error) {
+	client, err := b.getClient(ctx, s, role.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pooled, err := b.claimPooledToken(ctx, s, role)
+	if err != nil || pooled == nil {
+		return nil, err
+	}
+
+	if balenaName == "" {
+		balenaName = pooled.KeyName
+	}
+
+	if err := renameToken(ctx, client, pooled.KeyName, balenaName, balenaDesc); err != nil {
+		b.Logger().Error("error renaming pooled balena token", "key_name", pooled.KeyName, "error", err)
+
+		// the key is dropped from the pool rather than retried, as it may
+		// be gone from balena; if deleting it fails, the entry goes back
+		// for refillKeyPool to clean up once it ages out
+		if err := deleteToken(ctx, client, pooled.KeyName); err != nil {
+			b.Logger().Error("error deleting pooled balena token", "key_name", pooled.KeyName, "error", err)
+			return nil, b.returnPooledTokens(ctx, s, role, pooled)
+		}
+		return nil, nil
+	}
+
+	return &balenaToken{
+		TokenID: pooled.TokenID,
+		Token:   pooled.Token,
+		KeyName: balenaName,
+		KeyID:   pooled.KeyID,
+	}, nil
+}
+
+// claimPooledToken removes the oldest pooled key that has not reached the
+// role's pool_max_age from the pool and returns it, so that no other
+// checkout can hand out the same key
+func (b *balenaBackend) claimPooledToken(ctx context.Context, s logical.Storage, role *balenaRoleEntry) (*balenaPooledToken, error) {
+	b.poolLock.Lock()
+	defer b.poolLock.Unlock()
+
+	pooled, err := b.nextPooledToken(ctx, s, role)
+	if err != nil || pooled == nil {
+		return nil, err
+	}
+
+	if err := s.Delete(ctx, pooledTokenPath(role.Name, pooled.KeyName)); err != nil {
+		return nil, err
+	}
+
+	return pooled, nil
+}
+
+// nextPooledToken returns the oldest pooled key that has not reached the
+// role's pool_max_age, leaving it in the pool. Callers must hold poolLock.
+func (b *balenaBackend) nextPooledToken(ctx context.Context, s logical.Storage, role *balenaRoleEntry) (*balenaPooledToken, error) {
+	pool, err := listPooledTokens(ctx, s, role.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, pooled := range pool {
+		if now.Sub(pooled.CreatedAt) < role.PoolMaxAge {
+			return pooled, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// claimStalePooledTokens removes the pooled keys that are past
+// pool_max_age, or every pooled key when all is set, from the pool and
+// returns them together with the number of warm keys left
+func (b *balenaBackend) claimStalePooledTokens(ctx context.Context, s logical.Storage, role *balenaRoleEntry, all bool) ([]*balenaPooledToken, int, error) {
+	b.poolLock.Lock()
+	defer b.poolLock.Unlock()
+
+	pool, err := listPooledTokens(ctx, s, role.Name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	stale := []*balenaPooledToken{}
+	warm := 0
+	for _, pooled := range pool {
+		if !all && now.Sub(pooled.CreatedAt) < role.PoolMaxAge {
+			warm++
+			continue
+		}
+
+		if err := s.Delete(ctx, pooledTokenPath(role.Name, pooled.KeyName)); err != nil {
+			return nil, 0, err
+		}
+		stale = append(stale, pooled)
+	}
+
+	return stale, warm, nil
+}
+
+// returnPooledTokens puts keys back into the role's pool, so that keys which
+// could not be deleted from balena are retried later
+func (b *balenaBackend) returnPooledTokens(ctx context.Context, s logical.Storage, role *balenaRoleEntry, pool ...*balenaPooledToken) error {
+	b.poolLock.Lock()
+	defer b.poolLock.Unlock()
+
+	for _, pooled := range pool {
+		entry, err := logical.StorageEntryJSON(pooledTokenPath(role.Name, pooled.KeyName), pooled)
+		if err != nil {
+			return err
+		}
+		if err := s.Put(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deletePooledTokens deletes keys taken out of the role's pool from balena,
+// putting back the ones that could not be deleted
+func (b *balenaBackend) deletePooledTokens(ctx context.Context, s logical.Storage, c *balenaClient, role *balenaRoleEntry, pool []*balenaPooledToken) error {
+	for i, pooled := range pool {
+		if err := deleteToken(ctx, c, pooled.KeyName); err != nil {
+			if putErr := b.returnPooledTokens(ctx, s, role, pool[i:]...); putErr != nil {
+				b.Logger().Error("error returning pooled balena tokens", "role", role.Name, "error", putErr)
+			}
+			return fmt.Errorf("error deleting pooled token: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// refillKeyPool deletes pooled keys that are past pool_max_age and, once
+// fewer than pool_min_warm keys are left, tops the pool back up to pool_size.
+// Keys are created and deleted in balena without holding poolLock, which
+// only guards the pool's storage entries.
+func (b *balenaBackend) refillKeyPool(ctx context.Context, s logical.Storage, role *balenaRoleEntry) error {
+	client, err := b.getClient(ctx, s, role.BalenaApiKey)
+	if err != nil {
+		return fmt.Errorf("error getting client: %w", err)
+	}
+
+	stale, warm, err := b.claimStalePooledTokens(ctx, s, role, false)
+	if err != nil {
+		return err
+	}
+
+	if err := b.deletePooledTokens(ctx, s, client, role, stale); err != nil {
+		return err
+	}
+
+	if warm >= role.poolMinWarm() {
+		return nil
+	}
+
+	lifetime := b.poolLifetime(role)
+	for ; warm < role.PoolSize; warm++ {
+		token, err := createToken(ctx, client, "", pooledKeyDesc, lifetime)
+		if err != nil {
+			return fmt.Errorf("error creating pooled token: %w", err)
+		}
+
+		created := time.Now()
+		if err := b.returnPooledTokens(ctx, s, role, &balenaPooledToken{
+			Token:     token.Token,
+			TokenID:   token.TokenID,
+			KeyName:   token.KeyName,
+			KeyID:     token.KeyID,
+			CreatedAt: created,
+			ExpiresAt: created.Add(lifetime),
+		}); err != nil {
+			if delErr := deleteToken(ctx, client, token.KeyName); delErr != nil {
+				b.Logger().Error("error removing unpooled balena token", "key_name", token.KeyName, "error", delErr)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// drainKeyPool deletes every pooled key of the role from balena and storage
+func (b *balenaBackend) drainKeyPool(ctx context.Context, s logical.Storage, role *balenaRoleEntry) error {
+	pool, _, err := b.claimStalePooledTokens(ctx, s, role, true)
+	if err != nil || len(pool) == 0 {
+		return err
+	}
+
+	client, err := b.getClient(ctx, s, role.BalenaApiKey)
+	if err != nil {
+		if putErr := b.returnPooledTokens(ctx, s, role, pool...); putErr != nil {
+			b.Logger().Error("error returning pooled balena tokens", "role", role.Name, "error", putErr)
+		}
+		return fmt.Errorf("error getting client: %w", err)
+	}
+
+	return b.deletePooledTokens(ctx, s, client, role, pool)
+}
+
+// refillKeyPools refills the pool of every role that has one configured and
+// drains the pools of roles that no longer have one
+func (b *balenaBackend) refillKeyPools(ctx context.Context, s logical.Storage) error {
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	// a paused mount must not create keys in the background either
+	if config != nil && config.IssuancePaused {
+		return nil
+	}
+
+	roles, err := listRoles(ctx, s, "")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range roles {
+		role, err := b.getRole(ctx, s, name)
+		if err != nil {
+			return err
+		}
+
+		if role == nil || role.Disabled {
+			continue
+		}
+
+		// keys left over from a pool that was turned off are drained
+		if role.PoolSize <= 0 {
+			if err := b.drainKeyPool(ctx, s, role); err != nil {
+				b.Logger().Error("error draining key pool", "role", name, "error", err)
+			}
+			continue
+		}
+
+		// one broken role should not keep the other pools cold
+		if err := b.refillKeyPool(ctx, s, role); err != nil {
+			b.Logger().Error("error refilling key pool", "role", name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// listPooledTokens returns the pooled keys of a role, oldest first
+func listPooledTokens(ctx context.Context, s logical.Storage, roleName string) ([]*balenaPooledToken, error) {
+	keys, err := s.List(ctx, keyPoolStoragePrefix+roleName+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	pool := make([]*balenaPooledToken, 0, len(keys))
+	for _, keyName := range keys {
+		entry, err := s.Get(ctx, pooledTokenPath(roleName, keyName))
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+
+		var pooled balenaPooledToken
+		if err := entry.DecodeJSON(&pooled); err != nil {
+			return nil, fmt.Errorf("error reading pooled token: %w", err)
+		}
+		pool = append(pool, &pooled)
+	}
+
+	sort.Slice(pool, func(i, j int) bool {
+		return pool[i].CreatedAt.Before(pool[j].CreatedAt)
+	})
+
+	return pool, nil
+}
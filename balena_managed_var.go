@@ -0,0 +1,437 @@
+package balenakeys
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	managedVarStoragePrefix      = "managed-var/"
+	managedVarStateStoragePrefix = "managed-var-state/"
+
+	// managedVarStageCanary is the stage of a rotation whose new value is
+	// only set on the canary devices
+	managedVarStageCanary = "canary"
+
+	defaultManagedVarLength        = 32
+	defaultManagedVarCharset       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	defaultManagedVarCanaryPeriod  = 5 * time.Minute
+	defaultManagedVarCanaryTimeout = time.Hour
+
+	// managedVarRetryBackoff is how long a failed rotation waits before
+	// the periodic function tries it again
+	managedVarRetryBackoff = 5 * time.Minute
+)
+
+// balenaManagedVar defines a variable whose value Vault generates and
+// rotates, set on a fleet or on a single device of it
+type balenaManagedVar struct {
+	Name           string        `json:"name"`
+	Role           string        `json:"role"`
+	Fleet          string        `json:"fleet"`
+	DeviceUUID     string        `json:"device_uuid,omitempty"`
+	VarName        string        `json:"var_name"`
+	Length         int           `json:"length"`
+	Charset        string        `json:"charset"`
+	RotationPeriod time.Duration `json:"rotation_period"`
+	CanaryTag      string        `json:"canary_tag,omitempty"`
+	CanaryPeriod   time.Duration `json:"canary_period"`
+	CanaryTimeout  time.Duration `json:"canary_timeout"`
+}
+
+// balenaManagedVarState is the current value of a managed variable and
+// the progress of its rotation. During the canary stage Pending is set on
+// the devices recorded in Canary only.
+type balenaManagedVarState struct {
+	Value           string          `json:"value"`
+	Version         int             `json:"version"`
+	LastRotatedAt   time.Time       `json:"last_rotated_at,omitempty"`
+	LastAttemptAt   time.Time       `json:"last_attempt_at,omitempty"`
+	LastError       string          `json:"last_error,omitempty"`
+	RetryAt         time.Time       `json:"retry_at,omitempty"`
+	Stage           string          `json:"stage,omitempty"`
+	Pending         string          `json:"pending,omitempty"`
+	CanaryStartedAt time.Time       `json:"canary_started_at,omitempty"`
+	Canary          *balenaOverride `json:"canary,omitempty"`
+}
+
+// due reports whether a new rotation of v should start at now. The
+// rotation period counts from the last successful rotation, and failed
+// attempts are retried after managedVarRetryBackoff.
+func (st *balenaManagedVarState) due(v *balenaManagedVar, now time.Time) bool {
+	if st.Stage != "" {
+		return false
+	}
+
+	if !st.RetryAt.IsZero() {
+		return !now.Before(st.RetryAt)
+	}
+
+	if st.LastRotatedAt.IsZero() {
+		return true
+	}
+
+	return v.RotationPeriod > 0 && !now.Before(st.LastRotatedAt.Add(v.RotationPeriod))
+}
+
+// toResponseData returns the state, without any values, as the data of a
+// read response
+func (st *balenaManagedVarState) toResponseData() map[string]interface{} {
+	canaryDevices := []string{}
+	if st.Canary != nil {
+		for _, device := range st.Canary.Devices {
+			canaryDevices = append(canaryDevices, device.UUID)
+		}
+	}
+
+	return map[string]interface{}{
+		"version":           st.Version,
+		"last_rotated_at":   st.LastRotatedAt,
+		"last_attempt_at":   st.LastAttemptAt,
+		"last_error":        st.LastError,
+		"retry_at":          st.RetryAt,
+		"stage":             st.Stage,
+		"canary_started_at": st.CanaryStartedAt,
+		"canary_devices":    canaryDevices,
+	}
+}
+
+// reconcileManagedVars starts the rotations that are due and moves
+// rotations in their canary stage forward. A failing variable does not
+// stop the others.
+func (b *balenaBackend) reconcileManagedVars(ctx context.Context, s logical.Storage) error {
+	b.managedVarLock.Lock()
+	defer b.managedVarLock.Unlock()
+
+	names, err := s.List(ctx, managedVarStoragePrefix)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, name := range names {
+		v, err := getManagedVar(ctx, s, name)
+		if err != nil {
+			return err
+		}
+
+		if v == nil {
+			continue
+		}
+
+		state, err := getManagedVarState(ctx, s, name)
+		if err != nil {
+			return err
+		}
+
+		if state.Stage == "" && !state.due(v, now) {
+			continue
+		}
+
+		if err := b.rotateManagedVar(ctx, s, v, state); err != nil {
+			b.Logger().Error("error rotating managed variable", "managed_var", v.Name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// rotateManagedVar takes the next step of a rotation: it starts one when
+// none is in progress, and otherwise checks on its canary devices. The
+// state is saved whatever the outcome, with any error in LastError.
+func (b *balenaBackend) rotateManagedVar(ctx context.Context, s logical.Storage, v *balenaManagedVar, state *balenaManagedVarState) error {
+	err := b.stepManagedVar(ctx, s, v, state)
+
+	state.LastError = ""
+	state.RetryAt = time.Time{}
+	if err != nil {
+		state.LastError = err.Error()
+
+		// a failing canary stage is checked again on every run anyway
+		if state.Stage == "" {
+			state.RetryAt = time.Now().Add(managedVarRetryBackoff)
+		}
+	}
+
+	if putErr := putManagedVarState(ctx, s, v.Name, state); putErr != nil {
+		return putErr
+	}
+
+	return err
+}
+
+// stepManagedVar changes state in place as the rotation moves forward
+func (b *balenaBackend) stepManagedVar(ctx context.Context, s logical.Storage, v *balenaManagedVar, state *balenaManagedVarState) error {
+	role, err := b.getRole(ctx, s, v.Role)
+	if err != nil {
+		return fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if role == nil {
+		return fmt.Errorf("role %q not found", v.Role)
+	}
+
+	client, err := b.getClient(ctx, s, role.BalenaApiKey)
+	if err != nil {
+		return err
+	}
+
+	if state.Stage == managedVarStageCanary {
+		return b.checkManagedVarCanary(ctx, client, role, v, state)
+	}
+
+	now := time.Now()
+	state.LastAttemptAt = now
+
+	value, err := generateValue(v.Length, v.Charset)
+	if err != nil {
+		return err
+	}
+
+	if v.DeviceUUID != "" {
+		device, resp, err := roleDevice(ctx, client, role, v.DeviceUUID)
+		if err != nil {
+			return err
+		}
+		if resp != nil {
+			return resp.Error()
+		}
+
+		if err := setDeviceVar(ctx, client, deviceEnvironmentVarResource, device.ID, v.VarName, value); err != nil {
+			return err
+		}
+
+		state.rotated(value, now)
+		return nil
+	}
+
+	if v.CanaryTag == "" {
+		if err := setManagedFleetVar(ctx, client, role, v, value); err != nil {
+			return err
+		}
+
+		state.rotated(value, now)
+		return nil
+	}
+
+	devices, resp, err := roleDevices(ctx, client, role, "", v.Fleet, v.CanaryTag)
+	if err != nil {
+		return err
+	}
+	if resp != nil {
+		return fmt.Errorf("error selecting canary devices: %w", resp.Error())
+	}
+
+	b.overrideLock.Lock()
+	defer b.overrideLock.Unlock()
+
+	// the canary value would be undone by an override lease ending, and
+	// would in turn be recorded as the value the override restores
+	vars := []balenaOverrideVar{{Resource: deviceEnvironmentVarResource, Name: v.VarName, Value: value}}
+	device, name, err := overriddenVar(ctx, s, devices, vars)
+	if err != nil {
+		return err
+	}
+
+	if device != "" {
+		return fmt.Errorf("variable %q of canary device %q already has an active override", name, device)
+	}
+
+	canary := &balenaOverride{Role: role.Name}
+	if err := recordDeviceOverride(ctx, client, canary, devices, vars); err != nil {
+		return err
+	}
+
+	applyErr := applyDeviceOverride(ctx, client, canary)
+	if applyErr != nil {
+		if restoreErr := restoreDeviceOverride(ctx, client, canary); restoreErr == nil {
+			return applyErr
+		}
+	}
+
+	// keep the canary stage even when the apply could not be undone, so a
+	// later run finishes or undoes it. The state is saved before
+	// overrideLock is released, so that overrides see the canary.
+	state.Stage = managedVarStageCanary
+	state.Pending = value
+	state.CanaryStartedAt = now
+	state.Canary = canary
+
+	if err := putManagedVarState(ctx, s, v.Name, state); err != nil {
+		return err
+	}
+
+	return applyErr
+}
+
+// checkManagedVarCanary promotes the pending value to the whole fleet once
+// every canary device has been online after the canary period, or gives
+// up and removes the canary values after the canary timeout
+func (b *balenaBackend) checkManagedVarCanary(ctx context.Context, client *balenaClient, role *balenaRoleEntry, v *balenaManagedVar, state *balenaManagedVarState) error {
+	elapsed := time.Since(state.CanaryStartedAt)
+	if elapsed < v.CanaryPeriod {
+		return nil
+	}
+
+	var offline []string
+	for _, d := range state.Canary.Devices {
+		device, err := getDevice(ctx, client, d.UUID)
+		if err != nil {
+			return err
+		}
+
+		if device == nil || !device.IsOnline {
+			offline = append(offline, d.UUID)
+		}
+	}
+
+	if len(offline) > 0 {
+		if elapsed < v.CanaryTimeout {
+			return nil
+		}
+
+		if err := restoreDeviceOverride(ctx, client, state.Canary); err != nil {
+			return err
+		}
+
+		state.endCanary()
+		return fmt.Errorf("rotation aborted, canary devices did not come online: %s", strings.Join(offline, ", "))
+	}
+
+	if err := setManagedFleetVar(ctx, client, role, v, state.Pending); err != nil {
+		return err
+	}
+
+	// the canary devices fall back to the fleet value, or to their own
+	// value if they had one before the rotation
+	if err := restoreDeviceOverride(ctx, client, state.Canary); err != nil {
+		return err
+	}
+
+	state.rotated(state.Pending, time.Now())
+	state.endCanary()
+
+	return nil
+}
+
+// rotated records value as the current value of the variable
+func (st *balenaManagedVarState) rotated(value string, now time.Time) {
+	st.Value = value
+	st.Version++
+	st.LastRotatedAt = now
+}
+
+// endCanary clears the canary stage of a rotation
+func (st *balenaManagedVarState) endCanary() {
+	st.Stage = ""
+	st.Pending = ""
+	st.CanaryStartedAt = time.Time{}
+	st.Canary = nil
+}
+
+// setManagedFleetVar sets the managed variable on its fleet
+func setManagedFleetVar(ctx context.Context, c *balenaClient, role *balenaRoleEntry, v *balenaManagedVar, value string) error {
+	fleet, err := getFleet(ctx, c, v.Fleet)
+	if err != nil {
+		return err
+	}
+
+	if fleet == nil {
+		return fmt.Errorf("fleet %q not found", v.Fleet)
+	}
+
+	if !fleetAllowed(role.AllowedFleets, *fleet) {
+		return fmt.Errorf("fleet %q is not allowed by role %q", fleet.Slug, role.Name)
+	}
+
+	set := balenaVarSet{Resource: fleetEnvVarResource, Parent: "application", ParentID: fleet.ID}
+	existing, err := listVarSet(ctx, c, set)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range existing {
+		if e.Name == v.VarName {
+			return updateVarSetVar(ctx, c, set, e.ID, value)
+		}
+	}
+
+	return createVarSetVar(ctx, c, set, v.VarName, value)
+}
+
+// generateValue returns a random value of length characters picked
+// uniformly from charset
+func generateValue(length int, charset string) (string, error) {
+	chars := []rune(charset)
+	if length <= 0 || len(chars) == 0 {
+		return "", errors.New("length and charset must not be empty")
+	}
+
+	max := big.NewInt(int64(len(chars)))
+	value := make([]rune, length)
+	for i := range value {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("error generating random value: %w", err)
+		}
+		value[i] = chars[n.Int64()]
+	}
+
+	return string(value), nil
+}
+
+// getManagedVar returns a managed variable definition, or nil if there is none
+func getManagedVar(ctx context.Context, s logical.Storage, name string) (*balenaManagedVar, error) {
+	entry, err := s.Get(ctx, managedVarStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var v balenaManagedVar
+	if err := entry.DecodeJSON(&v); err != nil {
+		return nil, fmt.Errorf("error reading managed variable: %w", err)
+	}
+
+	return &v, nil
+}
+
+// getManagedVarState returns the state of a managed variable, which is
+// empty before its first rotation
+func getManagedVarState(ctx context.Context, s logical.Storage, name string) (*balenaManagedVarState, error) {
+	entry, err := s.Get(ctx, managedVarStateStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	var state balenaManagedVarState
+	if entry == nil {
+		return &state, nil
+	}
+
+	if err := entry.DecodeJSON(&state); err != nil {
+		return nil, fmt.Errorf("error reading managed variable state: %w", err)
+	}
+
+	return &state, nil
+}
+
+// putManagedVarState records the state of a managed variable in storage
+func putManagedVarState(ctx context.Context, s logical.Storage, name string, state *balenaManagedVarState) error {
+	entry, err := logical.StorageEntryJSON(managedVarStateStoragePrefix+name, state)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
@@ -0,0 +1,340 @@
+package balenakeys
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaOpenBalenaUserType = "balena_openbalena_user"
+	defaultUserEmailDomain   = "openbalena.local"
+	defaultOrganizationRole  = "member"
+)
+
+// organizationRoles lists the organization membership roles a role can grant
+var organizationRoles = []string{"member", "administrator"}
+
+// balenaOpenBalenaUser defines a secret for a temporary openBalena user
+// and how it should be revoked or renewed.
+func (b *balenaBackend) balenaOpenBalenaUser() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaOpenBalenaUserType,
+		Fields: map[string]*framework.FieldSchema{
+			"username": {
+				Type:        framework.TypeString,
+				Description: "Username of the temporary user",
+			},
+			"password": {
+				Type:        framework.TypeString,
+				Description: "Generated password of the temporary user",
+			},
+			"session_token": {
+				Type:        framework.TypeString,
+				Description: "Session token of the temporary user",
+			},
+		},
+		Revoke: roleLeaseRevoke(b.openBalenaUserRevoke),
+		Renew:  b.tokenRenew,
+	}
+}
+
+// createOpenBalenaUserCreds creates a temporary user with a generated
+// password, adds it to the role's organizations and logs it in
+func (b *balenaBackend) createOpenBalenaUserCreds(ctx context.Context, req *logical.Request, role *balenaRoleEntry, ttl time.Duration) (*logical.Response, error) {
+	client, err := b.getClient(ctx, req.Storage, role.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix, err := randomHex(6)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	emailDomain := role.UserEmailDomain
+	if emailDomain == "" {
+		emailDomain = defaultUserEmailDomain
+	}
+
+	username := "vault_" + suffix
+	userID, err := createUser(ctx, client, username, username+"@"+emailDomain, password)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.setupOpenBalenaUser(ctx, client, role, userID, username, password)
+	if err != nil || resp.IsError() {
+		// don't leave a user behind without a lease
+		if delErr := deleteUser(ctx, client, userID); delErr != nil {
+			b.Logger().Error("error removing partially created user", "username", username, "error", delErr)
+		}
+		return resp, err
+	}
+
+	resp.Data["user_id"] = userID
+	resp.Secret.InternalData["user_id"] = userID
+	resp.Secret.InternalData["role"] = role.Name
+	resp.Secret.InternalData["ttl"] = ttl
+	resp.Secret.InternalData["max_ttl"] = role.MaxTTL
+
+	if ttl > 0 {
+		resp.Secret.TTL = ttl
+	}
+
+	if role.MaxTTL > 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+
+	// the role can't be deleted while the user still needs its balena key
+	// to be removed again
+	if err := trackRoleLease(ctx, req.Storage, resp); err != nil {
+		if delErr := deleteUser(ctx, client, userID); delErr != nil {
+			b.Logger().Error("error removing untracked user", "username", username, "error", delErr)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// setupOpenBalenaUser adds a new user to the role's organizations and logs
+// it in, returning the secret for the user
+func (b *balenaBackend) setupOpenBalenaUser(ctx context.Context, c *balenaClient, role *balenaRoleEntry, userID int, username string, password string) (*logical.Response, error) {
+	orgRole := role.OrganizationRole
+	if orgRole == "" {
+		orgRole = defaultOrganizationRole
+	}
+
+	if len(role.Organizations) > 0 {
+		orgRoleID, err := getOrganizationRoleID(ctx, c, orgRole)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, handle := range role.Organizations {
+			orgID, err := getOrganizationID(ctx, c, handle)
+			if err != nil {
+				return nil, err
+			}
+
+			if orgID == 0 {
+				return logical.ErrorResponse("organization %q not found", handle), nil
+			}
+
+			if err := createOrganizationMembership(ctx, c, userID, orgID, orgRoleID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sessionToken, err := login(ctx, c, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Secret(balenaOpenBalenaUserType).Response(map[string]interface{}{
+		"username":          username,
+		"password":          password,
+		"session_token":     sessionToken,
+		"organizations":     role.Organizations,
+		"organization_role": orgRole,
+	}, map[string]interface{}{}), nil
+}
+
+// openBalenaUserRevoke deletes the temporary user
+func (b *balenaBackend) openBalenaUserRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName, ok := req.Secret.InternalData["role"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing role internal data")
+	}
+
+	userID, ok := internalDataInt(req.Secret.InternalData["user_id"])
+	if !ok {
+		return nil, errors.New("secret is missing user_id internal data")
+	}
+
+	roleEntry, err := b.getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return nil, fmt.Errorf("error retrieving role: role %q not found", roleName)
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	if err := deleteUser(ctx, client, userID); err != nil {
+		return nil, fmt.Errorf("error revoking user: %w", err)
+	}
+
+	return nil, nil
+}
+
+// createUser calls the openBalena admin API to register a user, and
+// returns the ID of the new user
+func createUser(ctx context.Context, c *balenaClient, username string, email string, password string) (int, error) {
+	type balenaBody struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	req, err := c.NewRequest(ctx, "POST", "user/register", "", balenaBody{
+		Username: username,
+		Email:    email,
+		Password: password,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return 0, fmt.Errorf("error creating balena user: %w", err)
+	}
+
+	userID, err := getUserID(ctx, c, username)
+	if err != nil {
+		return 0, err
+	}
+
+	if userID == 0 {
+		return 0, fmt.Errorf("error creating balena user: user %q not found after registration", username)
+	}
+
+	return userID, nil
+}
+
+// deleteUser calls the openBalena admin API to delete a user
+func deleteUser(ctx context.Context, c *balenaClient, userID int) error {
+	req, err := c.NewRequest(ctx, "DELETE", fmt.Sprintf("v6/user(%d)", userID), "", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error deleting balena user: %w", err)
+	}
+
+	return nil
+}
+
+// login returns a session token for a user's credentials
+func login(ctx context.Context, c *balenaClient, username string, password string) (string, error) {
+	type balenaBody struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	req, err := c.NewRequest(ctx, "POST", "login_", "", balenaBody{
+		Username: username,
+		Password: password,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// the session token comes back as plain text rather than JSON
+	var token bytes.Buffer
+	if err := c.Do(req, &token); err != nil {
+		return "", fmt.Errorf("error logging in balena user: %w", err)
+	}
+
+	if token.Len() == 0 {
+		return "", errors.New("error logging in balena user: empty session token")
+	}
+
+	return strings.TrimSpace(token.String()), nil
+}
+
+// getOrganizationID looks up an organization by handle, returning 0 when
+// there is no such organization
+func getOrganizationID(ctx context.Context, c *balenaClient, handle string) (int, error) {
+	if !orgHandleRegex.MatchString(handle) {
+		return 0, fmt.Errorf("invalid organization %q", handle)
+	}
+
+	var orgs struct {
+		D []struct {
+			ID int `json:"id"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/organization?$select=id&$filter=handle%%20eq%%20%s", odataString(handle)), "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Do(req, &orgs); err != nil {
+		return 0, fmt.Errorf("error getting balena organization: %w", err)
+	}
+
+	if len(orgs.D) == 0 {
+		return 0, nil
+	}
+
+	return orgs.D[0].ID, nil
+}
+
+// getOrganizationRoleID looks up the ID of an organization membership role by name
+func getOrganizationRoleID(ctx context.Context, c *balenaClient, name string) (int, error) {
+	var roles struct {
+		D []struct {
+			ID int `json:"id"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/organization_membership_role?$select=id&$filter=name%%20eq%%20%s", odataString(name)), "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Do(req, &roles); err != nil {
+		return 0, fmt.Errorf("error getting balena organization membership role: %w", err)
+	}
+
+	if len(roles.D) == 0 {
+		return 0, fmt.Errorf("organization membership role %q not found", name)
+	}
+
+	return roles.D[0].ID, nil
+}
+
+// createOrganizationMembership calls the balena client to add a user to an organization
+func createOrganizationMembership(ctx context.Context, c *balenaClient, userID int, orgID int, roleID int) error {
+	type balenaBody struct {
+		User                       int `json:"user"`
+		IsMemberOfOrganization     int `json:"is_member_of__organization"`
+		OrganizationMembershipRole int `json:"organization_membership_role"`
+	}
+
+	req, err := c.NewRequest(ctx, "POST", "v6/organization_membership", "", balenaBody{
+		User:                       userID,
+		IsMemberOfOrganization:     orgID,
+		OrganizationMembershipRole: roleID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error creating balena organization membership: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,532 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaProvisioningKeyType    = "balena_provisioning_key"
+	provisioningKeyStoragePrefix = "provisioning-key/"
+	defaultProvisioningKeyDesc   = "Vault Managed Provisioning Key"
+
+	// provisioningFleetStoragePrefix holds, per fleet, how far its devices
+	// have been matched against single-use provisioning keys
+	provisioningFleetStoragePrefix = "provisioning-key-fleet/"
+
+	// ownDeviceStoragePrefix holds, per fleet, the devices this backend
+	// registered itself while the fleet had single-use keys outstanding
+	ownDeviceStoragePrefix = "provisioning-key-device/"
+
+	// ownDeviceGrace is how old a device must be before it is matched
+	// against single-use keys, so that a device this backend is registering
+	// has been recorded as its own by then
+	ownDeviceGrace = time.Minute
+)
+
+// balenaSingleUseKey tracks a single-use provisioning key until a
+// device has registered in its fleet
+type balenaSingleUseKey struct {
+	Role     string    `json:"role"`
+	TokenID  string    `json:"token_id"`
+	KeyName  string    `json:"key_name"`
+	FleetID  int       `json:"fleet_id"`
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+// singleUseKeyPath returns the storage path of a single-use key, which is
+// kept under its fleet by the token ID generated for it
+func singleUseKeyPath(fleetID int, tokenID string) string {
+	return fmt.Sprintf("%s%d/%s", provisioningKeyStoragePrefix, fleetID, tokenID)
+}
+
+// ownDevicePath returns the storage path recording a device as registered
+// by this backend
+func ownDevicePath(fleetID int, deviceID int) string {
+	return fmt.Sprintf("%s%d/%d", ownDeviceStoragePrefix, fleetID, deviceID)
+}
+
+// balenaProvisioningFleet records the newest device of a fleet that has
+// been matched against single-use provisioning keys, so that no device
+// uses up more than one key
+type balenaProvisioningFleet struct {
+	LastDeviceID int `json:"last_device_id"`
+}
+
+// balenaProvisioningKey defines a secret for a fleet provisioning key
+// and how it should be revoked or renewed.
+func (b *balenaBackend) balenaProvisioningKey() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaProvisioningKeyType,
+		Fields: map[string]*framework.FieldSchema{
+			"provisioning_key": {
+				Type:        framework.TypeString,
+				Description: "Balena provisioning key",
+			},
+			"fleet_id": {
+				Type:        framework.TypeInt,
+				Description: "ID of the fleet devices register in",
+			},
+		},
+		Revoke: roleLeaseRevoke(b.provisioningKeyRevoke),
+		Renew:  b.provisioningKeyRenew,
+	}
+}
+
+// createProvisioningKeyCreds creates a provisioning key for the role's fleet
+// that expires together with its lease
+func (b *balenaBackend) createProvisioningKeyCreds(ctx context.Context, req *logical.Request, role *balenaRoleEntry, balenaName string, balenaDesc string, ttl time.Duration) (*logical.Response, error) {
+	if ttl <= 0 {
+		ttl = b.System().DefaultLeaseTTL()
+	}
+
+	client, err := b.getClient(ctx, req.Storage, role.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fleet, err := getFleet(ctx, client, role.Fleet)
+	if err != nil {
+		return nil, err
+	}
+
+	if fleet == nil {
+		return logical.ErrorResponse("fleet %q not found", role.Fleet), nil
+	}
+
+	if balenaDesc == defaultKeyDesc {
+		balenaDesc = defaultProvisioningKeyDesc
+	}
+
+	issuedAt := time.Now()
+	token, err := createProvisioningToken(ctx, client, fleet.ID, balenaName, balenaDesc, issuedAt.Add(ttl))
+	if err != nil {
+		return nil, err
+	}
+
+	if role.SingleUse {
+		entry, err := logical.StorageEntryJSON(singleUseKeyPath(fleet.ID, token.TokenID), &balenaSingleUseKey{
+			Role:     role.Name,
+			TokenID:  token.TokenID,
+			KeyName:  token.KeyName,
+			FleetID:  fleet.ID,
+			IssuedAt: issuedAt,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := req.Storage.Put(ctx, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := b.Secret(balenaProvisioningKeyType).Response(map[string]interface{}{
+		"provisioning_key": token.Token,
+		"token_id":         token.TokenID,
+		"key_name":         token.KeyName,
+		"key_desc":         balenaDesc,
+		"fleet_id":         fleet.ID,
+		"fleet":            fleet.Slug,
+		"single_use":       role.SingleUse,
+	}, map[string]interface{}{
+		"token_id": token.TokenID,
+		"key_name": token.KeyName,
+		"role":     role.Name,
+		"fleet_id": fleet.ID,
+		"ttl":      ttl,
+		"max_ttl":  role.MaxTTL,
+	})
+
+	resp.Secret.TTL = ttl
+
+	if role.MaxTTL > 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+
+	// the role can't be deleted while the key still needs its balena key
+	// to be removed again
+	if err := trackRoleLease(ctx, req.Storage, resp); err != nil {
+		if delErr := deleteToken(ctx, client, token.KeyName); delErr != nil {
+			b.Logger().Error("error removing untracked provisioning key", "key_name", token.KeyName, "error", delErr)
+		}
+		if delErr := req.Storage.Delete(ctx, singleUseKeyPath(fleet.ID, token.TokenID)); delErr != nil {
+			b.Logger().Error("error removing untracked single-use key", "key_name", token.KeyName, "error", delErr)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// provisioningKeyRevoke deletes the provisioning key from balena
+func (b *balenaBackend) provisioningKeyRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleEntry, keyName, err := b.secretRoleAndKey(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	if err := deleteToken(ctx, client, keyName); err != nil {
+		return nil, fmt.Errorf("error revoking provisioning key: %w", err)
+	}
+
+	tokenID, _ := req.Secret.InternalData["token_id"].(string)
+	fleetID, ok := internalDataInt(req.Secret.InternalData["fleet_id"])
+	if ok && tokenID != "" {
+		if err := req.Storage.Delete(ctx, singleUseKeyPath(fleetID, tokenID)); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// provisioningKeyRenew extends the lease and moves the key's expiry date
+// in balena to the new end of the lease
+func (b *balenaBackend) provisioningKeyRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	resp, err := b.tokenRenew(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	roleEntry, keyName, err := b.secretRoleAndKey(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	if err := setTokenExpiry(ctx, client, keyName, renewedLeaseEnd(req, resp)); err != nil {
+		return nil, fmt.Errorf("error extending provisioning key: %w", err)
+	}
+
+	return resp, nil
+}
+
+// revokeUsedProvisioningKeys deletes single-use provisioning keys from balena
+// once a device has registered in their fleet. balena does not record which
+// key registered a device, so every new device in a fleet is taken to have
+// used the oldest outstanding key issued before it registered. Devices this
+// backend registered itself are skipped, but a device registered some other
+// way still uses up a key. A fleet never loses more keys than it gained
+// devices.
+func (b *balenaBackend) revokeUsedProvisioningKeys(ctx context.Context, s logical.Storage) error {
+	fleetDirs, err := s.List(ctx, provisioningKeyStoragePrefix)
+	if err != nil {
+		return err
+	}
+
+	fleets := map[int][]*balenaSingleUseKey{}
+	for _, fleetDir := range fleetDirs {
+		tokenIDs, err := s.List(ctx, provisioningKeyStoragePrefix+fleetDir)
+		if err != nil {
+			return err
+		}
+
+		for _, tokenID := range tokenIDs {
+			path := provisioningKeyStoragePrefix + fleetDir + tokenID
+			entry, err := s.Get(ctx, path)
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				continue
+			}
+
+			var key balenaSingleUseKey
+			if err := entry.DecodeJSON(&key); err != nil {
+				return fmt.Errorf("error reading single-use provisioning key: %w", err)
+			}
+
+			role, err := b.getRole(ctx, s, key.Role)
+			if err != nil {
+				return err
+			}
+
+			// without the role there is no account to delete the key with;
+			// it still expires with its lease
+			if role == nil {
+				if err := s.Delete(ctx, path); err != nil {
+					return err
+				}
+				continue
+			}
+
+			fleets[key.FleetID] = append(fleets[key.FleetID], &key)
+		}
+	}
+
+	for fleetID, keys := range fleets {
+		if err := b.revokeUsedFleetKeys(ctx, s, fleetID, keys); err != nil {
+			b.Logger().Error("error checking single-use provisioning keys", "fleet_id", fleetID, "error", err)
+		}
+	}
+
+	// devices registered in fleets without single-use keys can't use one up
+	deviceDirs, err := s.List(ctx, ownDeviceStoragePrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, deviceDir := range deviceDirs {
+		fleetID, err := strconv.Atoi(strings.TrimSuffix(deviceDir, "/"))
+		if err == nil && fleets[fleetID] != nil {
+			continue
+		}
+
+		if err := forgetOwnDevices(ctx, s, ownDeviceStoragePrefix+deviceDir, -1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// noteOwnDevice records a device this backend registered itself, so that it
+// does not use up a single-use provisioning key of its fleet. Nothing is
+// recorded for fleets without outstanding single-use keys.
+func (b *balenaBackend) noteOwnDevice(ctx context.Context, s logical.Storage, fleetID int, deviceID int) {
+	keys, err := s.List(ctx, fmt.Sprintf("%s%d/", provisioningKeyStoragePrefix, fleetID))
+	if err == nil && len(keys) > 0 {
+		err = s.Put(ctx, &logical.StorageEntry{Key: ownDevicePath(fleetID, deviceID)})
+	}
+
+	if err != nil {
+		b.Logger().Error("error recording preregistered device", "fleet_id", fleetID, "device_id", deviceID, "error", err)
+	}
+}
+
+// forgetOwnDevices removes the records of devices under prefix with an ID
+// up to lastDeviceID, or all of them when lastDeviceID is negative
+func forgetOwnDevices(ctx context.Context, s logical.Storage, prefix string, lastDeviceID int) error {
+	deviceIDs, err := s.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, deviceID := range deviceIDs {
+		if id, err := strconv.Atoi(deviceID); err == nil && lastDeviceID >= 0 && id > lastDeviceID {
+			continue
+		}
+
+		if err := s.Delete(ctx, prefix+deviceID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeUsedFleetKeys matches the devices registered in a fleet since it
+// was last checked against the fleet's outstanding single-use keys, oldest
+// first, and deletes the keys they used
+func (b *balenaBackend) revokeUsedFleetKeys(ctx context.Context, s logical.Storage, fleetID int, keys []*balenaSingleUseKey) error {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].IssuedAt.Before(keys[j].IssuedAt)
+	})
+
+	role, err := b.getRole(ctx, s, keys[0].Role)
+	if err != nil {
+		return err
+	}
+
+	if role == nil {
+		return fmt.Errorf("role %q not found", keys[0].Role)
+	}
+
+	client, err := b.getClient(ctx, s, role.BalenaApiKey)
+	if err != nil {
+		return err
+	}
+
+	fleet, err := getProvisioningFleet(ctx, s, fleetID)
+	if err != nil {
+		return err
+	}
+
+	var devices struct {
+		D []struct {
+			ID        int       `json:"id"`
+			CreatedAt time.Time `json:"created_at"`
+		} `json:"d"`
+	}
+
+	cutoff := time.Now().Add(-ownDeviceGrace)
+	req, err := client.NewRequest(ctx, "GET", fmt.Sprintf("v6/device?$select=id,created_at&$orderby=id%%20asc&$filter=(belongs_to__application%%20eq%%20%d)%%20and%%20(id%%20gt%%20%d)%%20and%%20(created_at%%20ge%%20%%27%s%%27)%%20and%%20(created_at%%20lt%%20%%27%s%%27)", fleetID, fleet.LastDeviceID, keys[0].IssuedAt.UTC().Format(balenaTimeFormat), cutoff.UTC().Format(balenaTimeFormat)), "", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := client.Do(req, &devices); err != nil {
+		return fmt.Errorf("error listing balena devices: %w", err)
+	}
+
+	// the progress is saved however far the matching got, so a device is
+	// never counted against a second key
+	defer func() {
+		if putErr := putProvisioningFleet(ctx, s, fleetID, fleet); putErr != nil {
+			b.Logger().Error("error saving single-use provisioning key progress", "fleet_id", fleetID, "error", putErr)
+		}
+	}()
+
+	for _, device := range devices.D {
+		own, err := s.Get(ctx, ownDevicePath(fleetID, device.ID))
+		if err != nil {
+			return err
+		}
+
+		if own != nil {
+			fleet.LastDeviceID = device.ID
+			continue
+		}
+
+		for i, key := range keys {
+			if key == nil || key.IssuedAt.After(device.CreatedAt) {
+				continue
+			}
+
+			if err := b.revokeSingleUseKey(ctx, s, key); err != nil {
+				return err
+			}
+			keys[i] = nil
+			break
+		}
+
+		fleet.LastDeviceID = device.ID
+	}
+
+	return forgetOwnDevices(ctx, s, fmt.Sprintf("%s%d/", ownDeviceStoragePrefix, fleetID), fleet.LastDeviceID)
+}
+
+// revokeSingleUseKey deletes a used single-use key from balena with its
+// role's account and stops tracking it
+func (b *balenaBackend) revokeSingleUseKey(ctx context.Context, s logical.Storage, key *balenaSingleUseKey) error {
+	role, err := b.getRole(ctx, s, key.Role)
+	if err != nil {
+		return err
+	}
+
+	if role == nil {
+		return fmt.Errorf("role %q not found", key.Role)
+	}
+
+	client, err := b.getClient(ctx, s, role.BalenaApiKey)
+	if err != nil {
+		return err
+	}
+
+	if err := deleteToken(ctx, client, key.KeyName); err != nil {
+		return err
+	}
+
+	return s.Delete(ctx, singleUseKeyPath(key.FleetID, key.TokenID))
+}
+
+// getProvisioningFleet returns how far a fleet's devices have been matched
+// against single-use keys
+func getProvisioningFleet(ctx context.Context, s logical.Storage, fleetID int) (*balenaProvisioningFleet, error) {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s%d", provisioningFleetStoragePrefix, fleetID))
+	if err != nil {
+		return nil, err
+	}
+
+	fleet := &balenaProvisioningFleet{}
+	if entry == nil {
+		return fleet, nil
+	}
+
+	if err := entry.DecodeJSON(fleet); err != nil {
+		return nil, fmt.Errorf("error reading provisioning key fleet: %w", err)
+	}
+	return fleet, nil
+}
+
+// putProvisioningFleet stores how far a fleet's devices have been matched
+func putProvisioningFleet(ctx context.Context, s logical.Storage, fleetID int, fleet *balenaProvisioningFleet) error {
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s%d", provisioningFleetStoragePrefix, fleetID), fleet)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// secretRoleAndKey returns the role and balena key name a secret was issued with
+func (b *balenaBackend) secretRoleAndKey(ctx context.Context, req *logical.Request) (*balenaRoleEntry, string, error) {
+	roleName, ok := req.Secret.InternalData["role"].(string)
+	if !ok {
+		return nil, "", errors.New("secret is missing role internal data")
+	}
+
+	keyName, ok := req.Secret.InternalData["key_name"].(string)
+	if !ok {
+		return nil, "", errors.New("secret is missing key_name internal data")
+	}
+
+	roleEntry, err := b.getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, "", fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return nil, "", fmt.Errorf("error retrieving role: role %q not found", roleName)
+	}
+
+	return roleEntry, keyName, nil
+}
+
+// createProvisioningToken calls the balena client to create a provisioning
+// key for a fleet that expires at the given time
+func createProvisioningToken(ctx context.Context, c *balenaClient, fleetID int, balenaName string, balenaDesc string, expiry time.Time) (*balenaToken, error) {
+	type balenaBody struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Expiry_date string `json:"expiryDate"`
+	}
+
+	tokenID := uuid.New().String()
+
+	if balenaName == "" {
+		balenaName = tokenID
+	}
+
+	req, err := c.NewRequest(ctx, "POST", fmt.Sprintf("api-key/application/%d/provisioning", fleetID), "", balenaBody{
+		Name:        balenaName,
+		Description: balenaDesc,
+		Expiry_date: expiry.UTC().Format(balenaTimeFormat),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var token string
+	if err := c.Do(req, &token); err != nil {
+		return nil, fmt.Errorf("error creating balena provisioning key: %w", err)
+	}
+
+	if token == "" {
+		return nil, errors.New("error creating balena provisioning key: empty key")
+	}
+
+	return &balenaToken{
+		TokenID: tokenID,
+		Token:   token,
+		KeyName: balenaName,
+	}, nil
+}
@@ -0,0 +1,229 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaPublicURLType = "balena_public_url"
+
+	publicURLStoragePrefix = "public-url/"
+)
+
+// balenaPublicURLState counts the active leases of a device's public URL
+// and records whether the URL was on before the first of them, so that it
+// is only turned off once the last lease ends and only if it was off
+type balenaPublicURLState struct {
+	Leases     int  `json:"leases"`
+	WasEnabled bool `json:"was_enabled"`
+}
+
+// balenaPublicURL defines a secret for an enabled device public URL
+// and how it should be revoked or renewed.
+func (b *balenaBackend) balenaPublicURL() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaPublicURLType,
+		Fields: map[string]*framework.FieldSchema{
+			"url": {
+				Type:        framework.TypeString,
+				Description: "Public URL of the device",
+			},
+		},
+		Revoke: roleLeaseRevoke(b.publicURLRevoke),
+		Renew:  b.tokenRenew,
+	}
+}
+
+// publicURLRevoke drops the lease from the device's public URL, turning the
+// URL off again once no lease is left and it was off before
+func (b *balenaBackend) publicURLRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName, ok := req.Secret.InternalData["role"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing role internal data")
+	}
+
+	deviceID, ok := internalDataInt(req.Secret.InternalData["device_id"])
+	if !ok {
+		return nil, errors.New("secret is missing device_id internal data")
+	}
+
+	roleEntry, err := b.getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return nil, fmt.Errorf("error retrieving role: role %q not found", roleName)
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	if err := b.releasePublicURL(ctx, req.Storage, client, deviceID); err != nil {
+		return nil, fmt.Errorf("error revoking public url: %w", err)
+	}
+
+	return nil, nil
+}
+
+// releasePublicURL drops a lease from the device's public URL, turning the
+// URL off again once no lease is left and it was off before
+func (b *balenaBackend) releasePublicURL(ctx context.Context, s logical.Storage, c *balenaClient, deviceID int) error {
+	b.publicURLLock.Lock()
+	defer b.publicURLLock.Unlock()
+
+	state, err := getPublicURLState(ctx, s, deviceID)
+	if err != nil {
+		return err
+	}
+
+	if state != nil && state.Leases > 1 {
+		state.Leases--
+		return putPublicURLState(ctx, s, deviceID, state)
+	}
+
+	if state == nil || !state.WasEnabled {
+		if err := setPublicURL(ctx, c, deviceID, false); err != nil {
+			return err
+		}
+	}
+
+	return s.Delete(ctx, publicURLStoragePath(deviceID))
+}
+
+// enablePublicURL turns on a device's public URL for a new lease, counting
+// the lease and recording the URL's state before the first one
+func (b *balenaBackend) enablePublicURL(ctx context.Context, s logical.Storage, c *balenaClient, deviceID int) error {
+	b.publicURLLock.Lock()
+	defer b.publicURLLock.Unlock()
+
+	state, err := getPublicURLState(ctx, s, deviceID)
+	if err != nil {
+		return err
+	}
+
+	if state == nil {
+		enabled, err := getPublicURL(ctx, c, deviceID)
+		if err != nil {
+			return err
+		}
+		state = &balenaPublicURLState{WasEnabled: enabled}
+	}
+
+	if err := setPublicURL(ctx, c, deviceID, true); err != nil {
+		return err
+	}
+
+	state.Leases++
+	if err := putPublicURLState(ctx, s, deviceID, state); err != nil {
+		if state.Leases == 1 && !state.WasEnabled {
+			if offErr := setPublicURL(ctx, c, deviceID, false); offErr != nil {
+				b.Logger().Error("error turning public url off again", "device_id", deviceID, "error", offErr)
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// getPublicURL calls the balena client to read whether a device's public
+// URL is on
+func getPublicURL(ctx context.Context, c *balenaClient, deviceID int) (bool, error) {
+	var devices struct {
+		D []struct {
+			IsWebAccessible bool `json:"is_web_accessible"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/device(%d)?$select=is_web_accessible", deviceID), "", nil)
+	if err != nil {
+		return false, err
+	}
+
+	if err := c.Do(req, &devices); err != nil {
+		return false, fmt.Errorf("error getting balena device public url: %w", err)
+	}
+
+	if len(devices.D) == 0 {
+		return false, fmt.Errorf("device %d not found", deviceID)
+	}
+
+	return devices.D[0].IsWebAccessible, nil
+}
+
+// setPublicURL calls the balena client to turn a device's public URL on or off
+func setPublicURL(ctx context.Context, c *balenaClient, deviceID int, enabled bool) error {
+	type balenaBody struct {
+		IsWebAccessible bool `json:"is_web_accessible"`
+	}
+
+	req, err := c.NewRequest(ctx, "PATCH", fmt.Sprintf("v6/device(%d)", deviceID), "", balenaBody{
+		IsWebAccessible: enabled,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error setting balena device public url: %w", err)
+	}
+
+	return nil
+}
+
+// publicURLStoragePath returns the storage path of a device's public URL state
+func publicURLStoragePath(deviceID int) string {
+	return fmt.Sprintf("%s%d", publicURLStoragePrefix, deviceID)
+}
+
+// getPublicURLState gets the public URL state of a device from the Vault
+// storage API, or nil when no lease holds the URL
+func getPublicURLState(ctx context.Context, s logical.Storage, deviceID int) (*balenaPublicURLState, error) {
+	entry, err := s.Get(ctx, publicURLStoragePath(deviceID))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var state balenaPublicURLState
+	if err := entry.DecodeJSON(&state); err != nil {
+		return nil, fmt.Errorf("error reading public url state: %w", err)
+	}
+	return &state, nil
+}
+
+// putPublicURLState adds the public URL state of a device to the Vault storage API
+func putPublicURLState(ctx context.Context, s logical.Storage, deviceID int, state *balenaPublicURLState) error {
+	entry, err := logical.StorageEntryJSON(publicURLStoragePath(deviceID), state)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// devicePublicURL returns the public URL balena serves a device's web
+// port on
+func devicePublicURL(config *balenaConfig, deviceUUID string) (string, error) {
+	if config == nil {
+		return "", errors.New("backend is not configured")
+	}
+
+	endpoints, err := endpointsFromURL(config.URL)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("https://%s.%s", deviceUUID, endpoints.Devices), nil
+}
@@ -0,0 +1,158 @@
+package balenakeys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-secure-stdlib/strutil"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaRegistryTokenType = "balena_registry_token"
+)
+
+// balenaRegistryToken defines a secret for a container registry token.
+// Registry tokens cannot be revoked or extended in balena, so the lease
+// is capped at the token's own lifetime.
+func (b *balenaBackend) balenaRegistryToken() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaRegistryTokenType,
+		Fields: map[string]*framework.FieldSchema{
+			"token": {
+				Type:        framework.TypeString,
+				Description: "Balena registry token",
+			},
+			"registry": {
+				Type:        framework.TypeString,
+				Description: "Host name of the balena container registry",
+			},
+			"docker_config": {
+				Type:        framework.TypeString,
+				Description: "Docker config.json authenticating to the registry with the token",
+			},
+		},
+		Revoke: b.registryTokenRevoke,
+	}
+}
+
+// createRegistryCreds exchanges the role's key for a registry token scoped
+// to the requested repositories
+func (b *balenaBackend) createRegistryCreds(ctx context.Context, req *logical.Request, role *balenaRoleEntry, repositories []string, ttl time.Duration) (*logical.Response, error) {
+	if len(repositories) == 0 {
+		for _, r := range role.RegistryRepositories {
+			if strings.Contains(r, "*") {
+				return logical.ErrorResponse("repositories is required for roles with glob registry_repositories"), nil
+			}
+		}
+		repositories = role.RegistryRepositories
+	}
+
+	for _, r := range repositories {
+		if !strutil.StrListContainsGlob(role.RegistryRepositories, r) {
+			return logical.ErrorResponse("repository %q is not allowed by role %q", r, role.Name), nil
+		}
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return nil, errors.New("backend is not configured")
+	}
+
+	endpoints, err := endpointsFromURL(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := b.getClient(ctx, req.Storage, role.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := "pull"
+	if role.RegistryPush {
+		actions = "pull,push"
+	}
+
+	token, expiresIn, err := createRegistryToken(ctx, client, endpoints.Registry, repositories, actions)
+	if err != nil {
+		return nil, err
+	}
+
+	dockerConfig, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			endpoints.Registry: map[string]string{
+				"registrytoken": token,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := b.Secret(balenaRegistryTokenType).Response(map[string]interface{}{
+		"token":         token,
+		"registry":      endpoints.Registry,
+		"repositories":  repositories,
+		"actions":       actions,
+		"docker_config": string(dockerConfig),
+	}, map[string]interface{}{
+		"role": role.Name,
+	})
+
+	if ttl <= 0 || (expiresIn > 0 && ttl > expiresIn) {
+		ttl = expiresIn
+	}
+
+	if ttl > 0 {
+		resp.Secret.TTL = ttl
+		resp.Secret.MaxTTL = ttl
+	}
+	resp.Secret.Renewable = false
+
+	return resp, nil
+}
+
+// registryTokenRevoke does nothing, as registry tokens expire on their own
+func (b *balenaBackend) registryTokenRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return nil, nil
+}
+
+// createRegistryToken calls the balena client to create a registry token
+// granting actions on repositories, and returns how long it is valid for
+func createRegistryToken(ctx context.Context, c *balenaClient, registry string, repositories []string, actions string) (string, time.Duration, error) {
+	query := neturl.Values{}
+	query.Set("service", registry)
+	for _, r := range repositories {
+		query.Add("scope", fmt.Sprintf("repository:%s:%s", r, actions))
+	}
+
+	req, err := c.NewRequest(ctx, "GET", "auth/v1/token", query.Encode(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var token struct {
+		Token     string `json:"token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	if err := c.Do(req, &token); err != nil {
+		return "", 0, fmt.Errorf("error creating balena registry token: %w", err)
+	}
+
+	if token.Token == "" {
+		return "", 0, errors.New("error creating balena registry token: empty token")
+	}
+
+	return token.Token, time.Duration(token.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,338 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaReleasePinType    = "balena_release_pin"
+	releasePinStoragePrefix = "release-pin/"
+)
+
+// releaseCommitRegex matches a full or abbreviated release commit hash
+var releaseCommitRegex = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// balenaRelease is the subset of a balena release this backend works with
+type balenaRelease struct {
+	ID     int    `json:"id"`
+	Commit string `json:"commit"`
+}
+
+// balenaReleasePin records the devices a lease pinned to a release and
+// what they were pinned to before, so they can be restored on revocation.
+// Orphaned is set when the pin failed to apply and could not be undone, so
+// no lease holds it and the periodic function retries the restore.
+type balenaReleasePin struct {
+	ID        string                   `json:"id"`
+	Role      string                   `json:"role"`
+	ReleaseID int                      `json:"release_id"`
+	Commit    string                   `json:"commit"`
+	Devices   []balenaReleasePinDevice `json:"devices"`
+	Orphaned  bool                     `json:"orphaned"`
+}
+
+// balenaReleasePinDevice holds the pin of one device before the lease. A
+// nil PreviousRelease means the device was tracking the fleet's latest release.
+type balenaReleasePinDevice struct {
+	ID              int    `json:"id"`
+	UUID            string `json:"uuid"`
+	PreviousRelease *int   `json:"previous_release"`
+}
+
+// balenaReleasePin defines a secret for a temporary device release pin
+// and how it should be revoked or renewed.
+func (b *balenaBackend) balenaReleasePin() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaReleasePinType,
+		Fields: map[string]*framework.FieldSchema{
+			"devices": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "UUIDs of the pinned devices",
+			},
+			"commit": {
+				Type:        framework.TypeString,
+				Description: "Commit of the release the devices are pinned to",
+			},
+		},
+		Revoke: b.releasePinRevoke,
+		Renew:  b.tokenRenew,
+	}
+}
+
+// releasePinRevoke restores the devices' previous pins and forgets the pin
+func (b *balenaBackend) releasePinRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	pinID, ok := req.Secret.InternalData["pin_id"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing pin_id internal data")
+	}
+
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+
+	pin, err := getReleasePin(ctx, req.Storage, pinID)
+	if err != nil {
+		return nil, err
+	}
+
+	if pin == nil {
+		return nil, nil
+	}
+
+	if err := b.removeReleasePin(ctx, req.Storage, pin); err != nil {
+		return nil, fmt.Errorf("error revoking release pin: %w", err)
+	}
+
+	return nil, nil
+}
+
+// reconcileReleasePins retries restoring the devices of orphaned release
+// pins, whose apply failed and whose restore failed right after it
+func (b *balenaBackend) reconcileReleasePins(ctx context.Context, s logical.Storage) error {
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+
+	pins, err := listReleasePins(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	for _, pin := range pins {
+		if !pin.Orphaned {
+			continue
+		}
+
+		if err := b.removeReleasePin(ctx, s, pin); err != nil {
+			b.Logger().Error("error restoring orphaned release pin", "pin_id", pin.ID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// removeReleasePin restores the devices' previous pins with the pin's role
+// and forgets the pin
+func (b *balenaBackend) removeReleasePin(ctx context.Context, s logical.Storage, pin *balenaReleasePin) error {
+	roleEntry, err := b.getRole(ctx, s, pin.Role)
+	if err != nil {
+		return fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return fmt.Errorf("error retrieving role: role %q not found", pin.Role)
+	}
+
+	client, err := b.getClient(ctx, s, roleEntry.BalenaApiKey)
+	if err != nil {
+		return fmt.Errorf("error getting client: %w", err)
+	}
+
+	if err := restoreReleasePin(ctx, client, pin); err != nil {
+		return err
+	}
+
+	return s.Delete(ctx, releasePinStoragePrefix+pin.ID)
+}
+
+// pinnedDevice returns the UUID of the first of devices that a recorded
+// release pin already holds, or "" when none is pinned
+func pinnedDevice(ctx context.Context, s logical.Storage, devices []balenaDevice) (string, error) {
+	pins, err := listReleasePins(ctx, s)
+	if err != nil {
+		return "", err
+	}
+
+	pinned := make(map[int]bool)
+	for _, pin := range pins {
+		for _, device := range pin.Devices {
+			pinned[device.ID] = true
+		}
+	}
+
+	for _, device := range devices {
+		if pinned[device.ID] {
+			return device.UUID, nil
+		}
+	}
+
+	return "", nil
+}
+
+// recordReleasePin looks up the current pin of each device that is about
+// to be pinned
+func recordReleasePin(ctx context.Context, c *balenaClient, pin *balenaReleasePin, devices []balenaDevice) error {
+	for _, device := range devices {
+		previous, err := getDevicePin(ctx, c, device.ID)
+		if err != nil {
+			return err
+		}
+
+		pin.Devices = append(pin.Devices, balenaReleasePinDevice{
+			ID:              device.ID,
+			UUID:            device.UUID,
+			PreviousRelease: previous,
+		})
+	}
+
+	return nil
+}
+
+// applyReleasePin pins each device to the pin's release
+func applyReleasePin(ctx context.Context, c *balenaClient, pin *balenaReleasePin) error {
+	for _, device := range pin.Devices {
+		if err := setDevicePin(ctx, c, device.ID, &pin.ReleaseID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreReleasePin puts each device back on the release it was pinned
+// to before, or back to tracking the latest release
+func restoreReleasePin(ctx context.Context, c *balenaClient, pin *balenaReleasePin) error {
+	for _, device := range pin.Devices {
+		if err := setDevicePin(ctx, c, device.ID, device.PreviousRelease); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getReleasePin returns a recorded release pin, or nil if there is none
+func getReleasePin(ctx context.Context, s logical.Storage, id string) (*balenaReleasePin, error) {
+	entry, err := s.Get(ctx, releasePinStoragePrefix+id)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var pin balenaReleasePin
+	if err := entry.DecodeJSON(&pin); err != nil {
+		return nil, fmt.Errorf("error reading release pin: %w", err)
+	}
+
+	return &pin, nil
+}
+
+// listReleasePins returns every recorded release pin
+func listReleasePins(ctx context.Context, s logical.Storage) ([]*balenaReleasePin, error) {
+	ids, err := s.List(ctx, releasePinStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var pins []*balenaReleasePin
+	for _, id := range ids {
+		pin, err := getReleasePin(ctx, s, id)
+		if err != nil {
+			return nil, err
+		}
+		if pin != nil {
+			pins = append(pins, pin)
+		}
+	}
+
+	return pins, nil
+}
+
+// putReleasePin records a release pin in storage
+func putReleasePin(ctx context.Context, s logical.Storage, pin *balenaReleasePin) error {
+	entry, err := logical.StorageEntryJSON(releasePinStoragePrefix+pin.ID, pin)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// getFleetRelease looks up a successful release of a fleet by full or
+// abbreviated commit, returning nil when there is no such release
+func getFleetRelease(ctx context.Context, c *balenaClient, fleetID int, commit string) (*balenaRelease, error) {
+	if !releaseCommitRegex.MatchString(commit) {
+		return nil, fmt.Errorf("invalid release commit %q", commit)
+	}
+
+	var releases struct {
+		D []balenaRelease `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/release?$select=id,commit&$filter=(belongs_to__application%%20eq%%20%d)%%20and%%20(status%%20eq%%20%%27success%%27)%%20and%%20startswith(commit,%%27%s%%27)", fleetID, commit), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Do(req, &releases); err != nil {
+		return nil, fmt.Errorf("error getting balena release: %w", err)
+	}
+
+	switch len(releases.D) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &releases.D[0], nil
+	default:
+		return nil, fmt.Errorf("release commit %q is ambiguous", commit)
+	}
+}
+
+// getDevicePin returns the ID of the release a device is pinned to, or nil
+// when it tracks its fleet's latest release
+func getDevicePin(ctx context.Context, c *balenaClient, deviceID int) (*int, error) {
+	var devices struct {
+		D []struct {
+			Release *struct {
+				ID int `json:"__id"`
+			} `json:"is_pinned_on__release"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/device(%d)?$select=is_pinned_on__release", deviceID), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Do(req, &devices); err != nil {
+		return nil, fmt.Errorf("error getting balena device release: %w", err)
+	}
+
+	if len(devices.D) == 0 {
+		return nil, fmt.Errorf("balena device %d not found", deviceID)
+	}
+
+	if devices.D[0].Release == nil {
+		return nil, nil
+	}
+
+	return &devices.D[0].Release.ID, nil
+}
+
+// setDevicePin calls the balena client to pin a device to a release, or
+// to make it track its fleet's latest release when releaseID is nil
+func setDevicePin(ctx context.Context, c *balenaClient, deviceID int, releaseID *int) error {
+	type balenaBody struct {
+		Release *int `json:"is_pinned_on__release"`
+	}
+
+	req, err := c.NewRequest(ctx, "PATCH", fmt.Sprintf("v6/device(%d)", deviceID), "", balenaBody{
+		Release: releaseID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error setting balena device release: %w", err)
+	}
+
+	return nil
+}
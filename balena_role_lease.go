@@ -0,0 +1,157 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	roleLeaseStoragePrefix = "role-lease/"
+)
+
+// balenaRoleLease records an outstanding lease whose revocation needs the
+// balena key of the role that issued it, so the role can't be deleted first.
+type balenaRoleLease struct {
+	Type     string    `json:"type"`
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+// roleLeasePath returns the storage path of a role's lease record
+func roleLeasePath(role string, ref string) string {
+	return roleLeaseStoragePrefix + role + "/" + ref
+}
+
+// trackRoleLease records the lease of resp against the role in its
+// "role" internal data, until the lease is revoked
+func trackRoleLease(ctx context.Context, s logical.Storage, resp *logical.Response) error {
+	role, ok := resp.Secret.InternalData["role"].(string)
+	if !ok {
+		return errors.New("secret is missing role internal data")
+	}
+
+	secretType, _ := resp.Secret.InternalData["secret_type"].(string)
+
+	ref := uuid.New().String()
+	entry, err := logical.StorageEntryJSON(roleLeasePath(role, ref), &balenaRoleLease{
+		Type:     secretType,
+		IssuedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.Put(ctx, entry); err != nil {
+		return err
+	}
+
+	resp.Secret.InternalData["lease_ref"] = ref
+	return nil
+}
+
+// roleLeaseRevoke wraps the revoke handler of a tracked lease so that the
+// lease record is removed once the lease has been revoked
+func roleLeaseRevoke(revoke framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		resp, err := revoke(ctx, req, d)
+		if err != nil || (resp != nil && resp.IsError()) {
+			return resp, err
+		}
+
+		role, _ := req.Secret.InternalData["role"].(string)
+		ref, _ := req.Secret.InternalData["lease_ref"].(string)
+		if role == "" || ref == "" {
+			return resp, nil
+		}
+
+		if err := req.Storage.Delete(ctx, roleLeasePath(role, ref)); err != nil {
+			return nil, err
+		}
+
+		return resp, nil
+	}
+}
+
+// countRoleLeases returns the number of tracked leases the role has
+// outstanding. Nested roles keep their leases below the role's own, and
+// are not counted.
+func countRoleLeases(ctx context.Context, s logical.Storage, role string) (int, error) {
+	refs, err := s.List(ctx, roleLeaseStoragePrefix+role+"/")
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, ref := range refs {
+		if !strings.HasSuffix(ref, "/") {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// roleInUse returns why the role can't be deleted yet, or "" when nothing
+// outstanding needs the role's balena key anymore
+func (b *balenaBackend) roleInUse(ctx context.Context, s logical.Storage, role string) (string, error) {
+	leases, err := countRoleLeases(ctx, s, role)
+	if err != nil {
+		return "", err
+	}
+
+	if leases > 0 {
+		return fmt.Sprintf("%d leases issued by the role are still outstanding", leases), nil
+	}
+
+	grants, err := listTeamGrants(ctx, s)
+	if err != nil {
+		return "", err
+	}
+
+	for _, grant := range grants {
+		if grant.Role == role && grant.RevokedAt.IsZero() {
+			return fmt.Sprintf("team grant of %q to %q is still outstanding", grant.Team, grant.Username), nil
+		}
+	}
+
+	overrides, err := listDeviceOverrides(ctx, s)
+	if err != nil {
+		return "", err
+	}
+
+	for _, override := range overrides {
+		if override.Role == role {
+			return fmt.Sprintf("device override %q has not been restored yet", override.ID), nil
+		}
+	}
+
+	pins, err := listReleasePins(ctx, s)
+	if err != nil {
+		return "", err
+	}
+
+	for _, pin := range pins {
+		if pin.Role == role {
+			return fmt.Sprintf("release pin %q has not been restored yet", pin.ID), nil
+		}
+	}
+
+	moves, err := listDeviceMoves(ctx, s)
+	if err != nil {
+		return "", err
+	}
+
+	for _, move := range moves {
+		if move.Role == role {
+			return fmt.Sprintf("device %q has not been moved back to %q yet", move.DeviceUUID, move.FromFleet), nil
+		}
+	}
+
+	return "", nil
+}
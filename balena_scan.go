@@ -0,0 +1,333 @@
+package balenakeys
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	scanReasonPrivateKey  = "private_key"
+	scanReasonHighEntropy = "high_entropy"
+
+	// scanMinEntropyLength and scanMinEntropy bound the values flagged as
+	// high entropy. Shorter values and ones below 3.5 bits per character,
+	// such as words and numbers, are too common to report.
+	scanMinEntropyLength = 20
+	scanMinEntropy       = 3.5
+
+	// deviceServiceEnvVarResource holds the variables set for one service
+	// on one device
+	deviceServiceEnvVarResource = "device_service_environment_variable"
+)
+
+// scanKeyPrefixes are the prefixes of well-known credential formats
+var scanKeyPrefixes = []struct {
+	name  string
+	regex *regexp.Regexp
+}{
+	{"aws_access_key", regexp.MustCompile(`^(AKIA|ASIA)[0-9A-Z]{16}$`)},
+	{"github_token", regexp.MustCompile(`^(gh[pousr]_[0-9A-Za-z]{30,}|github_pat_\w{20,})$`)},
+	{"gitlab_token", regexp.MustCompile(`^glpat-[\w-]{20,}$`)},
+	{"slack_token", regexp.MustCompile(`^xox[abpr]-[\w-]{10,}$`)},
+	{"stripe_key", regexp.MustCompile(`^[sr]k_(live|test)_[0-9A-Za-z]{16,}$`)},
+	{"google_api_key", regexp.MustCompile(`^AIza[\w-]{35}$`)},
+	{"sendgrid_key", regexp.MustCompile(`^SG\.[\w-]{16,}\.[\w-]{16,}$`)},
+	{"npm_token", regexp.MustCompile(`^npm_[0-9A-Za-z]{36}$`)},
+	{"pypi_token", regexp.MustCompile(`^pypi-[\w-]{50,}$`)},
+	{"vault_token", regexp.MustCompile(`^hv[sbr]\.[\w-]{20,}$`)},
+	{"jwt", regexp.MustCompile(`^eyJ[\w-]+\.eyJ[\w-]+\.[\w-]+$`)},
+	{"url_credentials", regexp.MustCompile(`^[a-z][a-z0-9+.-]*://[^/\s:@]+:[^/\s@]+@`)},
+}
+
+// scanTokenRegex matches values made only of the characters of base64,
+// hex and URL-safe tokens. Only those are checked for entropy, as URLs,
+// paths and sentences are long and varied without being secret.
+var scanTokenRegex = regexp.MustCompile(`^[A-Za-z0-9+/=_-]+$`)
+
+// scanUUIDRegex matches UUIDs, which are random but not secret
+var scanUUIDRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+
+// balenaScanFinding is an environment variable whose value looks like a
+// credential. The value itself is never reported.
+type balenaScanFinding struct {
+	Fleet      string   `json:"fleet"`
+	Service    string   `json:"service,omitempty"`
+	DeviceUUID string   `json:"device_uuid,omitempty"`
+	Name       string   `json:"name"`
+	Reasons    []string `json:"reasons"`
+	Owner      string   `json:"owner,omitempty"`
+}
+
+// balenaScanOwners are the sync and managed variable definitions that own
+// balena variables, to report which flagged values Vault already manages
+type balenaScanOwners struct {
+	syncs       []*balenaSync
+	syncManaged map[string][]string
+	managedVars []*balenaManagedVar
+	canaries    map[string][]string
+}
+
+// scanValue returns why a value looks like a credential, or nil when it
+// does not
+func scanValue(value string) []string {
+	value = strings.TrimSpace(value)
+
+	var reasons []string
+	if strings.Contains(value, "-----BEGIN ") && strings.Contains(value, "PRIVATE KEY-----") {
+		reasons = append(reasons, scanReasonPrivateKey)
+	}
+
+	for _, prefix := range scanKeyPrefixes {
+		if prefix.regex.MatchString(value) {
+			reasons = append(reasons, "known_prefix:"+prefix.name)
+		}
+	}
+
+	if len(value) >= scanMinEntropyLength && scanTokenRegex.MatchString(value) &&
+		!scanUUIDRegex.MatchString(value) && shannonEntropy(value) >= scanMinEntropy {
+		reasons = append(reasons, scanReasonHighEntropy)
+	}
+
+	return reasons
+}
+
+// shannonEntropy returns the entropy of a string in bits per character
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+
+	var entropy float64
+	for _, n := range counts {
+		p := float64(n) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// scanFleet flags the fleet, service, device and device service environment
+// variables of a fleet whose values look like credentials
+func scanFleet(ctx context.Context, c *balenaClient, fleet balenaFleet, owners *balenaScanOwners) ([]balenaScanFinding, int, error) {
+	var findings []balenaScanFinding
+	scanned := 0
+
+	check := func(f balenaScanFinding, value string) {
+		scanned++
+		if f.Reasons = scanValue(value); f.Reasons != nil {
+			f.Owner = owners.owner(fleet, f)
+			findings = append(findings, f)
+		}
+	}
+
+	fleetVars, err := listVarSet(ctx, c, balenaVarSet{Resource: fleetEnvVarResource, Parent: "application", ParentID: fleet.ID})
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, v := range fleetVars {
+		check(balenaScanFinding{Fleet: fleet.Slug, Name: v.Name}, v.Value)
+	}
+
+	var serviceVars struct {
+		D []struct {
+			balenaEnvVar
+			Service []struct {
+				ServiceName string `json:"service_name"`
+			} `json:"service"`
+		} `json:"d"`
+	}
+	if err := scanList(ctx, c, fmt.Sprintf("v6/%s?$select=id,name,value&$expand=service($select=service_name)&$filter=service/application%%20eq%%20%d", serviceEnvVarResource, fleet.ID), &serviceVars); err != nil {
+		return nil, 0, err
+	}
+	for _, v := range serviceVars.D {
+		f := balenaScanFinding{Fleet: fleet.Slug, Name: v.Name}
+		if len(v.Service) > 0 {
+			f.Service = v.Service[0].ServiceName
+		}
+		check(f, v.Value)
+	}
+
+	var deviceVars struct {
+		D []struct {
+			balenaEnvVar
+			Device []struct {
+				UUID string `json:"uuid"`
+			} `json:"device"`
+		} `json:"d"`
+	}
+	if err := scanList(ctx, c, fmt.Sprintf("v6/%s?$select=id,name,value&$expand=device($select=uuid)&$filter=device/belongs_to__application%%20eq%%20%d", deviceEnvironmentVarResource, fleet.ID), &deviceVars); err != nil {
+		return nil, 0, err
+	}
+	for _, v := range deviceVars.D {
+		f := balenaScanFinding{Fleet: fleet.Slug, Name: v.Name}
+		if len(v.Device) > 0 {
+			f.DeviceUUID = v.Device[0].UUID
+		}
+		check(f, v.Value)
+	}
+
+	var deviceServiceVars struct {
+		D []struct {
+			balenaEnvVar
+			ServiceInstall []struct {
+				Device []struct {
+					UUID string `json:"uuid"`
+				} `json:"device"`
+				Service []struct {
+					ServiceName string `json:"service_name"`
+				} `json:"installs__service"`
+			} `json:"service_install"`
+		} `json:"d"`
+	}
+	if err := scanList(ctx, c, fmt.Sprintf("v6/%s?$select=id,name,value&$expand=service_install($select=id%%3B$expand=device($select=uuid),installs__service($select=service_name))&$filter=service_install/device/belongs_to__application%%20eq%%20%d", deviceServiceEnvVarResource, fleet.ID), &deviceServiceVars); err != nil {
+		return nil, 0, err
+	}
+	for _, v := range deviceServiceVars.D {
+		f := balenaScanFinding{Fleet: fleet.Slug, Name: v.Name}
+		if len(v.ServiceInstall) > 0 {
+			install := v.ServiceInstall[0]
+			if len(install.Device) > 0 {
+				f.DeviceUUID = install.Device[0].UUID
+			}
+			if len(install.Service) > 0 {
+				f.Service = install.Service[0].ServiceName
+			}
+		}
+		check(f, v.Value)
+	}
+
+	return findings, scanned, nil
+}
+
+// scanList calls the balena client to list the variables of a resource
+func scanList(ctx context.Context, c *balenaClient, path string, v interface{}) error {
+	req, err := c.NewRequest(ctx, "GET", path, "", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, v); err != nil {
+		return fmt.Errorf("error listing balena variables: %w", err)
+	}
+
+	return nil
+}
+
+// listFleets returns every fleet the balena key can see
+func listFleets(ctx context.Context, c *balenaClient) ([]balenaFleet, error) {
+	var fleets struct {
+		D []balenaFleet `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", "v6/application?$select=id,slug", "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Do(req, &fleets); err != nil {
+		return nil, fmt.Errorf("error listing balena fleets: %w", err)
+	}
+
+	sort.Slice(fleets.D, func(i, j int) bool { return fleets.D[i].Slug < fleets.D[j].Slug })
+
+	return fleets.D, nil
+}
+
+// getScanOwners loads the sync and managed variable definitions
+func getScanOwners(ctx context.Context, s logical.Storage) (*balenaScanOwners, error) {
+	owners := &balenaScanOwners{
+		syncManaged: map[string][]string{},
+		canaries:    map[string][]string{},
+	}
+
+	syncNames, err := s.List(ctx, syncStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range syncNames {
+		sync, err := getSync(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if sync == nil {
+			continue
+		}
+
+		status, err := getSyncStatus(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+
+		owners.syncs = append(owners.syncs, sync)
+		owners.syncManaged[name] = status.Managed
+	}
+
+	varNames, err := s.List(ctx, managedVarStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range varNames {
+		v, err := getManagedVar(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+
+		state, err := getManagedVarState(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+
+		owners.managedVars = append(owners.managedVars, v)
+		if state.Canary != nil {
+			for _, device := range state.Canary.Devices {
+				owners.canaries[name] = append(owners.canaries[name], device.UUID)
+			}
+		}
+	}
+
+	return owners, nil
+}
+
+// owner returns the Vault path of the definition that owns a variable,
+// or an empty string when only balena holds it
+func (o *balenaScanOwners) owner(fleet balenaFleet, f balenaScanFinding) string {
+	for _, sync := range o.syncs {
+		if f.DeviceUUID != "" || sync.Service != f.Service || !fleetAllowed([]string{sync.Fleet}, fleet) {
+			continue
+		}
+
+		for _, name := range o.syncManaged[sync.Name] {
+			if name == f.Name {
+				return syncStoragePrefix + sync.Name
+			}
+		}
+	}
+
+	for _, v := range o.managedVars {
+		if f.Service != "" || v.VarName != f.Name || !fleetAllowed([]string{v.Fleet}, fleet) {
+			continue
+		}
+
+		switch {
+		case f.DeviceUUID == "" && v.DeviceUUID == "":
+			return managedVarStoragePrefix + v.Name
+		case f.DeviceUUID != "" && strings.EqualFold(f.DeviceUUID, v.DeviceUUID):
+			return managedVarStoragePrefix + v.Name
+		case f.DeviceUUID != "" && len(o.canaries[v.Name]) > 0 && deviceAllowed(o.canaries[v.Name], f.DeviceUUID):
+			return managedVarStoragePrefix + v.Name
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,274 @@
+package balenakeys
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	balenaSSHKeyType = "balena_ssh_key"
+)
+
+// balenaSSHKey defines a secret for an SSH public key registered
+// on a balena user and how it should be revoked or renewed.
+func (b *balenaBackend) balenaSSHKey() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaSSHKeyType,
+		Fields: map[string]*framework.FieldSchema{
+			"private_key": {
+				Type:        framework.TypeString,
+				Description: "Generated OpenSSH private key, when no public key was supplied",
+			},
+			"public_key": {
+				Type:        framework.TypeString,
+				Description: "Public key registered on the balena user",
+			},
+			"key_id": {
+				Type:        framework.TypeInt,
+				Description: "ID of the public key in balena",
+			},
+		},
+		Revoke: roleLeaseRevoke(b.sshKeyRevoke),
+		Renew:  b.tokenRenew,
+	}
+}
+
+// createSSHKeyCreds registers an SSH public key on the role's balena user and
+// returns it under a lease. Without a caller supplied public key, an ed25519
+// key pair is generated and the private key is returned.
+func (b *balenaBackend) createSSHKeyCreds(ctx context.Context, req *logical.Request, role *balenaRoleEntry, publicKey string, balenaName string, ttl time.Duration) (*logical.Response, error) {
+	var privateKey string
+	if publicKey == "" {
+		var err error
+		publicKey, privateKey, err = generateSSHKeyPair(balenaName)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey)); err != nil {
+		return logical.ErrorResponse("invalid public_key: %s", err), nil
+	}
+
+	if balenaName == "" {
+		balenaName = "vault-" + uuid.New().String()
+	}
+
+	client, err := b.getClient(ctx, req.Storage, role.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := whoami(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, err := createSSHKey(ctx, client, userID, balenaName, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{
+		"public_key": publicKey,
+		"key_id":     keyID,
+		"key_name":   balenaName,
+	}
+	if privateKey != "" {
+		data["private_key"] = privateKey
+	}
+
+	resp := b.Secret(balenaSSHKeyType).Response(data, map[string]interface{}{
+		"key_id":   keyID,
+		"key_name": balenaName,
+		"role":     role.Name,
+		"ttl":      ttl,
+		"max_ttl":  role.MaxTTL,
+	})
+
+	if ttl > 0 {
+		resp.Secret.TTL = ttl
+	}
+
+	if role.MaxTTL > 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+
+	// the role can't be deleted while the key still needs its balena key
+	// to be removed again
+	if err := trackRoleLease(ctx, req.Storage, resp); err != nil {
+		if delErr := deleteSSHKey(ctx, client, keyID); delErr != nil {
+			b.Logger().Error("error removing untracked ssh key", "key_id", keyID, "error", delErr)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// sshKeyRevoke deletes the public key from the balena user
+func (b *balenaBackend) sshKeyRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName, ok := req.Secret.InternalData["role"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing role internal data")
+	}
+
+	keyID, ok := internalDataInt(req.Secret.InternalData["key_id"])
+	if !ok {
+		return nil, errors.New("secret is missing key_id internal data")
+	}
+
+	roleEntry, err := b.getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return nil, fmt.Errorf("error retrieving role: role %q not found", roleName)
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	if err := deleteSSHKey(ctx, client, keyID); err != nil {
+		return nil, fmt.Errorf("error revoking ssh key: %w", err)
+	}
+
+	return nil, nil
+}
+
+// createSSHKey calls the balena client to register a public key on a user
+func createSSHKey(ctx context.Context, c *balenaClient, userID int, title string, publicKey string) (int, error) {
+	type balenaBody struct {
+		User      int    `json:"user"`
+		Title     string `json:"title"`
+		PublicKey string `json:"public_key"`
+	}
+
+	req, err := c.NewRequest(ctx, "POST", "v6/user__has__public_key", "", balenaBody{
+		User:      userID,
+		Title:     title,
+		PublicKey: strings.TrimSpace(publicKey),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var key struct {
+		ID int `json:"id"`
+	}
+	if err := c.Do(req, &key); err != nil {
+		return 0, fmt.Errorf("error creating balena ssh key: %w", err)
+	}
+
+	return key.ID, nil
+}
+
+// deleteSSHKey calls the balena client to remove a public key from a user
+func deleteSSHKey(ctx context.Context, c *balenaClient, keyID int) error {
+	req, err := c.NewRequest(ctx, "DELETE", fmt.Sprintf("v6/user__has__public_key(%d)", keyID), "", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error deleting balena ssh key: %w", err)
+	}
+
+	return nil
+}
+
+// generateSSHKeyPair returns a new ed25519 key pair as an authorized_keys
+// line and a PEM encoded OpenSSH private key
+func generateSSHKeyPair(comment string) (string, string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating ssh key: %w", err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", "", err
+	}
+
+	privPEM, err := marshalOpenSSHPrivateKey(priv, comment)
+	if err != nil {
+		return "", "", err
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))), string(privPEM), nil
+}
+
+// marshalOpenSSHPrivateKey encodes an unencrypted ed25519 private key in the
+// "openssh-key-v1" format that ssh and ssh-keygen expect
+func marshalOpenSSHPrivateKey(key ed25519.PrivateKey, comment string) ([]byte, error) {
+	pub := key.Public().(ed25519.PublicKey)
+
+	pubKey := struct {
+		KeyType string
+		Pub     []byte
+	}{ssh.KeyAlgoED25519, pub}
+
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	checkInt := binary.BigEndian.Uint32(check[:])
+
+	privKey := struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+		Rest    []byte `ssh:"rest"`
+	}{
+		Check1:  checkInt,
+		Check2:  checkInt,
+		KeyType: ssh.KeyAlgoED25519,
+		Pub:     pub,
+		Priv:    key,
+		Comment: comment,
+	}
+
+	// pad the private section to the 8 byte block size of the "none" cipher
+	unpadded := len(ssh.Marshal(privKey))
+	for i := 1; (unpadded+len(privKey.Rest))%8 != 0; i++ {
+		privKey.Rest = append(privKey.Rest, byte(i))
+	}
+
+	envelope := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       ssh.Marshal(pubKey),
+		PrivKeyBlock: ssh.Marshal(privKey),
+	}
+
+	block := &pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), ssh.Marshal(envelope)...),
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
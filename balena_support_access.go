@@ -0,0 +1,249 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaSupportAccessType = "balena_support_access"
+
+	supportTargetDevice = "device"
+	supportTargetFleet  = "fleet"
+
+	supportAccessStoragePrefix = "support-access/"
+)
+
+// balenaSupportGrant records the lease that currently grants support access
+// to a device or fleet, so that a second lease can't record the first one's
+// access as granted before it
+type balenaSupportGrant struct {
+	Role     string    `json:"role"`
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+// balenaSupportAccess defines a secret for balena support access to a device
+// or fleet and how it should be revoked or renewed.
+func (b *balenaBackend) balenaSupportAccess() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaSupportAccessType,
+		Fields: map[string]*framework.FieldSchema{
+			"accessible_until": {
+				Type:        framework.TypeString,
+				Description: "Time until which balena support can access the device or fleet",
+			},
+		},
+		Revoke: roleLeaseRevoke(b.supportAccessRevoke),
+		Renew:  b.supportAccessRenew,
+	}
+}
+
+// supportAccessRevoke ends balena support access immediately, unless it had
+// been granted for longer before the lease, in which case that expiry is
+// restored
+func (b *balenaBackend) supportAccessRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	client, target, targetID, err := b.supportAccessTarget(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var until *time.Time
+	if previous := previousSupportAccess(req); previous != nil && previous.After(time.Now()) {
+		until = previous
+	}
+
+	b.supportLock.Lock()
+	defer b.supportLock.Unlock()
+
+	if err := setSupportAccess(ctx, client, target, targetID, until); err != nil {
+		return nil, fmt.Errorf("error revoking support access: %w", err)
+	}
+
+	if err := req.Storage.Delete(ctx, supportGrantPath(target, targetID)); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// supportAccessRenew extends the lease and moves the end of support
+// access to the new end of the lease
+func (b *balenaBackend) supportAccessRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	resp, err := b.tokenRenew(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	client, target, targetID, err := b.supportAccessTarget(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	until := laterSupportAccess(renewedLeaseEnd(req, resp), previousSupportAccess(req))
+	if err := setSupportAccess(ctx, client, target, targetID, &until); err != nil {
+		return nil, fmt.Errorf("error extending support access: %w", err)
+	}
+
+	return resp, nil
+}
+
+// supportAccessTarget returns a client for the secret's role together with
+// the kind and ID of the device or fleet support access was granted to
+func (b *balenaBackend) supportAccessTarget(ctx context.Context, req *logical.Request) (*balenaClient, string, int, error) {
+	roleName, ok := req.Secret.InternalData["role"].(string)
+	if !ok {
+		return nil, "", 0, errors.New("secret is missing role internal data")
+	}
+
+	target, ok := req.Secret.InternalData["target"].(string)
+	if !ok {
+		return nil, "", 0, errors.New("secret is missing target internal data")
+	}
+
+	targetID, ok := internalDataInt(req.Secret.InternalData["target_id"])
+	if !ok {
+		return nil, "", 0, errors.New("secret is missing target_id internal data")
+	}
+
+	roleEntry, err := b.getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return nil, "", 0, fmt.Errorf("error retrieving role: role %q not found", roleName)
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("error getting client: %w", err)
+	}
+
+	return client, target, targetID, nil
+}
+
+// supportGrantPath returns the storage path of the support access grant of
+// a device or fleet
+func supportGrantPath(target string, targetID int) string {
+	return fmt.Sprintf("%s%s/%d", supportAccessStoragePrefix, target, targetID)
+}
+
+// getSupportGrant returns the lease granting support access to a device or
+// fleet, or nil if there is none
+func getSupportGrant(ctx context.Context, s logical.Storage, target string, targetID int) (*balenaSupportGrant, error) {
+	entry, err := s.Get(ctx, supportGrantPath(target, targetID))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var grant balenaSupportGrant
+	if err := entry.DecodeJSON(&grant); err != nil {
+		return nil, err
+	}
+
+	return &grant, nil
+}
+
+// putSupportGrant records the lease granting support access to a device or
+// fleet
+func putSupportGrant(ctx context.Context, s logical.Storage, target string, targetID int, grant *balenaSupportGrant) error {
+	entry, err := logical.StorageEntryJSON(supportGrantPath(target, targetID), grant)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// previousSupportAccess returns the support access expiry the target had
+// before the lease was issued, or nil if it had none
+func previousSupportAccess(req *logical.Request) *time.Time {
+	raw, _ := req.Secret.InternalData["previous_until"].(string)
+	if raw == "" {
+		return nil
+	}
+
+	previous, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return nil
+	}
+	return &previous
+}
+
+// laterSupportAccess returns until, or previous if it ends later, so that a
+// lease never shortens support access granted before it
+func laterSupportAccess(until time.Time, previous *time.Time) time.Time {
+	if previous != nil && previous.After(until) {
+		return *previous
+	}
+	return until
+}
+
+// getSupportAccess calls the balena client to read until when support can
+// access a device or fleet, returning nil when it cannot
+func getSupportAccess(ctx context.Context, c *balenaClient, target string, targetID int) (*time.Time, error) {
+	resource := "device"
+	if target == supportTargetFleet {
+		resource = "application"
+	}
+
+	var result struct {
+		D []struct {
+			Until *time.Time `json:"is_accessible_by_support_until__date"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/%s(%d)?$select=is_accessible_by_support_until__date", resource, targetID), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Do(req, &result); err != nil {
+		return nil, fmt.Errorf("error getting balena support access: %w", err)
+	}
+
+	if len(result.D) == 0 {
+		return nil, nil
+	}
+
+	return result.D[0].Until, nil
+}
+
+// setSupportAccess calls the balena client to grant support access to a
+// device or fleet until the given time, or to remove it when until is nil
+func setSupportAccess(ctx context.Context, c *balenaClient, target string, targetID int, until *time.Time) error {
+	type balenaBody struct {
+		Until *string `json:"is_accessible_by_support_until__date"`
+	}
+
+	resource := "device"
+	if target == supportTargetFleet {
+		resource = "application"
+	}
+
+	var body balenaBody
+	if until != nil {
+		date := until.UTC().Format(balenaTimeFormat)
+		body.Until = &date
+	}
+
+	req, err := c.NewRequest(ctx, "PATCH", fmt.Sprintf("v6/%s(%d)", resource, targetID), "", body)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error setting balena support access: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,543 @@
+package balenakeys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-secure-stdlib/strutil"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	syncStoragePrefix       = "sync/"
+	syncStatusStoragePrefix = "sync-status/"
+
+	fleetEnvVarResource   = "application_environment_variable"
+	serviceEnvVarResource = "service_environment_variable"
+)
+
+// balenaSync maps a Vault KV secret to the environment variables of a
+// fleet, or of one service of a fleet, using the balena key of Role
+type balenaSync struct {
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	KVMount   string `json:"kv_mount"`
+	KVPath    string `json:"kv_path"`
+	KVVersion int    `json:"kv_version"`
+	Fleet     string `json:"fleet"`
+	Service   string `json:"service,omitempty"`
+}
+
+// balenaSyncStatus is the outcome of the last run of a sync. Managed holds
+// the variables the sync set, which are the only ones it will delete when
+// their key disappears from the KV secret.
+type balenaSyncStatus struct {
+	LastRunAt     time.Time `json:"last_run_at"`
+	LastSuccessAt time.Time `json:"last_success_at,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+
+	// TokenExpiresAt is when vault_token expires, unless it is renewed
+	TokenExpiresAt time.Time `json:"token_expires_at,omitempty"`
+	Managed        []string  `json:"managed"`
+	Created        int       `json:"created"`
+	Updated        int       `json:"updated"`
+	Deleted        int       `json:"deleted"`
+}
+
+// toResponseData returns the status as the data of a read response
+func (st *balenaSyncStatus) toResponseData() map[string]interface{} {
+	data := map[string]interface{}{
+		"last_run_at":      st.LastRunAt,
+		"last_success_at":  st.LastSuccessAt,
+		"last_error":       st.LastError,
+		"token_expires_at": st.TokenExpiresAt,
+		"in_sync":          st.LastError == "" && !st.LastSuccessAt.IsZero(),
+		"managed":          st.Managed,
+		"created":          st.Created,
+		"updated":          st.Updated,
+		"deleted":          st.Deleted,
+	}
+	if st.Managed == nil {
+		data["managed"] = []string{}
+	}
+	return data
+}
+
+// balenaVarSet is the set of environment variables a sync writes to,
+// either a fleet's or a service's
+type balenaVarSet struct {
+	Resource string
+	Parent   string
+	ParentID int
+}
+
+// reconcileSyncs keeps the configured vault_token alive and makes the
+// balena environment variables of every sync match its KV secret,
+// recording the outcome in the sync's status. A failing sync does not
+// stop the others.
+func (b *balenaBackend) reconcileSyncs(ctx context.Context, s logical.Storage) error {
+	b.syncLock.Lock()
+	defer b.syncLock.Unlock()
+
+	names, err := s.List(ctx, syncStoragePrefix)
+	if err != nil {
+		return err
+	}
+
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	// the token is renewed even without syncs, as build secrets use it too
+	if len(names) == 0 && (config == nil || config.VaultToken == "") {
+		return nil
+	}
+
+	vault, err := syncVaultClient(config)
+	if err != nil {
+		return err
+	}
+
+	expiresAt, tokenErr := maintainVaultToken(ctx, vault)
+	if tokenErr != nil {
+		b.Logger().Error("error renewing vault_token", "error", tokenErr)
+	}
+
+	for _, name := range names {
+		sync, err := getSync(ctx, s, name)
+		if err != nil {
+			return err
+		}
+
+		if sync == nil {
+			continue
+		}
+
+		status, err := getSyncStatus(ctx, s, name)
+		if err != nil {
+			return err
+		}
+
+		if tokenErr != nil {
+			status.LastRunAt = time.Now()
+			status.LastError = tokenErr.Error()
+		} else {
+			status, err = b.runSync(ctx, s, vault, config, sync, status)
+			if err != nil {
+				b.Logger().Error("error syncing kv secret to balena", "sync", sync.Name, "error", err)
+				status.LastError = err.Error()
+			}
+		}
+		status.TokenExpiresAt = expiresAt
+
+		if err := putSyncStatus(ctx, s, name, status); err != nil {
+			return err
+		}
+	}
+
+	return tokenErr
+}
+
+// runSync creates, updates and deletes the target's variables to match
+// the sync's KV secret, starting from the status of the previous run
+func (b *balenaBackend) runSync(ctx context.Context, s logical.Storage, vault *api.Client, config *balenaConfig, sync *balenaSync, previous *balenaSyncStatus) (*balenaSyncStatus, error) {
+	status := &balenaSyncStatus{
+		LastRunAt:     time.Now(),
+		LastSuccessAt: previous.LastSuccessAt,
+		Managed:       previous.Managed,
+	}
+
+	// checked on every run, as allowed_kv_paths may have been narrowed
+	// since the sync was written
+	if !kvPathAllowed(config, sync.KVMount, sync.KVPath) {
+		return status, fmt.Errorf("kv secret %s/%s is not allowed by allowed_kv_paths", sync.KVMount, sync.KVPath)
+	}
+
+	data, err := readKV(ctx, vault, sync.KVMount, sync.KVPath, sync.KVVersion)
+	if err != nil {
+		return status, err
+	}
+
+	names := make([]string, 0, len(data))
+	for name := range data {
+		if !envVarNameRegex.MatchString(name) {
+			return status, fmt.Errorf("kv key %q is not a valid variable name", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	role, err := b.getRole(ctx, s, sync.Role)
+	if err != nil {
+		return status, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if role == nil {
+		return status, fmt.Errorf("role %q not found", sync.Role)
+	}
+
+	client, err := b.getClient(ctx, s, role.BalenaApiKey)
+	if err != nil {
+		return status, err
+	}
+
+	set, err := syncVarSet(ctx, client, role, sync)
+	if err != nil {
+		return status, err
+	}
+
+	existing, err := listVarSet(ctx, client, set)
+	if err != nil {
+		return status, err
+	}
+
+	current := make(map[string]balenaEnvVar, len(existing))
+	for _, v := range existing {
+		current[v.Name] = v
+	}
+
+	// until the run succeeds, variables it may have created are managed
+	// alongside the previous ones, so a failed run cannot orphan them
+	status.Managed = mergeNames(previous.Managed, names)
+
+	for _, name := range names {
+		v, ok := current[name]
+		switch {
+		case !ok:
+			if err := createVarSetVar(ctx, client, set, name, data[name]); err != nil {
+				return status, err
+			}
+			status.Created++
+		case v.Value != data[name]:
+			if err := updateVarSetVar(ctx, client, set, v.ID, data[name]); err != nil {
+				return status, err
+			}
+			status.Updated++
+		}
+	}
+
+	for _, name := range previous.Managed {
+		v, ok := current[name]
+		if _, keep := data[name]; keep || !ok {
+			continue
+		}
+
+		if err := deleteVarSetVar(ctx, client, set, v.ID); err != nil {
+			return status, err
+		}
+		status.Deleted++
+	}
+
+	status.Managed = names
+	status.LastSuccessAt = status.LastRunAt
+
+	return status, nil
+}
+
+// mergeNames returns the sorted union of two lists of names
+func mergeNames(a []string, b []string) []string {
+	seen := map[string]bool{}
+	var merged []string
+	for _, name := range append(append([]string{}, a...), b...) {
+		if !seen[name] {
+			seen[name] = true
+			merged = append(merged, name)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// syncVarSet resolves the fleet and service of a sync to the variable set
+// it writes to, checking the fleet against the role's allow-list
+func syncVarSet(ctx context.Context, c *balenaClient, role *balenaRoleEntry, sync *balenaSync) (balenaVarSet, error) {
+	fleet, err := getFleet(ctx, c, sync.Fleet)
+	if err != nil {
+		return balenaVarSet{}, err
+	}
+
+	if fleet == nil {
+		return balenaVarSet{}, fmt.Errorf("fleet %q not found", sync.Fleet)
+	}
+
+	if !fleetAllowed(role.AllowedFleets, *fleet) {
+		return balenaVarSet{}, fmt.Errorf("fleet %q is not allowed by role %q", fleet.Slug, role.Name)
+	}
+
+	if sync.Service == "" {
+		return balenaVarSet{Resource: fleetEnvVarResource, Parent: "application", ParentID: fleet.ID}, nil
+	}
+
+	serviceID, err := getServiceID(ctx, c, fleet.ID, sync.Service)
+	if err != nil {
+		return balenaVarSet{}, err
+	}
+
+	return balenaVarSet{Resource: serviceEnvVarResource, Parent: "service", ParentID: serviceID}, nil
+}
+
+// syncVaultClient returns a Vault API client for reading KV secrets, as
+// configured by vault_addr and vault_token
+func syncVaultClient(config *balenaConfig) (*api.Client, error) {
+	if config == nil || config.VaultAddr == "" || config.VaultToken == "" {
+		return nil, errors.New("vault_addr and vault_token must be configured to read kv secrets")
+	}
+
+	apiConfig := api.DefaultConfig()
+	apiConfig.Address = config.VaultAddr
+
+	client, err := api.NewClient(apiConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating vault client: %w", err)
+	}
+	client.SetToken(config.VaultToken)
+
+	return client, nil
+}
+
+// kvPathAllowed reports whether a KV secret matches the config's
+// allowed_kv_paths. An empty list allows no secrets.
+func kvPathAllowed(config *balenaConfig, mount string, path string) bool {
+	if config == nil {
+		return false
+	}
+
+	full := strings.Trim(mount, "/") + "/" + strings.Trim(path, "/")
+	return strutil.StrListContainsGlob(config.AllowedKVPaths, full)
+}
+
+// maintainVaultToken looks up the client's token and renews it once less
+// than half of its TTL is left, returning when it expires. Tokens without
+// a TTL return the zero time.
+func maintainVaultToken(ctx context.Context, vault *api.Client) (time.Time, error) {
+	secret, err := vault.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error looking up vault_token: %w", err)
+	}
+
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading vault_token ttl: %w", err)
+	}
+
+	if ttl == 0 {
+		return time.Time{}, nil
+	}
+
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading vault_token renewability: %w", err)
+	}
+
+	var creationTTL int64
+	if n, ok := secret.Data["creation_ttl"].(json.Number); ok {
+		creationTTL, _ = n.Int64()
+	}
+
+	if renewable && ttl < time.Duration(creationTTL)*time.Second/2 {
+		renewed, err := vault.Auth().Token().RenewSelfWithContext(ctx, 0)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error renewing vault_token: %w", err)
+		}
+
+		if renewed.Auth != nil {
+			ttl = time.Duration(renewed.Auth.LeaseDuration) * time.Second
+		}
+	}
+
+	return time.Now().Add(ttl), nil
+}
+
+// readKV reads a version 1 or 2 KV secret, returning its values as
+// strings. Values that are not strings are JSON encoded.
+func readKV(ctx context.Context, vault *api.Client, mount string, path string, version int) (map[string]string, error) {
+	mount, path = strings.Trim(mount, "/"), strings.Trim(path, "/")
+
+	full := mount + "/" + path
+	if version == 2 {
+		full = mount + "/data/" + path
+	}
+
+	secret, err := vault.Logical().ReadWithContext(ctx, full)
+	if err != nil {
+		return nil, fmt.Errorf("error reading kv secret %q: %w", full, err)
+	}
+
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("kv secret %q not found", full)
+	}
+
+	raw := secret.Data
+	if version == 2 {
+		raw, _ = secret.Data["data"].(map[string]interface{})
+		if raw == nil {
+			return nil, fmt.Errorf("kv secret %q is deleted", full)
+		}
+	}
+
+	data := make(map[string]string, len(raw))
+	for k, v := range raw {
+		if str, ok := v.(string); ok {
+			data[k] = str
+			continue
+		}
+
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding kv value %q: %w", k, err)
+		}
+		data[k] = string(encoded)
+	}
+
+	return data, nil
+}
+
+// getSync returns a sync definition, or nil if there is none
+func getSync(ctx context.Context, s logical.Storage, name string) (*balenaSync, error) {
+	entry, err := s.Get(ctx, syncStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var sync balenaSync
+	if err := entry.DecodeJSON(&sync); err != nil {
+		return nil, fmt.Errorf("error reading sync: %w", err)
+	}
+
+	return &sync, nil
+}
+
+// getSyncStatus returns the status of a sync, which is empty before its
+// first run
+func getSyncStatus(ctx context.Context, s logical.Storage, name string) (*balenaSyncStatus, error) {
+	entry, err := s.Get(ctx, syncStatusStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	var status balenaSyncStatus
+	if entry == nil {
+		return &status, nil
+	}
+
+	if err := entry.DecodeJSON(&status); err != nil {
+		return nil, fmt.Errorf("error reading sync status: %w", err)
+	}
+
+	return &status, nil
+}
+
+// putSyncStatus records the status of a sync in storage
+func putSyncStatus(ctx context.Context, s logical.Storage, name string, status *balenaSyncStatus) error {
+	entry, err := logical.StorageEntryJSON(syncStatusStoragePrefix+name, status)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// getServiceID looks up a service of a fleet by name
+func getServiceID(ctx context.Context, c *balenaClient, fleetID int, name string) (int, error) {
+	var services struct {
+		D []struct {
+			ID int `json:"id"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/service?$select=id&$filter=(application%%20eq%%20%d)%%20and%%20(service_name%%20eq%%20%s)", fleetID, odataString(name)), "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Do(req, &services); err != nil {
+		return 0, fmt.Errorf("error getting balena service: %w", err)
+	}
+
+	if len(services.D) == 0 {
+		return 0, fmt.Errorf("service %q not found", name)
+	}
+
+	return services.D[0].ID, nil
+}
+
+// listVarSet returns the environment variables in a variable set
+func listVarSet(ctx context.Context, c *balenaClient, set balenaVarSet) ([]balenaEnvVar, error) {
+	var vars struct {
+		D []balenaEnvVar `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/%s?$select=id,name,value&$filter=%s%%20eq%%20%d", set.Resource, set.Parent, set.ParentID), "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Do(req, &vars); err != nil {
+		return nil, fmt.Errorf("error listing balena variables: %w", err)
+	}
+
+	return vars.D, nil
+}
+
+// createVarSetVar calls the balena client to add a variable to a variable set
+func createVarSetVar(ctx context.Context, c *balenaClient, set balenaVarSet, name string, value string) error {
+	req, err := c.NewRequest(ctx, "POST", "v6/"+set.Resource, "", map[string]interface{}{
+		set.Parent: set.ParentID,
+		"name":     name,
+		"value":    value,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error creating balena variable %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// updateVarSetVar calls the balena client to change the value of a variable
+func updateVarSetVar(ctx context.Context, c *balenaClient, set balenaVarSet, varID int, value string) error {
+	type balenaBody struct {
+		Value string `json:"value"`
+	}
+
+	req, err := c.NewRequest(ctx, "PATCH", fmt.Sprintf("v6/%s(%d)", set.Resource, varID), "", balenaBody{
+		Value: value,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error updating balena variable: %w", err)
+	}
+
+	return nil
+}
+
+// deleteVarSetVar calls the balena client to remove a variable
+func deleteVarSetVar(ctx context.Context, c *balenaClient, set balenaVarSet, varID int) error {
+	req, err := c.NewRequest(ctx, "DELETE", fmt.Sprintf("v6/%s(%d)", set.Resource, varID), "", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error deleting balena variable: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,513 @@
+package balenakeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	balenaTeamMembershipType = "balena_team_membership"
+	teamGrantStoragePrefix   = "team-grant/"
+
+	// teamGrantRetention is how long a revoked grant is kept, so that a
+	// membership re-added by hand after revocation is still removed
+	teamGrantRetention = 7 * 24 * time.Hour
+)
+
+// orgHandleRegex matches balena organization handles
+var orgHandleRegex = regexp.MustCompile(`^[\w.-]+$`)
+
+// balenaTeamGrant records a team membership granted with a lease, so the
+// periodic check can restore or remove the membership to match the lease
+type balenaTeamGrant struct {
+	ID        string    `json:"id"`
+	Role      string    `json:"role"`
+	Username  string    `json:"username"`
+	UserID    int       `json:"user_id"`
+	TeamID    int       `json:"team_id"`
+	Team      string    `json:"team"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+// active reports whether the grant should currently hold a membership
+func (g *balenaTeamGrant) active(now time.Time) bool {
+	return g.RevokedAt.IsZero() && now.Before(g.ExpiresAt)
+}
+
+// balenaTeamMembership defines a secret for a temporary organization team
+// membership of a balena user and how it should be revoked or renewed.
+func (b *balenaBackend) balenaTeamMembership() *framework.Secret {
+	return &framework.Secret{
+		Type: balenaTeamMembershipType,
+		Fields: map[string]*framework.FieldSchema{
+			"username": {
+				Type:        framework.TypeString,
+				Description: "Balena username the membership was granted to",
+			},
+			"team": {
+				Type:        framework.TypeString,
+				Description: "Organization and name of the team",
+			},
+		},
+		Revoke: b.teamMembershipRevoke,
+		Renew:  b.teamMembershipRenew,
+	}
+}
+
+// createTeamMembershipCreds adds the balena user mapped to the requesting
+// Vault entity to the role's organization team and records the grant
+func (b *balenaBackend) createTeamMembershipCreds(ctx context.Context, req *logical.Request, role *balenaRoleEntry, ttl time.Duration) (*logical.Response, error) {
+	username, resp, err := b.entityBalenaUsername(req, role)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	if ttl <= 0 {
+		ttl = b.System().DefaultLeaseTTL()
+	}
+
+	client, err := b.getClient(ctx, req.Storage, role.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	teamID, err := getTeamID(ctx, client, role.Organization, role.Team)
+	if err != nil {
+		return nil, err
+	}
+
+	if teamID == 0 {
+		return logical.ErrorResponse("team %q not found in organization %q", role.Team, role.Organization), nil
+	}
+
+	userID, err := getUserID(ctx, client, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if userID == 0 {
+		return logical.ErrorResponse("balena user %q not found", username), nil
+	}
+
+	b.teamLock.Lock()
+	defer b.teamLock.Unlock()
+
+	grants, err := listTeamGrants(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	membershipID, err := getTeamMembership(ctx, client, userID, teamID)
+	if err != nil {
+		return nil, err
+	}
+
+	if membershipID != 0 && !teamGrantActive(grants, userID, teamID, "") {
+		return logical.ErrorResponse("balena user %q is already a member of team %q outside of Vault", username, role.Team), nil
+	}
+
+	if membershipID == 0 {
+		if _, err := createTeamMembership(ctx, client, userID, teamID); err != nil {
+			return nil, err
+		}
+	}
+
+	grant := &balenaTeamGrant{
+		ID:        uuid.New().String(),
+		Role:      role.Name,
+		Username:  username,
+		UserID:    userID,
+		TeamID:    teamID,
+		Team:      role.Organization + "/" + role.Team,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := putTeamGrant(ctx, req.Storage, grant); err != nil {
+		return nil, err
+	}
+
+	resp = b.Secret(balenaTeamMembershipType).Response(map[string]interface{}{
+		"username": username,
+		"team":     grant.Team,
+	}, map[string]interface{}{
+		"grant_id": grant.ID,
+		"role":     role.Name,
+		"ttl":      ttl,
+		"max_ttl":  role.MaxTTL,
+	})
+
+	resp.Secret.TTL = ttl
+
+	if role.MaxTTL > 0 {
+		resp.Secret.MaxTTL = role.MaxTTL
+	}
+
+	return resp, nil
+}
+
+// teamMembershipRevoke marks the grant revoked and removes the team
+// membership unless another lease still grants it
+func (b *balenaBackend) teamMembershipRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	grantID, ok := req.Secret.InternalData["grant_id"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing grant_id internal data")
+	}
+
+	b.teamLock.Lock()
+	defer b.teamLock.Unlock()
+
+	grant, err := getTeamGrant(ctx, req.Storage, grantID)
+	if err != nil {
+		return nil, err
+	}
+
+	if grant == nil {
+		return nil, nil
+	}
+
+	grant.RevokedAt = time.Now()
+	if err := putTeamGrant(ctx, req.Storage, grant); err != nil {
+		return nil, err
+	}
+
+	grants, err := listTeamGrants(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if teamGrantActive(grants, grant.UserID, grant.TeamID, grant.ID) {
+		return nil, nil
+	}
+
+	if err := b.removeTeamMembership(ctx, req.Storage, grant); err != nil {
+		return nil, fmt.Errorf("error revoking team membership: %w", err)
+	}
+
+	return nil, nil
+}
+
+// teamMembershipRenew extends the lease and moves the grant's expiry with it
+func (b *balenaBackend) teamMembershipRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	resp, err := b.tokenRenew(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	grantID, ok := req.Secret.InternalData["grant_id"].(string)
+	if !ok {
+		return nil, errors.New("secret is missing grant_id internal data")
+	}
+
+	b.teamLock.Lock()
+	defer b.teamLock.Unlock()
+
+	grant, err := getTeamGrant(ctx, req.Storage, grantID)
+	if err != nil {
+		return nil, err
+	}
+
+	if grant == nil {
+		return nil, fmt.Errorf("team grant %q not found", grantID)
+	}
+
+	grant.ExpiresAt = renewedLeaseEnd(req, resp)
+
+	if err := putTeamGrant(ctx, req.Storage, grant); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// reconcileTeamGrants makes team memberships match the recorded grants. A
+// membership removed by hand while a grant is active is added back, and one
+// left behind or re-added after every grant ended is removed again.
+func (b *balenaBackend) reconcileTeamGrants(ctx context.Context, s logical.Storage) error {
+	b.teamLock.Lock()
+	defer b.teamLock.Unlock()
+
+	grants, err := listTeamGrants(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	pairs := map[string]*balenaTeamGrant{}
+	var kept []*balenaTeamGrant
+	for _, grant := range grants {
+		if !grant.RevokedAt.IsZero() && now.Sub(grant.RevokedAt) > teamGrantRetention {
+			if err := s.Delete(ctx, teamGrantStoragePrefix+grant.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// a grant past its expiry was not revoked by Vault, so end it here
+		if grant.RevokedAt.IsZero() && !grant.active(now) {
+			grant.RevokedAt = now
+			if err := putTeamGrant(ctx, s, grant); err != nil {
+				return err
+			}
+		}
+
+		kept = append(kept, grant)
+		key := fmt.Sprintf("%d/%d", grant.UserID, grant.TeamID)
+		if pairs[key] == nil || grant.active(now) {
+			pairs[key] = grant
+		}
+	}
+
+	for _, grant := range pairs {
+		active := teamGrantActive(kept, grant.UserID, grant.TeamID, "")
+		if err := b.reconcileTeamMembership(ctx, s, grant, active); err != nil {
+			b.Logger().Error("error reconciling team membership", "username", grant.Username, "team", grant.Team, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// reconcileTeamMembership adds or removes a user's team membership
+// depending on whether a grant for it is active
+func (b *balenaBackend) reconcileTeamMembership(ctx context.Context, s logical.Storage, grant *balenaTeamGrant, active bool) error {
+	client, err := b.teamGrantClient(ctx, s, grant)
+	if err != nil {
+		return err
+	}
+
+	membershipID, err := getTeamMembership(ctx, client, grant.UserID, grant.TeamID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case active && membershipID == 0:
+		b.Logger().Warn("restoring team membership removed outside of Vault", "username", grant.Username, "team", grant.Team)
+		_, err = createTeamMembership(ctx, client, grant.UserID, grant.TeamID)
+	case !active && membershipID != 0:
+		b.Logger().Warn("removing team membership without an active lease", "username", grant.Username, "team", grant.Team)
+		err = deleteTeamMembership(ctx, client, membershipID)
+	}
+
+	return err
+}
+
+// removeTeamMembership deletes the user's current membership of the team,
+// which may have been re-created by hand since it was granted
+func (b *balenaBackend) removeTeamMembership(ctx context.Context, s logical.Storage, grant *balenaTeamGrant) error {
+	client, err := b.teamGrantClient(ctx, s, grant)
+	if err != nil {
+		return err
+	}
+
+	membershipID, err := getTeamMembership(ctx, client, grant.UserID, grant.TeamID)
+	if err != nil {
+		return err
+	}
+
+	if membershipID == 0 {
+		return nil
+	}
+
+	return deleteTeamMembership(ctx, client, membershipID)
+}
+
+// deleteRevokedTeamGrants forgets the revoked grants of a role that is
+// being deleted, as their memberships can no longer be checked without it
+func (b *balenaBackend) deleteRevokedTeamGrants(ctx context.Context, s logical.Storage, role string) error {
+	b.teamLock.Lock()
+	defer b.teamLock.Unlock()
+
+	grants, err := listTeamGrants(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	for _, grant := range grants {
+		if grant.Role != role || grant.RevokedAt.IsZero() {
+			continue
+		}
+
+		if err := s.Delete(ctx, teamGrantStoragePrefix+grant.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// teamGrantClient returns a client using the API key of the grant's role
+func (b *balenaBackend) teamGrantClient(ctx context.Context, s logical.Storage, grant *balenaTeamGrant) (*balenaClient, error) {
+	role, err := b.getRole(ctx, s, grant.Role)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if role == nil {
+		return nil, fmt.Errorf("error retrieving role: role %q not found", grant.Role)
+	}
+
+	return b.getClient(ctx, s, role.BalenaApiKey)
+}
+
+// teamGrantActive reports whether any grant other than exceptID currently
+// holds a membership of the team for the user
+func teamGrantActive(grants []*balenaTeamGrant, userID int, teamID int, exceptID string) bool {
+	now := time.Now()
+	for _, g := range grants {
+		if g.ID != exceptID && g.UserID == userID && g.TeamID == teamID && g.active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// getTeamGrant returns a recorded team grant, or nil if there is none
+func getTeamGrant(ctx context.Context, s logical.Storage, id string) (*balenaTeamGrant, error) {
+	entry, err := s.Get(ctx, teamGrantStoragePrefix+id)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var grant balenaTeamGrant
+	if err := entry.DecodeJSON(&grant); err != nil {
+		return nil, fmt.Errorf("error reading team grant: %w", err)
+	}
+
+	return &grant, nil
+}
+
+// putTeamGrant records a team grant in storage
+func putTeamGrant(ctx context.Context, s logical.Storage, grant *balenaTeamGrant) error {
+	entry, err := logical.StorageEntryJSON(teamGrantStoragePrefix+grant.ID, grant)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// listTeamGrants returns every recorded team grant
+func listTeamGrants(ctx context.Context, s logical.Storage) ([]*balenaTeamGrant, error) {
+	ids, err := s.List(ctx, teamGrantStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []*balenaTeamGrant
+	for _, id := range ids {
+		grant, err := getTeamGrant(ctx, s, id)
+		if err != nil {
+			return nil, err
+		}
+		if grant != nil {
+			grants = append(grants, grant)
+		}
+	}
+
+	return grants, nil
+}
+
+// getTeamID looks up a team by organization handle and team name,
+// returning 0 when there is no such team
+func getTeamID(ctx context.Context, c *balenaClient, org string, team string) (int, error) {
+	if !orgHandleRegex.MatchString(org) {
+		return 0, fmt.Errorf("invalid organization %q", org)
+	}
+
+	var teams struct {
+		D []struct {
+			ID int `json:"id"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/team?$select=id&$filter=(name%%20eq%%20%s)%%20and%%20(belongs_to__organization/handle%%20eq%%20%s)", odataString(team), odataString(org)), "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Do(req, &teams); err != nil {
+		return 0, fmt.Errorf("error getting balena team: %w", err)
+	}
+
+	if len(teams.D) == 0 {
+		return 0, nil
+	}
+
+	return teams.D[0].ID, nil
+}
+
+// getTeamMembership returns the ID of a user's membership of a team,
+// or 0 when the user is not a member
+func getTeamMembership(ctx context.Context, c *balenaClient, userID int, teamID int) (int, error) {
+	var memberships struct {
+		D []struct {
+			ID int `json:"id"`
+		} `json:"d"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/team_membership?$select=id&$filter=(user%%20eq%%20%d)%%20and%%20(is_member_of__team%%20eq%%20%d)", userID, teamID), "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Do(req, &memberships); err != nil {
+		return 0, fmt.Errorf("error getting balena team membership: %w", err)
+	}
+
+	if len(memberships.D) == 0 {
+		return 0, nil
+	}
+
+	return memberships.D[0].ID, nil
+}
+
+// createTeamMembership calls the balena client to add a user to a team
+func createTeamMembership(ctx context.Context, c *balenaClient, userID int, teamID int) (int, error) {
+	type balenaBody struct {
+		User           int `json:"user"`
+		IsMemberOfTeam int `json:"is_member_of__team"`
+	}
+
+	req, err := c.NewRequest(ctx, "POST", "v6/team_membership", "", balenaBody{
+		User:           userID,
+		IsMemberOfTeam: teamID,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var membership struct {
+		ID int `json:"id"`
+	}
+	if err := c.Do(req, &membership); err != nil {
+		return 0, fmt.Errorf("error creating balena team membership: %w", err)
+	}
+
+	return membership.ID, nil
+}
+
+// deleteTeamMembership calls the balena client to remove a team membership
+func deleteTeamMembership(ctx context.Context, c *balenaClient, membershipID int) error {
+	req, err := c.NewRequest(ctx, "DELETE", fmt.Sprintf("v6/team_membership(%d)", membershipID), "", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Do(req, nil); err != nil {
+		return fmt.Errorf("error deleting balena team membership: %w", err)
+	}
+
+	return nil
+}
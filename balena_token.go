@@ -11,7 +11,8 @@ import (
 )
 
 const (
-	balenaTokenType = "balena_token"
+	balenaTokenType  = "balena_token"
+	balenaTimeFormat = "2006-01-02T15:04:05.000Z"
 )
 
 // balenaToken defines a secret for the balena token
@@ -19,6 +20,7 @@ type balenaToken struct {
 	TokenID string `json:"token_id"`
 	Token   string `json:"token"`
 	KeyName string `json:"key_name"`
+	KeyID   int    `json:"key_id,omitempty"`
 }
 
 // balenaToken defines a secret to store for a given role
@@ -48,15 +50,6 @@ func (b *balenaBackend) tokenRevoke(ctx context.Context, req *logical.Request, d
 		return nil, fmt.Errorf("secret is missing role internal data")
 	}
 
-	// get the role entry
-	role := roleRaw.(string)
-	roleEntry, err := b.getRole(ctx, req.Storage, role)
-
-	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
-	if err != nil {
-		return nil, fmt.Errorf("error getting client: %w", err)
-	}
-
 	tokenName := ""
 	// We passed the token using InternalData from when we first created
 	// the secret. This is because the balena API uses the exact token
@@ -70,12 +63,71 @@ func (b *balenaBackend) tokenRevoke(ctx context.Context, req *logical.Request, d
 		}
 	}
 
+	cached, _ := req.Secret.InternalData["cached"].(bool)
+
+	// get the role entry
+	role := roleRaw.(string)
+	roleEntry, err := b.getRole(ctx, req.Storage, role)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		// deleting a role deletes its cached keys right away
+		if cached {
+			return nil, nil
+		}
+		return nil, b.revokeOrphanedToken(ctx, req, role)
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	// cached tokens are shared, so only drop this lease's reference
+	if cached {
+		if err := b.releaseCachedToken(ctx, req.Storage, roleEntry, tokenName); err != nil {
+			return nil, fmt.Errorf("error releasing cached user token: %w", err)
+		}
+		return nil, nil
+	}
+
+	// another key may have been given the same name since
+	if keyID, _ := internalDataInt(req.Secret.InternalData["key_id"]); keyID > 0 {
+		if err := deleteTokenID(ctx, client, keyID); err != nil {
+			return nil, fmt.Errorf("error revoking user token: %w", err)
+		}
+		return nil, nil
+	}
+
 	if err := deleteToken(ctx, client, tokenName); err != nil {
 		return nil, fmt.Errorf("error revoking user token: %w", err)
 	}
 	return nil, nil
 }
 
+// revokeOrphanedToken deletes the key of a lease whose role no longer
+// exists. Without the role's account key, the lease's own key is used to
+// delete itself by the key ID recorded when it was issued.
+func (b *balenaBackend) revokeOrphanedToken(ctx context.Context, req *logical.Request, role string) error {
+	keyID, _ := internalDataInt(req.Secret.InternalData["key_id"])
+	token, _ := req.Secret.InternalData["token"].(string)
+	if keyID == 0 || token == "" {
+		return fmt.Errorf("error retrieving role: role %q not found", role)
+	}
+
+	client, err := b.getClient(ctx, req.Storage, token)
+	if err != nil {
+		return fmt.Errorf("error getting client: %w", err)
+	}
+
+	if err := deleteTokenID(ctx, client, keyID); err != nil {
+		return fmt.Errorf("error revoking user token: %w", err)
+	}
+	return nil
+}
+
 // tokenRenew calls the client to create a new token and stores it in the Vault storage API
 func (b *balenaBackend) tokenRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	ttlRaw, ok := req.Secret.InternalData["ttl"]
@@ -103,6 +155,22 @@ func (b *balenaBackend) tokenRenew(ctx context.Context, req *logical.Request, d
 	return resp, nil
 }
 
+// renewedLeaseEnd returns when a lease renewed with resp ends, capped
+// at the lease's max TTL
+func renewedLeaseEnd(req *logical.Request, resp *logical.Response) time.Time {
+	end := time.Now().Add(resp.Secret.TTL)
+	if resp.Secret.MaxTTL > 0 && end.After(req.Secret.IssueTime.Add(resp.Secret.MaxTTL)) {
+		end = req.Secret.IssueTime.Add(resp.Secret.MaxTTL)
+	}
+	return end
+}
+
+// balenaExpiryDate returns the expiry date to give a balena key that backs
+// a lease of the given ttl, with some slack so the key outlives the lease
+func balenaExpiryDate(ttl time.Duration) string {
+	return time.Now().Add(ttl).Add(3 * time.Hour).UTC().Format(balenaTimeFormat)
+}
+
 // createToken calls the balena client to sign in and returns a new token
 func createToken(ctx context.Context, c *balenaClient, balenaName string, balenaDesc string, ttl time.Duration) (*balenaToken, error) {
 
@@ -118,12 +186,12 @@ func createToken(ctx context.Context, c *balenaClient, balenaName string, balena
 		balenaName = tokenID
 	}
 
-	balenaExpiry := time.Now().Add(ttl).Add(3 * time.Hour)
-
+	// the key is created under its unique token ID first, so that its
+	// balena ID can be told apart from other keys with the requested name
 	body := balenaBody{
-		Name:        balenaName,
+		Name:        tokenID,
 		Description: balenaDesc,
-		Expiry_date: balenaExpiry.UTC().Format("2006-01-02T15:04:05.000Z"),
+		Expiry_date: balenaExpiryDate(ttl),
 	}
 
 	req, err := c.NewRequest(ctx, "POST", "api-key/user/full", "", body)
@@ -134,15 +202,58 @@ func createToken(ctx context.Context, c *balenaClient, balenaName string, balena
 		return nil, fmt.Errorf("error creating balena token: %w", err)
 	}
 
+	if balenaName == tokenID {
+		// the ID lets the key be deleted even once its role is gone; it
+		// is only looked up on a best effort basis, as the key is usable
+		// under its name already
+		keyID, _ := lookupToken(ctx, c, tokenID)
+		return &balenaToken{
+			TokenID: tokenID,
+			Token:   token,
+			KeyName: balenaName,
+			KeyID:   keyID,
+		}, nil
+	}
+
+	keyID, err := identifyToken(ctx, c, tokenID, balenaName, balenaDesc)
+	if err != nil {
+		return nil, err
+	}
+
 	return &balenaToken{
 		TokenID: tokenID,
 		Token:   token,
 		KeyName: balenaName,
+		KeyID:   keyID,
 	}, nil
 }
 
-// deleteToken calls the balena client to sign out and revoke the token
-func deleteToken(ctx context.Context, c *balenaClient, tokenName string) error {
+// identifyToken returns the balena ID of a key just created under its
+// unique token ID and gives it balenaName. The key is deleted again when it
+// can't be found or renamed.
+func identifyToken(ctx context.Context, c *balenaClient, tokenID string, balenaName string, balenaDesc string) (int, error) {
+	keyID, err := lookupToken(ctx, c, tokenID)
+	if err == nil && keyID == 0 {
+		err = fmt.Errorf("balena token %q not found", tokenID)
+	}
+
+	if err == nil && balenaName != tokenID {
+		err = renameTokenID(ctx, c, keyID, balenaName, balenaDesc)
+	}
+
+	if err != nil {
+		if delErr := deleteToken(ctx, c, tokenID); delErr != nil {
+			return 0, fmt.Errorf("error naming balena token: %w (and deleting it: %s)", err, delErr)
+		}
+		return 0, fmt.Errorf("error naming balena token: %w", err)
+	}
+
+	return keyID, nil
+}
+
+// lookupToken returns the balena ID of the key with the given name, or 0
+// when the account has no such key
+func lookupToken(ctx context.Context, c *balenaClient, tokenName string) (int, error) {
 	type ApiKey struct {
 		D []struct {
 			ID          int       `json:"id"`
@@ -155,16 +266,33 @@ func deleteToken(ctx context.Context, c *balenaClient, tokenName string) error {
 
 	var key ApiKey
 
-	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/api_key?$select=id,created_at,name,description,expiry_date&$filter=(name%%20eq%%20%%27%s%%27)&$orderby=created_at%%20asc&$skip=0", tokenName), "", nil)
+	req, err := c.NewRequest(ctx, "GET", fmt.Sprintf("v6/api_key?$select=id,created_at,name,description,expiry_date&$filter=(name%%20eq%%20%s)&$orderby=created_at%%20asc&$skip=0", odataString(tokenName)), "", nil)
+	if err != nil {
+		return 0, err
+	}
 
 	err = c.Do(req, &key)
 
 	if err != nil {
-		return fmt.Errorf("error getting balena token: %w", err)
+		return 0, fmt.Errorf("error getting balena token: %w", err)
+	}
+
+	if len(key.D) == 0 {
+		return 0, nil
+	}
+
+	return key.D[0].ID, nil
+}
+
+// deleteToken calls the balena client to sign out and revoke the token
+func deleteToken(ctx context.Context, c *balenaClient, tokenName string) error {
+	id, err := lookupToken(ctx, c, tokenName)
+	if err != nil {
+		return err
 	}
 
-	if len(key.D) > 0 {
-		req, err = c.NewRequest(ctx, "DELETE", fmt.Sprintf("v6/api_key(%d)", key.D[0].ID), "", nil)
+	if id > 0 {
+		req, _ := c.NewRequest(ctx, "DELETE", fmt.Sprintf("v6/api_key(%d)", id), "", nil)
 
 		var stat string
 		err = c.Do(req, stat)
@@ -177,3 +305,71 @@ func deleteToken(ctx context.Context, c *balenaClient, tokenName string) error {
 	return nil
 
 }
+
+// deleteTokenID deletes the balena key with the given ID
+func deleteTokenID(ctx context.Context, c *balenaClient, id int) error {
+	req, err := c.NewRequest(ctx, "DELETE", fmt.Sprintf("v6/api_key(%d)", id), "", nil)
+	if err != nil {
+		return err
+	}
+
+	return c.Do(req, nil)
+}
+
+// renameToken changes the name and description of an existing balena key
+func renameToken(ctx context.Context, c *balenaClient, tokenName string, balenaName string, balenaDesc string) error {
+	id, err := lookupToken(ctx, c, tokenName)
+	if err != nil {
+		return err
+	}
+
+	if id == 0 {
+		return fmt.Errorf("balena token %q not found", tokenName)
+	}
+
+	return renameTokenID(ctx, c, id, balenaName, balenaDesc)
+}
+
+// renameTokenID changes the name and description of the balena key with
+// the given ID
+func renameTokenID(ctx context.Context, c *balenaClient, id int, balenaName string, balenaDesc string) error {
+	type balenaBody struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+
+	req, err := c.NewRequest(ctx, "PATCH", fmt.Sprintf("v6/api_key(%d)", id), "", balenaBody{
+		Name:        balenaName,
+		Description: balenaDesc,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Do(req, nil)
+}
+
+// setTokenExpiry moves the expiry date of an existing balena key
+func setTokenExpiry(ctx context.Context, c *balenaClient, tokenName string, expiry time.Time) error {
+	type balenaBody struct {
+		ExpiryDate string `json:"expiry_date"`
+	}
+
+	id, err := lookupToken(ctx, c, tokenName)
+	if err != nil {
+		return err
+	}
+
+	if id == 0 {
+		return fmt.Errorf("balena token %q not found", tokenName)
+	}
+
+	req, err := c.NewRequest(ctx, "PATCH", fmt.Sprintf("v6/api_key(%d)", id), "", balenaBody{
+		ExpiryDate: expiry.UTC().Format(balenaTimeFormat),
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Do(req, nil)
+}
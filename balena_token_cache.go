@@ -0,0 +1,243 @@
+package balenakeys
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	tokenCacheStoragePrefix     = "token-cache/"
+	defaultCacheRefreshFraction = 0.5
+)
+
+// balenaCachedToken is a balena key shared by every lease handed
+// out for a role while the role has cache_credentials set.
+type balenaCachedToken struct {
+	Token     string    `json:"token"`
+	TokenID   string    `json:"token_id"`
+	KeyName   string    `json:"key_name"`
+	KeyDesc   string    `json:"key_desc"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Leases    int       `json:"leases"`
+	Retired   bool      `json:"retired"`
+}
+
+// refreshDue reports whether the key has used up the given fraction
+// of its lifetime and should no longer be handed out.
+func (t *balenaCachedToken) refreshDue(now time.Time, fraction float64) bool {
+	lifetime := t.ExpiresAt.Sub(t.CreatedAt)
+	return now.Sub(t.CreatedAt) >= time.Duration(float64(lifetime)*fraction)
+}
+
+// cachedTokenPath returns the storage path of a cached key
+func cachedTokenPath(role string, keyName string) string {
+	return tokenCacheStoragePrefix + role + "/" + keyName
+}
+
+// checkoutCachedToken returns the cached key for the role, creating a new
+// one when there is none or the current one is due for refresh. The key's
+// lease count is incremented before it is returned.
+func (b *balenaBackend) checkoutCachedToken(ctx context.Context, s logical.Storage, role *balenaRoleEntry, balenaDesc string) (*balenaCachedToken, error) {
+	b.cacheLock.Lock()
+	defer b.cacheLock.Unlock()
+
+	now := time.Now()
+
+	cached, err := b.currentCachedToken(ctx, s, role.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached != nil && cached.refreshDue(now, role.CacheRefreshFraction) {
+		if err := b.retireCachedToken(ctx, s, role, cached); err != nil {
+			return nil, err
+		}
+		cached = nil
+	}
+
+	if cached == nil {
+		lifetime := role.MaxTTL
+		if lifetime <= 0 {
+			lifetime = b.System().MaxLeaseTTL()
+		}
+
+		token, err := b.createToken(ctx, s, role, "", balenaDesc, lifetime)
+		if err != nil {
+			return nil, err
+		}
+
+		cached = &balenaCachedToken{
+			Token:     token.Token,
+			TokenID:   token.TokenID,
+			KeyName:   token.KeyName,
+			KeyDesc:   balenaDesc,
+			CreatedAt: now,
+			ExpiresAt: now.Add(lifetime),
+		}
+	}
+
+	cached.Leases++
+	if err := putCachedToken(ctx, s, role.Name, cached); err != nil {
+		return nil, err
+	}
+
+	return cached, nil
+}
+
+// releaseCachedToken drops one lease from a cached key. The key is deleted
+// from balena once it has been retired and its last lease is gone.
+func (b *balenaBackend) releaseCachedToken(ctx context.Context, s logical.Storage, role *balenaRoleEntry, keyName string) error {
+	b.cacheLock.Lock()
+	defer b.cacheLock.Unlock()
+
+	cached, err := getCachedToken(ctx, s, role.Name, keyName)
+	if err != nil {
+		return err
+	}
+
+	// without a cache entry nobody else can be holding the key
+	if cached == nil {
+		return b.deleteRoleToken(ctx, s, role, keyName)
+	}
+
+	if cached.Leases > 0 {
+		cached.Leases--
+	}
+
+	if cached.Leases > 0 || (!cached.Retired && time.Now().Before(cached.ExpiresAt)) {
+		return putCachedToken(ctx, s, role.Name, cached)
+	}
+
+	if err := b.deleteRoleToken(ctx, s, role, keyName); err != nil {
+		return err
+	}
+	return s.Delete(ctx, cachedTokenPath(role.Name, keyName))
+}
+
+// retireCachedTokens stops every cached key of the role from being handed
+// out again, for example because the role changed accounts.
+func (b *balenaBackend) retireCachedTokens(ctx context.Context, s logical.Storage, role *balenaRoleEntry) error {
+	b.cacheLock.Lock()
+	defer b.cacheLock.Unlock()
+
+	keys, err := s.List(ctx, tokenCacheStoragePrefix+role.Name+"/")
+	if err != nil {
+		return err
+	}
+
+	for _, keyName := range keys {
+		cached, err := getCachedToken(ctx, s, role.Name, keyName)
+		if err != nil {
+			return err
+		}
+		if cached == nil || cached.Retired {
+			continue
+		}
+		if err := b.retireCachedToken(ctx, s, role, cached); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteCachedTokens deletes every cached key of the role from balena and
+// storage, whether or not leases still refer to it, for a role that is
+// being deleted. The leases are revoked without the role later on.
+func (b *balenaBackend) deleteCachedTokens(ctx context.Context, s logical.Storage, role *balenaRoleEntry) error {
+	b.cacheLock.Lock()
+	defer b.cacheLock.Unlock()
+
+	keys, err := s.List(ctx, tokenCacheStoragePrefix+role.Name+"/")
+	if err != nil {
+		return err
+	}
+
+	for _, keyName := range keys {
+		if err := b.deleteRoleToken(ctx, s, role, keyName); err != nil {
+			return err
+		}
+		if err := s.Delete(ctx, cachedTokenPath(role.Name, keyName)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// retireCachedToken marks a cached key as replaced, deleting it right away
+// when no lease still refers to it. Callers must hold cacheLock.
+func (b *balenaBackend) retireCachedToken(ctx context.Context, s logical.Storage, role *balenaRoleEntry, cached *balenaCachedToken) error {
+	if cached.Leases > 0 {
+		cached.Retired = true
+		return putCachedToken(ctx, s, role.Name, cached)
+	}
+
+	if err := b.deleteRoleToken(ctx, s, role, cached.KeyName); err != nil {
+		return err
+	}
+	return s.Delete(ctx, cachedTokenPath(role.Name, cached.KeyName))
+}
+
+// currentCachedToken returns the cached key of the role that has not been
+// retired yet, if any.
+func (b *balenaBackend) currentCachedToken(ctx context.Context, s logical.Storage, roleName string) (*balenaCachedToken, error) {
+	keys, err := s.List(ctx, tokenCacheStoragePrefix+roleName+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, keyName := range keys {
+		cached, err := getCachedToken(ctx, s, roleName, keyName)
+		if err != nil {
+			return nil, err
+		}
+		if cached != nil && !cached.Retired {
+			return cached, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// deleteRoleToken deletes a balena key using the role's account
+func (b *balenaBackend) deleteRoleToken(ctx context.Context, s logical.Storage, role *balenaRoleEntry, keyName string) error {
+	client, err := b.getClient(ctx, s, role.BalenaApiKey)
+	if err != nil {
+		return fmt.Errorf("error getting client: %w", err)
+	}
+
+	return deleteToken(ctx, client, keyName)
+}
+
+// getCachedToken gets a cached key from the Vault storage API
+func getCachedToken(ctx context.Context, s logical.Storage, roleName string, keyName string) (*balenaCachedToken, error) {
+	entry, err := s.Get(ctx, cachedTokenPath(roleName, keyName))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var cached balenaCachedToken
+	if err := entry.DecodeJSON(&cached); err != nil {
+		return nil, fmt.Errorf("error reading cached token: %w", err)
+	}
+	return &cached, nil
+}
+
+// putCachedToken adds a cached key to the Vault storage API
+func putCachedToken(ctx context.Context, s logical.Storage, roleName string, cached *balenaCachedToken) error {
+	entry, err := logical.StorageEntryJSON(cachedTokenPath(roleName, cached.KeyName), cached)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
@@ -2,6 +2,9 @@ package balenakeys
 
 import (
 	"errors"
+	"fmt"
+	neturl "net/url"
+	"strings"
 
 	"go.einride.tech/balena"
 )
@@ -27,7 +30,58 @@ func newClient(config *balenaConfig, bToken string) (*balenaClient, error) {
 		return nil, errors.New("client URL was not defined")
 	}
 
+	baseURL, err := neturl.Parse(strings.TrimSuffix(config.URL, "/") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid client URL: %w", err)
+	}
+
 	c := balena.New(nil, bToken)
+	c.BaseURL = baseURL
 
 	return &balenaClient{c}, nil
 }
+
+// balenaEndpoints holds the service endpoints of a balena
+// installation that devices need to know about
+type balenaEndpoints struct {
+	API      string
+	Registry string
+	VPN      string
+	Delta    string
+	Devices  string
+}
+
+// endpointsFromURL derives the balena service endpoints from the API URL,
+// following the "api.<domain>" naming used by balenaCloud and openBalena
+func endpointsFromURL(apiURL string) (*balenaEndpoints, error) {
+	u, err := neturl.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client URL: %w", err)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid client URL %q", apiURL)
+	}
+
+	domain := strings.TrimPrefix(u.Hostname(), "api.")
+
+	// balenaCloud serves public device URLs from a separate domain
+	devices := "devices." + domain
+	if domain == "balena-cloud.com" {
+		devices = "balena-devices.com"
+	}
+
+	return &balenaEndpoints{
+		API:      u.Scheme + "://" + u.Host,
+		Registry: "registry2." + domain,
+		VPN:      "vpn." + domain,
+		Delta:    u.Scheme + "://delta." + domain,
+		Devices:  devices,
+	}, nil
+}
+
+// odataString quotes and escapes a value for use in an OData filter
+func odataString(v string) string {
+	quoted := "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	return strings.ReplaceAll(neturl.QueryEscape(quoted), "+", "%20")
+}
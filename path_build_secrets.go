@@ -0,0 +1,282 @@
+package balenakeys
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// toResponseData returns the build secrets definition as the data of a
+// read response
+func (s *balenaBuildSecrets) toResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"kv_mount":   s.KVMount,
+		"kv_version": s.KVVersion,
+		"files":      s.Files,
+	}
+}
+
+// pathBuildSecrets extends the Vault API with endpoints to define and
+// render balena build-time secrets.
+func pathBuildSecrets(b *balenaBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: buildSecretsStoragePrefix + framework.GenericNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the build secrets",
+					Required:    true,
+				},
+				"kv_mount": {
+					Type:        framework.TypeString,
+					Description: "Mount path of the KV secrets engine. Defaults to secret",
+				},
+				"kv_version": {
+					Type:          framework.TypeInt,
+					Description:   "Version of the KV secrets engine, 1 or 2. Defaults to 2",
+					AllowedValues: []interface{}{1, 2},
+				},
+				"files": {
+					Type:        framework.TypeKVPairs,
+					Description: "Secret files, as dest or service/dest, mapped to the KV value to fill them with, as path#key",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathBuildSecretsRead,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathBuildSecretsWrite,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathBuildSecretsWrite,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathBuildSecretsDelete,
+				},
+			},
+			ExistenceCheck:  b.pathBuildSecretsExistenceCheck,
+			HelpSynopsis:    pathBuildSecretsHelpSyn,
+			HelpDescription: pathBuildSecretsHelpDesc,
+		},
+		{
+			Pattern: buildSecretsStoragePrefix + framework.GenericNameRegex("name") + "/archive$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the build secrets",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathBuildSecretsArchiveRead,
+				},
+			},
+			HelpSynopsis:    pathBuildSecretsArchiveHelpSyn,
+			HelpDescription: pathBuildSecretsArchiveHelpDesc,
+		},
+		{
+			Pattern: buildSecretsStoragePrefix + "?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathBuildSecretsList,
+				},
+			},
+			HelpSynopsis:    pathBuildSecretsHelpSyn,
+			HelpDescription: pathBuildSecretsHelpDesc,
+		},
+	}
+}
+
+// pathBuildSecretsExistenceCheck verifies if the build secrets exist.
+func (b *balenaBackend) pathBuildSecretsExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	secrets, err := getBuildSecrets(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, fmt.Errorf("existence check failed: %w", err)
+	}
+
+	return secrets != nil, nil
+}
+
+// pathBuildSecretsRead returns a build secrets definition
+func (b *balenaBackend) pathBuildSecretsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	secrets, err := getBuildSecrets(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if secrets == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{Data: secrets.toResponseData()}, nil
+}
+
+// pathBuildSecretsWrite creates or updates a build secrets definition
+func (b *balenaBackend) pathBuildSecretsWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	secrets, err := getBuildSecrets(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if secrets == nil {
+		secrets = &balenaBuildSecrets{Name: name, KVMount: "secret", KVVersion: 2}
+	}
+
+	if mount, ok := d.GetOk("kv_mount"); ok {
+		secrets.KVMount = strings.Trim(mount.(string), "/")
+	}
+
+	if version, ok := d.GetOk("kv_version"); ok {
+		secrets.KVVersion = version.(int)
+	}
+
+	if files, ok := d.GetOk("files"); ok {
+		secrets.Files = files.(map[string]string)
+	}
+
+	if secrets.KVMount == "" {
+		return logical.ErrorResponse("missing kv_mount"), nil
+	}
+
+	if secrets.KVVersion != 1 && secrets.KVVersion != 2 {
+		return logical.ErrorResponse("kv_version must be 1 or 2"), nil
+	}
+
+	files, err := buildSecretFiles(secrets.Files)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkBuildSecretsAllowed(config, secrets.KVMount, files); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(buildSecretsStoragePrefix+name, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// pathBuildSecretsDelete removes a build secrets definition
+func (b *balenaBackend) pathBuildSecretsDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, buildSecretsStoragePrefix+d.Get("name").(string)); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// pathBuildSecretsArchiveRead renders the build secrets as a base64
+// encoded tar archive to extract into the project before a build
+func (b *balenaBackend) pathBuildSecretsArchiveRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	secrets, err := getBuildSecrets(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if secrets == nil {
+		return logical.ErrorResponse("build secrets %q not found", name), nil
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// checked again, as allowed_kv_paths may have been narrowed since the
+	// definition was written
+	files, err := buildSecretFiles(secrets.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkBuildSecretsAllowed(config, secrets.KVMount, files); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	vault, err := syncVaultClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, files, err := renderBuildSecrets(ctx, vault, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, buildSecretsDir+f.Source)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"archive": base64.StdEncoding.EncodeToString(archive),
+			"files":   paths,
+		},
+	}, nil
+}
+
+// pathBuildSecretsList lists the build secrets definitions
+func (b *balenaBackend) pathBuildSecretsList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, buildSecretsStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(names), nil
+}
+
+const (
+	pathBuildSecretsHelpSyn  = `Define balena build-time secrets rendered from Vault KV secrets.`
+	pathBuildSecretsHelpDesc = `
+A build secrets definition maps the secret files of balena's build-time
+secrets feature to values of KV secrets in the "kv_mount" KV secrets
+engine. Each entry of "files" is a file name, available to every
+service's build, or "service/name" for one service only, mapped to the
+KV value to fill it with as "path#key".
+
+The KV secrets are read through the Vault API using the "vault_addr" and
+"vault_token" set in the config, not the caller's token, and every "path"
+must match the config's "allowed_kv_paths". Access to the archive of a
+definition is as strong as that token within those paths, so policies on
+this path should be granted as carefully as read access to the secrets.
+`
+	pathBuildSecretsArchiveHelpSyn  = `Render balena build-time secrets as a tar archive.`
+	pathBuildSecretsArchiveHelpDesc = `
+Returns a base64 encoded tar archive holding the secret files under
+.balena/secrets/ and .balena/build-secrets.yml, the "build-secrets"
+section of balena.yml mapping them to the builds, together with the list
+of the secret files.
+
+Extract the archive in the project root right before "balena push" or
+"balena deploy", and merge .balena/build-secrets.yml into the project's
+.balena/balena.yml, creating it if there is none. The section comes as a
+file of its own so that the project's other balena.yml settings are
+kept. yq can merge it:
+
+    yq -i '. *= load(".balena/build-secrets.yml")' .balena/balena.yml
+`
+)
@@ -0,0 +1,133 @@
+package balenakeys
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBuildSecrets renders KV secrets from a fake Vault as a build
+// secrets archive and checks its files and balena.yml section.
+func TestBuildSecrets(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/secret/data/ci/registry", r.URL.Path)
+		testJSON(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data": map[string]interface{}{
+					"npmrc": "//npm.example.com/:_authToken=abc",
+					"token": "pypi-token",
+				},
+			},
+		})(w, r)
+	}))
+	t.Cleanup(vault.Close)
+
+	b, s := getTestBackend(t)
+	require.NoError(t, testConfigCreate(t, b, s, map[string]interface{}{
+		"url":         url,
+		"vault_addr":  vault.URL,
+		"vault_token": "s.buildtoken",
+	}))
+
+	t.Run("Invalid File", func(t *testing.T) {
+		resp, err := testBuildSecretsRequest(t, b, s, logical.CreateOperation, "", map[string]interface{}{
+			"files": map[string]interface{}{"../npmrc": "ci/registry#npmrc"},
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Missing Key", func(t *testing.T) {
+		resp, err := testBuildSecretsRequest(t, b, s, logical.CreateOperation, "", map[string]interface{}{
+			"files": map[string]interface{}{"npmrc": "ci/registry"},
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	definition := map[string]interface{}{
+		"files": map[string]interface{}{
+			"npmrc":     "ci/registry#npmrc",
+			"api/token": "ci/registry#token",
+		},
+	}
+
+	t.Run("KV Path Not Allowed", func(t *testing.T) {
+		resp, err := testBuildSecretsRequest(t, b, s, logical.CreateOperation, "", definition)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+		"allowed_kv_paths": "secret/ci/*",
+	}))
+
+	resp, err := testBuildSecretsRequest(t, b, s, logical.CreateOperation, "", definition)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = testBuildSecretsRequest(t, b, s, logical.ReadOperation, "/archive", nil)
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, []string{".balena/secrets/api-token", ".balena/secrets/npmrc"}, resp.Data["files"])
+
+	archive, err := base64.StdEncoding.DecodeString(resp.Data["archive"].(string))
+	require.NoError(t, err)
+
+	files := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(content)
+	}
+
+	require.Equal(t, map[string]string{
+		".balena/secrets/npmrc":     "//npm.example.com/:_authToken=abc",
+		".balena/secrets/api-token": "pypi-token",
+		".balena/build-secrets.yml": `build-secrets:
+  global:
+    - source: npmrc
+      dest: npmrc
+  services:
+    api:
+      - source: api-token
+        dest: token
+`,
+	}, files)
+
+	t.Run("Allowed KV Paths Narrowed", func(t *testing.T) {
+		require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+			"allowed_kv_paths": "secret/other/*",
+		}))
+
+		resp, err := testBuildSecretsRequest(t, b, s, logical.ReadOperation, "/archive", nil)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+// Utility function to make a request to the ci build secrets
+func testBuildSecretsRequest(t *testing.T, b *balenaBackend, s logical.Storage, op logical.Operation, suffix string, data map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      buildSecretsStoragePrefix + "ci" + suffix,
+		Data:      data,
+		Storage:   s,
+	})
+}
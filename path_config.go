@@ -17,6 +17,19 @@ const (
 // required to instantiate a new balena client.
 type balenaConfig struct {
 	URL string `json:"url"`
+
+	// IssuancePaused stops every role from issuing new credentials
+	// while renewal and revocation keep working.
+	IssuancePaused bool `json:"issuance_paused"`
+
+	// VaultAddr and VaultToken are used to read the KV secrets synced
+	// into balena, as a plugin cannot read other mounts directly.
+	VaultAddr  string `json:"vault_addr"`
+	VaultToken string `json:"vault_token"`
+
+	// AllowedKVPaths limits the KV secrets syncs and build secrets may
+	// read with VaultToken, as "mount/path" entries that may use globs
+	AllowedKVPaths []string `json:"allowed_kv_paths"`
 }
 
 // pathConfig extends the Vault API with a `/config`
@@ -38,6 +51,25 @@ func pathConfig(b *balenaBackend) *framework.Path {
 					Sensitive: false,
 				},
 			},
+			"issuance_paused": {
+				Type:        framework.TypeBool,
+				Description: "Refuse to issue new credentials from any role. Renewal and revocation keep working",
+			},
+			"vault_addr": {
+				Type:        framework.TypeString,
+				Description: "Address of the Vault API to read synced KV secrets from",
+			},
+			"vault_token": {
+				Type:        framework.TypeString,
+				Description: "Vault token allowed to read the synced KV secrets",
+				DisplayAttrs: &framework.DisplayAttributes{
+					Sensitive: true,
+				},
+			},
+			"allowed_kv_paths": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "KV secrets, as mount/path and optionally ending in *, that syncs and build secrets may read with vault_token",
+			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
@@ -78,7 +110,10 @@ func (b *balenaBackend) pathConfigRead(ctx context.Context, req *logical.Request
 
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"url": config.URL,
+			"url":              config.URL,
+			"issuance_paused":  config.IssuancePaused,
+			"vault_addr":       config.VaultAddr,
+			"allowed_kv_paths": config.AllowedKVPaths,
 		},
 	}, nil
 }
@@ -98,9 +133,27 @@ func (b *balenaBackend) pathConfigWrite(ctx context.Context, req *logical.Reques
 	}
 
 	// username := data.Get("username").(string)
-	url := data.Get("url").(string)
+	if url, ok := data.GetOk("url"); ok {
+		config.URL = url.(string)
+	} else if req.Operation == logical.CreateOperation {
+		return logical.ErrorResponse("missing url in configuration"), nil
+	}
+
+	if paused, ok := data.GetOk("issuance_paused"); ok {
+		config.IssuancePaused = paused.(bool)
+	}
+
+	if addr, ok := data.GetOk("vault_addr"); ok {
+		config.VaultAddr = addr.(string)
+	}
 
-	config.URL = url
+	if token, ok := data.GetOk("vault_token"); ok {
+		config.VaultToken = token.(string)
+	}
+
+	if paths, ok := data.GetOk("allowed_kv_paths"); ok {
+		config.AllowedKVPaths = paths.([]string)
+	}
 
 	entry, err := logical.StorageEntryJSON(configStoragePath, config)
 	if err != nil {
@@ -158,4 +211,15 @@ JWTs issued to users working with the products API.
 You must sign up with a username and password and
 specify the balena address for the products API
 before using this secrets backend.
+
+Setting "issuance_paused" stops every role from issuing new
+credentials, for example during incident response. Existing
+leases can still be renewed and revoked.
+
+"vault_addr" and "vault_token" are needed to sync KV secrets into
+balena environment variables. The token is never returned on read, and
+is renewed by the periodic function while it is renewable. Syncs and
+build secrets can only read the KV secrets matching "allowed_kv_paths",
+such as "secret/ci/*". Anyone who can write a sync or build secrets
+definition can read those secrets through it, so keep the list narrow.
 `
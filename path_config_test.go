@@ -3,6 +3,7 @@ package balenakeys
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/hashicorp/vault/sdk/logical"
@@ -28,7 +29,10 @@ func TestConfig(t *testing.T) {
 		assert.NoError(t, err)
 
 		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
-			"url": url,
+			"url":              url,
+			"issuance_paused":  false,
+			"vault_addr":       "",
+			"allowed_kv_paths": []string(nil),
 		})
 
 		assert.NoError(t, err)
@@ -41,7 +45,28 @@ func TestConfig(t *testing.T) {
 		assert.NoError(t, err)
 
 		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
-			"url": url,
+			"url":              url,
+			"issuance_paused":  false,
+			"vault_addr":       "",
+			"allowed_kv_paths": []string(nil),
+		})
+
+		assert.NoError(t, err)
+
+		err = testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+			"issuance_paused":  true,
+			"vault_addr":       "https://vault.example.com:8200",
+			"vault_token":      "s.synctoken",
+			"allowed_kv_paths": "secret/ci/*,secret/myapp",
+		})
+
+		assert.NoError(t, err)
+
+		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
+			"url":              url,
+			"issuance_paused":  true,
+			"vault_addr":       "https://vault.example.com:8200",
+			"allowed_kv_paths": []string{"secret/ci/*", "secret/myapp"},
 		})
 
 		assert.NoError(t, err)
@@ -133,7 +158,7 @@ func testConfigRead(t *testing.T, b logical.Backend, s logical.Storage, expected
 
 		if !ok {
 			return fmt.Errorf(`expected data["%s"] = %v but was not included in read output"`, k, expectedV)
-		} else if expectedV != actualV {
+		} else if !reflect.DeepEqual(expectedV, actualV) {
 			return fmt.Errorf(`expected data["%s"] = %v, instead got %v"`, k, expectedV, actualV)
 		}
 	}
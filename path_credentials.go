@@ -10,13 +10,17 @@ import (
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+const (
+	defaultKeyDesc = "Vault Managed Balena Token"
+)
+
 // pathCredentials extends the Vault API with a `/creds`
 // endpoint for a role. You can choose whether
 // or not certain attributes should be displayed,
 // required, and named.
 func pathCredentials(b *balenaBackend) *framework.Path {
 	return &framework.Path{
-		Pattern: "creds/" + framework.GenericNameRegex("name"),
+		Pattern: "creds/" + roleNameRegex("name"),
 		Fields: map[string]*framework.FieldSchema{
 			"name": {
 				Type:        framework.TypeLowerCaseString,
@@ -35,6 +39,26 @@ func pathCredentials(b *balenaBackend) *framework.Path {
 				Type:        framework.TypeDurationSecond,
 				Description: "Default lease for generated credentials. If not set or set to 0, will",
 			},
+			"device_uuid": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "UUID of the device to create a key for. Required for device_key roles",
+			},
+			"public_key": {
+				Type:        framework.TypeString,
+				Description: "SSH public key to register for ssh_key roles. If not set, a key pair is generated",
+			},
+			"repositories": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Registry repositories to scope a registry_token to. Defaults to the role's registry_repositories",
+			},
+			"fleet_suffix": {
+				Type:        framework.TypeString,
+				Description: "Value of {{suffix}} in the fleet_name_template of ephemeral_fleet roles, such as a branch name",
+			},
+			"fleets": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Fleets to grant membership of for fleet_access roles. Defaults to the role's allowed_fleets",
+			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation:   b.pathCredentialsRead,
@@ -58,7 +82,7 @@ func (b *balenaBackend) pathCredentialsRead(ctx context.Context, req *logical.Re
 	}
 
 	if balenaDesc == "" {
-		balenaDesc = "Vault Managed Balena Token"
+		balenaDesc = defaultKeyDesc
 	}
 
 	roleEntry, err := b.getRole(ctx, req.Storage, roleName)
@@ -70,6 +94,10 @@ func (b *balenaBackend) pathCredentialsRead(ctx context.Context, req *logical.Re
 		return nil, errors.New("error retrieving role: role is nil")
 	}
 
+	if resp, err := b.checkIssuance(ctx, req.Storage, roleEntry); resp != nil || err != nil {
+		return resp, err
+	}
+
 	roleTtl := roleEntry.TTL
 	roleMaxTtl := roleEntry.MaxTTL
 
@@ -81,6 +109,27 @@ func (b *balenaBackend) pathCredentialsRead(ctx context.Context, req *logical.Re
 		ttl = roleMaxTtl
 	}
 
+	switch roleEntry.CredentialType {
+	case deviceKeyCredentialType:
+		return b.createDeviceKeyCreds(ctx, req, roleEntry, d.Get("device_uuid").(string), balenaName, balenaDesc, ttl)
+	case provisioningKeyCredentialType:
+		return b.createProvisioningKeyCreds(ctx, req, roleEntry, balenaName, balenaDesc, ttl)
+	case sshKeyCredentialType:
+		return b.createSSHKeyCreds(ctx, req, roleEntry, d.Get("public_key").(string), balenaName, ttl)
+	case registryCredentialType:
+		return b.createRegistryCreds(ctx, req, roleEntry, d.Get("repositories").([]string), ttl)
+	case fleetAccessCredentialType:
+		return b.createFleetMembershipCreds(ctx, req, roleEntry, d.Get("fleets").([]string), ttl)
+	case teamAccessCredentialType:
+		return b.createTeamMembershipCreds(ctx, req, roleEntry, ttl)
+	case openBalenaUserCredentialType:
+		return b.createOpenBalenaUserCreds(ctx, req, roleEntry, ttl)
+	case ephemeralDeviceCredentialType:
+		return b.createEphemeralDeviceCreds(ctx, req, roleEntry, ttl)
+	case ephemeralFleetCredentialType:
+		return b.createEphemeralFleetCreds(ctx, req, roleEntry, d.Get("fleet_suffix").(string), ttl)
+	}
+
 	if roleEntry.Name != "" {
 		return b.createUserCreds(ctx, req, roleEntry, balenaName, balenaDesc, ttl)
 	}
@@ -99,12 +148,47 @@ func (b *balenaBackend) pathCredentialsRead(ctx context.Context, req *logical.Re
 	return resp, nil
 }
 
+// checkIssuance returns an error response when the role is disabled or
+// issuance is paused for the whole mount
+func (b *balenaBackend) checkIssuance(ctx context.Context, s logical.Storage, role *balenaRoleEntry) (*logical.Response, error) {
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if config != nil && config.IssuancePaused {
+		return logical.ErrorResponse("credential issuance is paused for this mount"), nil
+	}
+
+	if role.Disabled {
+		return logical.ErrorResponse("role %q is disabled", role.Name), nil
+	}
+
+	return nil, nil
+}
+
 // createUserCreds creates a new balena token to store into the Vault backend, generates
 // a response with the secrets information, and checks the TTL and MaxTTL attributes.
 func (b *balenaBackend) createUserCreds(ctx context.Context, req *logical.Request, role *balenaRoleEntry, balenaName string, balenaDesc string, ttl time.Duration) (*logical.Response, error) {
-	token, err := b.createToken(ctx, req.Storage, role, balenaName, balenaDesc, ttl)
-	if err != nil {
-		return nil, err
+	if role.CacheCredentials {
+		return b.createCachedUserCreds(ctx, req, role, balenaDesc, ttl)
+	}
+
+	var token *balenaToken
+	var err error
+	if role.PoolSize > 0 {
+		token, err = b.checkoutPooledToken(ctx, req.Storage, role, balenaName, balenaDesc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// an empty pool falls back to creating the key on demand
+	if token == nil {
+		token, err = b.createToken(ctx, req.Storage, role, balenaName, balenaDesc, ttl)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// The response is divided into two objects (1) internal data and (2) data.
@@ -118,6 +202,8 @@ func (b *balenaBackend) createUserCreds(ctx context.Context, req *logical.Reques
 	}, map[string]interface{}{
 		"token_id": token.TokenID,
 		"key_name": token.KeyName,
+		"key_id":   token.KeyID,
+		"token":    token.Token,
 		"role":     role.Name,
 		"key_desc": balenaDesc,
 		"ttl":      ttl,
@@ -135,6 +221,40 @@ func (b *balenaBackend) createUserCreds(ctx context.Context, req *logical.Reques
 	return resp, nil
 }
 
+// createCachedUserCreds hands out the role's cached balena token under a new
+// lease. The lease can never outlive the cached key.
+func (b *balenaBackend) createCachedUserCreds(ctx context.Context, req *logical.Request, role *balenaRoleEntry, balenaDesc string, ttl time.Duration) (*logical.Response, error) {
+	cached, err := b.checkoutCachedToken(ctx, req.Storage, role, balenaDesc)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := time.Until(cached.ExpiresAt)
+	if ttl <= 0 || ttl > remaining {
+		ttl = remaining
+	}
+
+	resp := b.Secret(balenaTokenType).Response(map[string]interface{}{
+		"token":    cached.Token,
+		"token_id": cached.TokenID,
+		"key_name": cached.KeyName,
+		"key_desc": cached.KeyDesc,
+	}, map[string]interface{}{
+		"token_id": cached.TokenID,
+		"key_name": cached.KeyName,
+		"role":     role.Name,
+		"key_desc": cached.KeyDesc,
+		"cached":   true,
+		"ttl":      ttl,
+		"max_ttl":  remaining,
+	})
+
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = remaining
+
+	return resp, nil
+}
+
 // createToken uses the balena client to sign in and get a new token
 func (b *balenaBackend) createToken(ctx context.Context, s logical.Storage, roleEntry *balenaRoleEntry, balenaName string, balenaDesc string, ttl time.Duration) (*balenaToken, error) {
 	if roleEntry.BalenaApiKey == "" {
@@ -166,6 +286,25 @@ Generate a balena API token from a specific Vault role.
 
 const pathCredentialsHelpDesc = `
 This path generates a balena API user tokens
-based on a particular role. A role can only represent a user token,
-since balena doesn't have other types of tokens.
+based on a particular role. A "user_key" role creates a full user
+token, a "device_key" role creates a token for the device given
+as "device_uuid", and a "provisioning_key" role creates a provisioning
+key for the role's fleet that expires with the lease. An "ssh_key" role
+registers "public_key" on the role's balena user, or generates an ed25519
+key pair and returns the private key, and removes the key on revocation.
+A "registry_token" role returns a container registry token for
+"repositories" together with a docker config.json that uses it.
+A "fleet_access" role grants the requesting entity's balena user a
+membership of "fleets" that is removed when the lease is revoked, and a
+"team_access" role adds that user to the role's organization team. An
+"openbalena_user" role creates a temporary openBalena user and returns its
+username, password and a session token. An "ephemeral_device" role
+registers a device in the role's fleet and returns its UUID and device API
+key until the lease ends. An "ephemeral_fleet" role creates a fleet named
+with "fleet_suffix" and returns it with a provisioning key that only
+reaches the new fleet, until the lease ends. No user API key is issued, as
+balena's user keys reach every fleet of the account.
+
+Roles with "cache_credentials" set return a shared key from a cache
+instead of creating a new one, and ignore "balenaName".
 `
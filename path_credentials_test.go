@@ -2,13 +2,19 @@ package balenakeys
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 // newAcceptanceTestEnv creates a test environment for credentials
@@ -56,3 +62,955 @@ func TestAcceptanceUserToken(t *testing.T) {
 	t.Run("read user token cred", acceptanceTestEnv.ReadUserToken)
 	// t.Run("cleanup user tokens", acceptanceTestEnv.CleanupUserTokens)
 }
+
+// TestCredentialsIssuanceBlocked checks that disabled roles and a
+// paused mount refuse to issue credentials.
+func TestCredentialsIssuanceBlocked(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	err := testConfigCreate(t, b, s, map[string]interface{}{
+		"url": url,
+	})
+	require.NoError(t, err)
+
+	resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"balenaApiKey": "test-key",
+		"disabled":     true,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	t.Run("Disabled Role", func(t *testing.T) {
+		resp, err := testCredsRead(t, b, s, roleName)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "disabled")
+	})
+
+	t.Run("Paused Mount", func(t *testing.T) {
+		err := testConfigUpdate(t, b, s, map[string]interface{}{
+			"issuance_paused": true,
+		})
+		require.NoError(t, err)
+
+		resp, err := testCredsRead(t, b, s, roleName)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "paused")
+	})
+}
+
+// Utility function to read credentials for a role and return any errors
+func testCredsRead(t *testing.T, b *balenaBackend, s logical.Storage, name string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + name,
+		Storage:   s,
+	})
+}
+
+// TestDeviceKeyCredentials checks the checks a device_key role
+// makes before it calls balena.
+func TestDeviceKeyCredentials(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"balenaApiKey":         "test-key",
+		"credential_type":      deviceKeyCredentialType,
+		"allowed_device_uuids": "0123456789abcdef0123456789abcdef",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	t.Run("Missing Device UUID", func(t *testing.T) {
+		resp, err := testCredsRead(t, b, s, roleName)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Device Not Allowed", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/" + roleName,
+			Data:      map[string]interface{}{"device_uuid": "fedcba9876543210fedcba9876543210"},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "not allowed")
+	})
+
+	t.Run("Cache Not Supported", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"balenaApiKey":      "test-key",
+			"cache_credentials": true,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+// TestDeviceKeyRevoke issues a device key against a fake balena API and
+// revokes it by the key ID recorded at issue.
+func TestDeviceKeyRevoke(t *testing.T) {
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/device": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{
+				"id":                      1001,
+				"uuid":                    "0123456789abcdef0123456789abcdef",
+				"belongs_to__application": []map[string]interface{}{{"id": 42, "slug": "myorg/myfleet"}},
+			}},
+		}),
+		"POST api-key/device/1001/device-key": testJSON("device-key"),
+		"GET v6/api_key": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{"id": 66}},
+		}),
+		"PATCH v6/api_key(66)":  testJSON(nil),
+		"DELETE v6/api_key(66)": testJSON(nil),
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":    "test-key",
+		"credential_type": deviceKeyCredentialType,
+	})
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "creds/" + roleName,
+		Data: map[string]interface{}{
+			"device_uuid": "0123456789abcdef0123456789abcdef",
+			"balenaName":  "gateway",
+		},
+		Storage: s,
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, balenaDeviceKeyType, resp.Secret.InternalData["secret_type"])
+	require.Equal(t, 66, resp.Secret.InternalData["key_id"])
+	require.True(t, srv.called("PATCH v6/api_key(66)"))
+
+	t.Run("Role Delete Refused", func(t *testing.T) {
+		resp, err := testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+	require.True(t, srv.called("DELETE v6/api_key(66)"))
+
+	resp, err = testTokenRoleDelete(t, b, s)
+	require.NoError(t, err)
+	require.Nil(t, resp)
+}
+
+// TestSSHKeyCredentials registers generated and supplied SSH keys
+// against a fake balena API and revokes them again.
+func TestSSHKeyCredentials(t *testing.T) {
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET user/v1/whoami": testJSON(map[string]interface{}{"id": 7}),
+		"POST v6/user__has__public_key": func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			require.EqualValues(t, 7, body["user"])
+			require.Contains(t, body["public_key"], "ssh-ed25519 ")
+
+			testJSON(map[string]interface{}{"id": 55})(w, r)
+		},
+		"DELETE v6/user__has__public_key(55)": testJSON(nil),
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":    "test-key",
+		"credential_type": sshKeyCredentialType,
+	})
+
+	t.Run("Generated Key", func(t *testing.T) {
+		resp, err := testCredsRead(t, b, s, roleName)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, 55, resp.Data["key_id"])
+
+		signer, err := ssh.ParsePrivateKey([]byte(resp.Data["private_key"].(string)))
+		require.NoError(t, err)
+		require.Equal(t, resp.Data["public_key"], strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))))
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    resp.Secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.True(t, srv.called("DELETE v6/user__has__public_key(55)"))
+	})
+
+	t.Run("Supplied Key", func(t *testing.T) {
+		publicKey, _, err := generateSSHKeyPair("supplied")
+		require.NoError(t, err)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/" + roleName,
+			Data:      map[string]interface{}{"public_key": publicKey},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, publicKey, resp.Data["public_key"])
+		require.NotContains(t, resp.Data, "private_key")
+	})
+
+	t.Run("Invalid Key", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/" + roleName,
+			Data:      map[string]interface{}{"public_key": "not a key"},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Role In Use", func(t *testing.T) {
+		// the supplied key's lease is still outstanding
+		resp, err := testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		role, err := b.getRole(context.Background(), s, roleName)
+		require.NoError(t, err)
+		require.NotNil(t, role)
+
+		refs, err := s.List(context.Background(), roleLeaseStoragePrefix+roleName+"/")
+		require.NoError(t, err)
+		require.Len(t, refs, 1)
+
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret: &logical.Secret{InternalData: map[string]interface{}{
+				"secret_type": balenaSSHKeyType,
+				"role":        roleName,
+				"key_id":      55,
+				"lease_ref":   refs[0],
+			}},
+			Storage: s,
+		})
+		require.NoError(t, err)
+
+		resp, err = testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+}
+
+// TestRegistryCredentials exchanges the role's key for a scoped
+// registry token against a fake balena API.
+func TestRegistryCredentials(t *testing.T) {
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET auth/v1/token": func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, []string{"repository:v2/abc123:pull,push"}, r.URL.Query()["scope"])
+			require.Equal(t, "registry2.127.0.0.1", r.URL.Query().Get("service"))
+
+			testJSON(map[string]interface{}{"token": "registry-token", "expires_in": 3600})(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":          "test-key",
+		"credential_type":       registryCredentialType,
+		"registry_repositories": "v2/*",
+		"registry_push":         true,
+	})
+
+	t.Run("Glob Needs Repositories", func(t *testing.T) {
+		resp, err := testCredsRead(t, b, s, roleName)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Repository Not Allowed", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/" + roleName,
+			Data:      map[string]interface{}{"repositories": "other/abc123"},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Scoped Token", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/" + roleName,
+			Data:      map[string]interface{}{"repositories": "v2/abc123"},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, "registry-token", resp.Data["token"])
+		require.Equal(t, time.Hour, resp.Secret.TTL)
+		require.False(t, resp.Secret.Renewable)
+
+		var dockerConfig struct {
+			Auths map[string]map[string]string `json:"auths"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(resp.Data["docker_config"].(string)), &dockerConfig))
+		require.Equal(t, "registry-token", dockerConfig.Auths["registry2.127.0.0.1"]["registrytoken"])
+	})
+
+	t.Run("Repositories Required", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, "no-repositories", map[string]interface{}{
+			"balenaApiKey":    "test-key",
+			"credential_type": registryCredentialType,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+// TestFleetAccessCredentials grants the requesting entity's balena user
+// fleet memberships against a fake balena API and revokes them again.
+func TestFleetAccessCredentials(t *testing.T) {
+	var mu sync.Mutex
+	membership := 0
+	deleted := 0
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/application": func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.RawQuery, "otherfleet") {
+				testJSON(map[string]interface{}{
+					"d": []map[string]interface{}{{"id": 43, "slug": "myorg/otherfleet"}},
+				})(w, r)
+				return
+			}
+			testJSON(map[string]interface{}{
+				"d": []map[string]interface{}{{"id": 42, "slug": "myorg/myfleet"}},
+			})(w, r)
+		},
+		"GET v6/user":                        testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": 7}}}),
+		"GET v6/application_membership_role": testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": 2}}}),
+		"GET v6/user_application_membership": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			d := []map[string]interface{}{}
+			if membership != 0 {
+				d = append(d, map[string]interface{}{"id": membership})
+			}
+			testJSON(map[string]interface{}{"d": d})(w, r)
+		},
+		"DELETE v6/user_application_membership(99)": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			membership = 0
+			deleted++
+			testJSON(nil)(w, r)
+		},
+		"POST v6/user_application_membership": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			membership = 99
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			require.EqualValues(t, 7, body["user"])
+			require.EqualValues(t, 42, body["is_member_of__application"])
+			require.EqualValues(t, 2, body["application_membership_role"])
+
+			testJSON(map[string]interface{}{"id": 99})(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":    "test-key",
+		"credential_type": fleetAccessCredentialType,
+		"allowed_fleets":  "myorg/myfleet",
+		"membership_role": "operator",
+	})
+
+	b.System().(*logical.StaticSystemView).EntityVal = &logical.Entity{
+		ID:       "entity-id",
+		Metadata: map[string]string{defaultEntityMetadataKey: "support-engineer"},
+	}
+
+	t.Run("Missing Entity", func(t *testing.T) {
+		resp, err := testCredsRead(t, b, s, roleName)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Fleet Not Allowed", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/" + roleName,
+			Data:      map[string]interface{}{"fleets": "myorg/otherfleet"},
+			EntityID:  "entity-id",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Grant And Revoke", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + roleName,
+			EntityID:  "entity-id",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, "support-engineer", resp.Data["username"])
+		require.Equal(t, []string{"myorg/myfleet"}, resp.Data["fleets"])
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    resp.Secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Equal(t, 1, deleted)
+	})
+
+	t.Run("Overlapping Leases", func(t *testing.T) {
+		deleted = 0
+		var leases []*logical.Response
+		for i := 0; i < 2; i++ {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "creds/" + roleName,
+				EntityID:  "entity-id",
+				Storage:   s,
+			})
+			require.NoError(t, err)
+			require.False(t, resp.IsError())
+			require.Equal(t, []string{"myorg/myfleet"}, resp.Data["fleets"])
+			leases = append(leases, resp)
+		}
+
+		for i, lease := range leases {
+			_, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.RevokeOperation,
+				Secret:    lease.Secret,
+				Storage:   s,
+			})
+			require.NoError(t, err)
+			require.Equal(t, i, deleted)
+		}
+	})
+
+	t.Run("Hand Made Membership", func(t *testing.T) {
+		deleted = 0
+		membership = 99
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + roleName,
+			EntityID:  "entity-id",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, []string{"myorg/myfleet"}, resp.Data["already_member"])
+
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    resp.Secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Zero(t, deleted)
+	})
+
+	t.Run("Invalid Membership Role", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, "owner-access", map[string]interface{}{
+			"balenaApiKey":    "test-key",
+			"credential_type": fleetAccessCredentialType,
+			"allowed_fleets":  "myorg/myfleet",
+			"membership_role": "owner",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+// TestTeamAccessCredentials adds the requesting entity's balena user to a
+// team against a fake balena API, and checks that memberships changed by
+// hand are put back to match the lease.
+func TestTeamAccessCredentials(t *testing.T) {
+	var mu sync.Mutex
+	member := false
+	isMember := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return member
+	}
+	setMember := func(v bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		member = v
+	}
+
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/team": func(w http.ResponseWriter, r *http.Request) {
+			require.Contains(t, r.URL.Query().Get("$filter"), "'on call'")
+			testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": 11}}})(w, r)
+		},
+		"GET v6/user": testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": 7}}}),
+		"GET v6/team_membership": func(w http.ResponseWriter, r *http.Request) {
+			memberships := []map[string]interface{}{}
+			if isMember() {
+				memberships = append(memberships, map[string]interface{}{"id": 5})
+			}
+			testJSON(map[string]interface{}{"d": memberships})(w, r)
+		},
+		"POST v6/team_membership": func(w http.ResponseWriter, r *http.Request) {
+			setMember(true)
+			testJSON(map[string]interface{}{"id": 5})(w, r)
+		},
+		"DELETE v6/team_membership(5)": func(w http.ResponseWriter, r *http.Request) {
+			setMember(false)
+			testJSON(nil)(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":    "test-key",
+		"credential_type": teamAccessCredentialType,
+		"organization":    "myorg",
+		"team":            "on call",
+	})
+
+	b.System().(*logical.StaticSystemView).EntityVal = &logical.Entity{
+		ID:       "entity-id",
+		Metadata: map[string]string{defaultEntityMetadataKey: "support-engineer"},
+	}
+
+	readCreds := func() (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + roleName,
+			EntityID:  "entity-id",
+			Storage:   s,
+		})
+	}
+
+	resp, err := readCreds()
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, "myorg/on call", resp.Data["team"])
+	require.True(t, isMember())
+	secret := resp.Secret
+
+	t.Run("Restore Removed Membership", func(t *testing.T) {
+		setMember(false)
+		require.NoError(t, b.reconcileTeamGrants(context.Background(), s))
+		require.True(t, isMember())
+	})
+
+	t.Run("Second Lease Shares Membership", func(t *testing.T) {
+		resp, err := readCreds()
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    resp.Secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.True(t, isMember())
+	})
+
+	t.Run("Role In Use", func(t *testing.T) {
+		resp, err := testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.False(t, isMember())
+	})
+
+	t.Run("Remove Re-added Membership", func(t *testing.T) {
+		setMember(true)
+		require.NoError(t, b.reconcileTeamGrants(context.Background(), s))
+		require.False(t, isMember())
+	})
+
+	t.Run("Existing Member", func(t *testing.T) {
+		setMember(true)
+		resp, err := readCreds()
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Role Delete Forgets Revoked Grants", func(t *testing.T) {
+		resp, err := testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		grants, err := listTeamGrants(context.Background(), s)
+		require.NoError(t, err)
+		require.Empty(t, grants)
+	})
+}
+
+// TestOpenBalenaUserCredentials creates a temporary user against a fake
+// openBalena API and deletes it again on revocation.
+func TestOpenBalenaUserCredentials(t *testing.T) {
+	var username string
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"POST user/register": func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			require.Equal(t, body["username"]+"@example.com", body["email"])
+			require.Len(t, body["password"], 32)
+			username = body["username"]
+
+			testJSON("registration-token")(w, r)
+		},
+		"GET v6/user":                         testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": 8}}}),
+		"GET v6/organization":                 testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": 3}}}),
+		"GET v6/organization_membership_role": testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": 1}}}),
+		"POST v6/organization_membership": func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			require.EqualValues(t, 8, body["user"])
+			require.EqualValues(t, 3, body["is_member_of__organization"])
+
+			testJSON(map[string]interface{}{"id": 20})(w, r)
+		},
+		"POST login_": func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("session-token"))
+		},
+		"DELETE v6/user(8)": testJSON(nil),
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":      "test-key",
+		"credential_type":   openBalenaUserCredentialType,
+		"organizations":     "testorg",
+		"user_email_domain": "example.com",
+	})
+
+	resp, err := testCredsRead(t, b, s, roleName)
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, username, resp.Data["username"])
+	require.Equal(t, "session-token", resp.Data["session_token"])
+	require.True(t, srv.called("POST v6/organization_membership"))
+
+	// the user can only be deleted with the role's key
+	deleteResp, err := testTokenRoleDelete(t, b, s)
+	require.NoError(t, err)
+	require.True(t, deleteResp.IsError())
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+	require.True(t, srv.called("DELETE v6/user(8)"))
+
+	deleteResp, err = testTokenRoleDelete(t, b, s)
+	require.NoError(t, err)
+	require.Nil(t, deleteResp)
+}
+
+// TestEphemeralDeviceCredentials registers a throwaway device against a
+// fake balena API and deletes it again on revocation.
+func TestEphemeralDeviceCredentials(t *testing.T) {
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/application": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{"id": 42, "slug": "myorg/ci"}},
+		}),
+		"GET user/v1/whoami":                       testJSON(map[string]interface{}{"id": 7}),
+		"POST api-key/application/42/provisioning": testJSON("provisioning-key"),
+		"GET v6/api_key":                           testJSON(map[string]interface{}{"d": []interface{}{}}),
+		"POST device/register":                     testJSON(map[string]interface{}{"id": 1001}),
+		"DELETE v6/device(1001)":                   testJSON(nil),
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":    "test-key",
+		"credential_type": ephemeralDeviceCredentialType,
+		"fleet":           "myorg/ci",
+		"device_type":     "generic-amd64",
+	})
+
+	resp, err := testCredsRead(t, b, s, roleName)
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, 1001, resp.Data["device_id"])
+	require.Len(t, resp.Data["uuid"], 32)
+	require.Len(t, resp.Data["device_api_key"], 32)
+
+	leases, err := countRoleLeases(context.Background(), s, roleName)
+	require.NoError(t, err)
+	require.Equal(t, 1, leases)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+	require.True(t, srv.called("DELETE v6/device(1001)"))
+
+	leases, err = countRoleLeases(context.Background(), s, roleName)
+	require.NoError(t, err)
+	require.Zero(t, leases)
+}
+
+// TestEphemeralFleetCredentials creates a fleet from a template against a
+// fake balena API and deletes it again on revocation.
+func TestEphemeralFleetCredentials(t *testing.T) {
+	var copied []string
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/organization": testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": 3}}}),
+		"GET v6/device_type":  testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": 9}}}),
+		"GET v6/application": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{"id": 40, "slug": "myorg/preview-template"}},
+		}),
+		"POST v6/application": func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			require.Equal(t, "preview-feature-x", body["app_name"])
+			require.EqualValues(t, 3, body["organization"])
+			require.EqualValues(t, 9, body["is_for__device_type"])
+
+			testJSON(map[string]interface{}{"id": 50, "slug": "myorg/preview-feature-x"})(w, r)
+		},
+		"GET v6/application_environment_variable": func(w http.ResponseWriter, r *http.Request) {
+			require.Contains(t, r.URL.Query().Get("$filter"), "40")
+			testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": 1, "name": "API_URL", "value": "https://example.com"}}})(w, r)
+		},
+		"POST v6/application_environment_variable": func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			require.EqualValues(t, 50, body["application"])
+			copied = append(copied, body["name"].(string))
+
+			testJSON(map[string]interface{}{"id": 2})(w, r)
+		},
+		"POST api-key/application/50/provisioning": testJSON("provisioning-key"),
+		"DELETE v6/application(50)":                testJSON(nil),
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":        "test-key",
+		"credential_type":     ephemeralFleetCredentialType,
+		"organization":        "myorg",
+		"device_type":         "generic-amd64",
+		"fleet_name_template": "preview-{{suffix}}",
+		"template_fleet":      "myorg/preview-template",
+	})
+
+	t.Run("Suffix Required", func(t *testing.T) {
+		resp, err := testCredsRead(t, b, s, roleName)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create And Revoke", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/" + roleName,
+			Data:      map[string]interface{}{"fleet_suffix": "feature-x"},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, "myorg/preview-feature-x", resp.Data["fleet"])
+		require.Equal(t, "provisioning-key", resp.Data["provisioning_key"])
+		require.NotContains(t, resp.Data, "token")
+		require.Equal(t, []string{"API_URL"}, copied)
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    resp.Secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.False(t, srv.called("POST api-key/user/full"))
+		require.True(t, srv.called("DELETE v6/application(50)"))
+	})
+}
+
+// TestUserKeyRevokeAfterRoleDelete revokes user key leases whose role has
+// been deleted: a cached key is deleted with the role, and an uncached key
+// deletes itself by its ID.
+func TestUserKeyRevokeAfterRoleDelete(t *testing.T) {
+	var deletedWith []string
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"POST api-key/user/full": testJSON("user-key"),
+		"GET v6/api_key": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{"id": 55}},
+		}),
+		"DELETE v6/api_key(55)": func(w http.ResponseWriter, r *http.Request) {
+			deletedWith = append(deletedWith, r.Header.Get("Authorization"))
+			testJSON(nil)(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey": "test-key",
+	})
+
+	uncached, err := testCredsRead(t, b, s, roleName)
+	require.NoError(t, err)
+	require.False(t, uncached.IsError())
+
+	resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"balenaApiKey":      "test-key",
+		"cache_credentials": true,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	cached, err := testCredsRead(t, b, s, roleName)
+	require.NoError(t, err)
+	require.False(t, cached.IsError())
+
+	_, err = testTokenRoleDelete(t, b, s)
+	require.NoError(t, err)
+	require.Len(t, deletedWith, 1)
+	require.Contains(t, deletedWith[0], "test-key")
+
+	for _, lease := range []*logical.Response{cached, uncached} {
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    lease.Secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	}
+	require.Len(t, deletedWith, 2)
+	require.Contains(t, deletedWith[1], "user-key")
+}
+
+// TestSingleUseProvisioningKeys matches new fleet devices against single-use
+// keys: each device revokes one key, oldest first, and is not counted again.
+func TestSingleUseProvisioningKeys(t *testing.T) {
+	issued := time.Now().Add(-time.Hour)
+	ids := map[string]int{"key-a": 1, "key-b": 2, "key-c": 3}
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/device": func(w http.ResponseWriter, r *http.Request) {
+			d := []map[string]interface{}{}
+			if strings.Contains(r.URL.Query().Get("$filter"), "id gt 0") {
+				for _, id := range []int{10, 11, 12} {
+					d = append(d, map[string]interface{}{"id": id, "created_at": issued.Add(time.Duration(id) * time.Minute)})
+				}
+			}
+			testJSON(map[string]interface{}{"d": d})(w, r)
+		},
+		"GET v6/api_key": func(w http.ResponseWriter, r *http.Request) {
+			for name, id := range ids {
+				if strings.Contains(r.URL.Query().Get("$filter"), "'"+name+"'") {
+					testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": id}}})(w, r)
+					return
+				}
+			}
+			testJSON(map[string]interface{}{"d": []interface{}{}})(w, r)
+		},
+		"DELETE v6/api_key(1)": testJSON(nil),
+		"DELETE v6/api_key(2)": testJSON(nil),
+		"DELETE v6/api_key(3)": testJSON(nil),
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey": "test-key",
+	})
+
+	for i, key := range []*balenaSingleUseKey{
+		{Role: roleName, TokenID: "token-a", KeyName: "key-a", FleetID: 42, IssuedAt: issued},
+		{Role: roleName, TokenID: "token-b", KeyName: "key-b", FleetID: 42, IssuedAt: issued.Add(time.Minute)},
+		{Role: roleName, TokenID: "token-c", KeyName: "key-c", FleetID: 42, IssuedAt: issued.Add(2 * time.Minute)},
+		{Role: "deleted", TokenID: "token-d", KeyName: "key-d", FleetID: 42, IssuedAt: issued},
+	} {
+		entry, err := logical.StorageEntryJSON(singleUseKeyPath(key.FleetID, key.TokenID), key)
+		require.NoError(t, err, i)
+		require.NoError(t, s.Put(context.Background(), entry))
+	}
+
+	// device 11 was registered by the backend itself
+	b.noteOwnDevice(context.Background(), s, 42, 11)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, b.revokeUsedProvisioningKeys(context.Background(), s))
+
+		keys, err := s.List(context.Background(), provisioningKeyStoragePrefix+"42/")
+		require.NoError(t, err)
+		require.Equal(t, []string{"token-c"}, keys)
+
+		devices, err := s.List(context.Background(), ownDeviceStoragePrefix+"42/")
+		require.NoError(t, err)
+		require.Empty(t, devices)
+	}
+
+	require.True(t, srv.called("DELETE v6/api_key(1)"))
+	require.True(t, srv.called("DELETE v6/api_key(2)"))
+	require.False(t, srv.called("DELETE v6/api_key(3)"))
+}
+
+// TestCreateTokenSharedName checks that a key created with a name other keys
+// already use gets the ID of the new key, not of the oldest one by that name.
+func TestCreateTokenSharedName(t *testing.T) {
+	var renamed map[string]interface{}
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"POST api-key/user/full": func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			require.NotEqual(t, "shared-name", body["name"])
+
+			testJSON("user-key")(w, r)
+		},
+		"GET v6/api_key": func(w http.ResponseWriter, r *http.Request) {
+			id := 77
+			if strings.Contains(r.URL.Query().Get("$filter"), "'shared-name'") {
+				id = 1
+			}
+			testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": id}}})(w, r)
+		},
+		"PATCH v6/api_key(77)": func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&renamed))
+			testJSON(nil)(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey": "test-key",
+	})
+
+	client, err := b.getClient(context.Background(), s, "test-key")
+	require.NoError(t, err)
+
+	token, err := createToken(context.Background(), client, "shared-name", "desc", time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, 77, token.KeyID)
+	require.Equal(t, "shared-name", token.KeyName)
+	require.Equal(t, "shared-name", renamed["name"])
+}
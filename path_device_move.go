@@ -0,0 +1,164 @@
+package balenakeys
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathDeviceMove extends the Vault API with a `/device-move`
+// endpoint that moves a device to another fleet under a lease.
+func pathDeviceMove(b *balenaBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "device-move/" + roleNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role",
+				Required:    true,
+			},
+			"device_uuid": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "UUID of the device to move",
+				Required:    true,
+			},
+			"fleet": {
+				Type:        framework.TypeString,
+				Description: "Slug or ID of the fleet to move the device to, such as a quarantine or test fleet",
+				Required:    true,
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Length of the device move lease. If not set or set to 0, will use the role's ttl",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathDeviceMoveWrite,
+			},
+		},
+		HelpSynopsis:    pathDeviceMoveHelpSyn,
+		HelpDescription: pathDeviceMoveHelpDesc,
+	}
+}
+
+// pathDeviceMoveWrite records a device's fleet and moves it to another
+// fleet until the returned lease ends
+func (b *balenaBackend) pathDeviceMoveWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	fleetName := d.Get("fleet").(string)
+	if fleetName == "" {
+		return logical.ErrorResponse("fleet is required"), nil
+	}
+
+	roleEntry, resp, err := b.getIssuingRole(ctx, req.Storage, d.Get("name").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	ttl := b.leaseTTL(d, roleEntry)
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	device, resp, err := roleDevice(ctx, client, roleEntry, d.Get("device_uuid").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	fleet, err := getFleet(ctx, client, fleetName)
+	if err != nil {
+		return nil, err
+	}
+
+	if fleet == nil {
+		return logical.ErrorResponse("fleet %q not found", fleetName), nil
+	}
+
+	if !fleetAllowed(roleEntry.AllowedFleets, *fleet) {
+		return logical.ErrorResponse("fleet %q is not allowed by role %q", fleet.Slug, roleEntry.Name), nil
+	}
+
+	from := device.fleet()
+	if from.ID == fleet.ID {
+		return logical.ErrorResponse("device %q is already in fleet %q", device.UUID, fleet.Slug), nil
+	}
+
+	b.moveLock.Lock()
+	defer b.moveLock.Unlock()
+
+	moves, err := listDeviceMoves(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// a second move would record the first move's fleet as the one to
+	// return to, stranding the device there
+	for _, m := range moves {
+		if m.DeviceID == device.ID {
+			return logical.ErrorResponse("device %q is already moved by another lease", device.UUID), nil
+		}
+	}
+
+	move := &balenaDeviceMove{
+		ID:          uuid.New().String(),
+		Role:        roleEntry.Name,
+		DeviceID:    device.ID,
+		DeviceUUID:  device.UUID,
+		FromFleetID: from.ID,
+		FromFleet:   from.Slug,
+		ToFleetID:   fleet.ID,
+		ToFleet:     fleet.Slug,
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+
+	// the original fleet is stored before the device moves, so the
+	// periodic function can move it back even if this request never returns
+	if err := putDeviceMove(ctx, req.Storage, move); err != nil {
+		return nil, err
+	}
+
+	if err := moveDevice(ctx, client, device.ID, fleet.ID); err != nil {
+		if delErr := req.Storage.Delete(ctx, deviceMoveStoragePrefix+move.ID); delErr != nil {
+			b.Logger().Error("error removing device move", "move_id", move.ID, "error", delErr)
+		}
+		return nil, err
+	}
+
+	resp = b.Secret(balenaDeviceMoveType).Response(map[string]interface{}{
+		"device_uuid": device.UUID,
+		"from_fleet":  from.Slug,
+		"fleet":       fleet.Slug,
+	}, map[string]interface{}{
+		"move_id": move.ID,
+		"role":    roleEntry.Name,
+		"ttl":     ttl,
+		"max_ttl": roleEntry.MaxTTL,
+	})
+
+	resp.Secret.TTL = ttl
+
+	if roleEntry.MaxTTL > 0 {
+		resp.Secret.MaxTTL = roleEntry.MaxTTL
+	}
+
+	return resp, nil
+}
+
+const pathDeviceMoveHelpSyn = `
+Temporarily move a device to another fleet.
+`
+
+const pathDeviceMoveHelpDesc = `
+This path moves the device given as "device_uuid" to "fleet", such as a
+quarantine or test fleet, using the role's balena key. Both the device's
+own fleet and "fleet" must be allowed by the role's "allowed_fleets", and
+the device by its "allowed_device_uuids". The original fleet is recorded,
+and the device is moved back when the lease is revoked or expires. Moves
+back that fail are retried by the periodic function. A device that was
+moved to yet another fleet outside of Vault in the meantime is left there.
+`
@@ -0,0 +1,129 @@
+package balenakeys
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDeviceMove moves a device to a quarantine fleet and back, with the
+// move back first failing and then repaired by the periodic function.
+func TestDeviceMove(t *testing.T) {
+	var mu sync.Mutex
+	fleets := map[int]string{42: "myorg/myfleet", 43: "myorg/quarantine"}
+	fleetID := 42
+	failMoves := false
+
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/device": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			testJSON(map[string]interface{}{
+				"d": []map[string]interface{}{{
+					"id":                      1001,
+					"uuid":                    "0123456789abcdef0123456789abcdef",
+					"belongs_to__application": []map[string]interface{}{{"id": fleetID, "slug": fleets[fleetID]}},
+				}},
+			})(w, r)
+		},
+		"GET v6/application": func(w http.ResponseWriter, r *http.Request) {
+			d := []map[string]interface{}{}
+			for id, slug := range fleets {
+				if r.URL.Query().Get("$filter") == "slug eq '"+slug+"'" {
+					d = append(d, map[string]interface{}{"id": id, "slug": slug})
+				}
+			}
+			testJSON(map[string]interface{}{"d": d})(w, r)
+		},
+		"PATCH v6/device(1001)": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if failMoves {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+
+			var body map[string]int
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			fleetID = body["belongs_to__application"]
+
+			testJSON(nil)(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":   "test-key",
+		"allowed_fleets": "myorg/myfleet,myorg/quarantine",
+	})
+
+	t.Run("Fleet Not Allowed", func(t *testing.T) {
+		resp, err := testDeviceMove(t, b, s, "myorg/other")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Same Fleet", func(t *testing.T) {
+		resp, err := testDeviceMove(t, b, s, "myorg/myfleet")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	resp, err := testDeviceMove(t, b, s, "myorg/quarantine")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, "myorg/myfleet", resp.Data["from_fleet"])
+	require.Equal(t, 43, fleetID)
+	secret := resp.Secret
+
+	t.Run("Already Moved", func(t *testing.T) {
+		resp, err := testDeviceMove(t, b, s, "myorg/quarantine")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	mu.Lock()
+	failMoves = true
+	mu.Unlock()
+
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    secret,
+		Storage:   s,
+	})
+	require.Error(t, err)
+	require.Equal(t, 43, fleetID)
+
+	// moving the device back needs the role's key
+	deleteResp, err := testTokenRoleDelete(t, b, s)
+	require.NoError(t, err)
+	require.True(t, deleteResp.IsError())
+
+	mu.Lock()
+	failMoves = false
+	mu.Unlock()
+
+	require.NoError(t, b.reconcileDeviceMoves(context.Background(), s))
+	require.Equal(t, 42, fleetID)
+
+	keys, err := s.List(context.Background(), deviceMoveStoragePrefix)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
+
+// Utility function to move a device to a fleet and return any errors
+func testDeviceMove(t *testing.T, b *balenaBackend, s logical.Storage, fleet string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "device-move/" + roleName,
+		Data:      map[string]interface{}{"device_uuid": "0123456789abcdef0123456789abcdef", "fleet": fleet},
+		Storage:   s,
+	})
+}
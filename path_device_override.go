@@ -0,0 +1,205 @@
+package balenakeys
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathDeviceOverride extends the Vault API with a `/device-override`
+// endpoint that overrides device variables under a lease.
+func pathDeviceOverride(b *balenaBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "device-override/" + roleNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role",
+				Required:    true,
+			},
+			"device_uuid": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "UUID of the device to override variables on",
+			},
+			"fleet": {
+				Type:        framework.TypeString,
+				Description: "Slug or ID of the fleet to select devices by tag in",
+			},
+			"tag": {
+				Type:        framework.TypeString,
+				Description: "Tag, as key or key=value, selecting the devices in fleet to override variables on",
+			},
+			"config": {
+				Type:        framework.TypeKVPairs,
+				Description: "Device configuration variables to set, such as BALENA_SUPERVISOR_LOCAL_MODE",
+			},
+			"env": {
+				Type:        framework.TypeKVPairs,
+				Description: "Device environment variables to set",
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Length of the override lease. If not set or set to 0, will use the role's ttl",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathDeviceOverrideWrite,
+			},
+		},
+		HelpSynopsis:    pathDeviceOverrideHelpSyn,
+		HelpDescription: pathDeviceOverrideHelpDesc,
+	}
+}
+
+// pathDeviceOverrideWrite records the current values of the requested
+// variables on the selected devices, then sets them until the lease ends
+func (b *balenaBackend) pathDeviceOverrideWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	vars, resp := overrideVars(d.Get("config").(map[string]string), d.Get("env").(map[string]string))
+	if resp != nil {
+		return resp, nil
+	}
+
+	roleEntry, resp, err := b.getIssuingRole(ctx, req.Storage, d.Get("name").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	ttl := b.leaseTTL(d, roleEntry)
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, resp, err := roleDevices(ctx, client, roleEntry, d.Get("device_uuid").(string), d.Get("fleet").(string), d.Get("tag").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	b.overrideLock.Lock()
+	defer b.overrideLock.Unlock()
+
+	// a second override would record the first one's value as the
+	// variable's previous value, and whichever lease ended first would
+	// undo the other
+	device, name, err := overriddenVar(ctx, req.Storage, devices, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	if device != "" {
+		return logical.ErrorResponse("variable %q of device %q already has an active override", name, device), nil
+	}
+
+	override := &balenaOverride{
+		ID:   uuid.New().String(),
+		Role: roleEntry.Name,
+	}
+	if err := recordDeviceOverride(ctx, client, override, devices, vars); err != nil {
+		return nil, err
+	}
+
+	// the previous values are stored before anything changes, so a failed
+	// apply can always be undone
+	if err := putDeviceOverride(ctx, req.Storage, override); err != nil {
+		return nil, err
+	}
+
+	if err := applyDeviceOverride(ctx, client, override); err != nil {
+		if restoreErr := restoreDeviceOverride(ctx, client, override); restoreErr != nil {
+			b.Logger().Error("error restoring partially applied device override, will retry", "override_id", override.ID, "error", restoreErr)
+
+			// no lease will revoke the override, so the periodic function
+			// restores it instead
+			override.Orphaned = true
+			if putErr := putDeviceOverride(ctx, req.Storage, override); putErr != nil {
+				b.Logger().Error("error marking device override for restore", "override_id", override.ID, "error", putErr)
+			}
+			return nil, err
+		}
+		if delErr := req.Storage.Delete(ctx, deviceOverrideStoragePrefix+override.ID); delErr != nil {
+			b.Logger().Error("error removing device override", "override_id", override.ID, "error", delErr)
+		}
+		return nil, err
+	}
+
+	deviceUUIDs := make([]string, 0, len(devices))
+	for _, device := range devices {
+		deviceUUIDs = append(deviceUUIDs, device.UUID)
+	}
+
+	resp = b.Secret(balenaDeviceOverrideType).Response(map[string]interface{}{
+		"devices": deviceUUIDs,
+		"config":  d.Get("config"),
+		"env":     d.Get("env"),
+	}, map[string]interface{}{
+		"override_id": override.ID,
+		"role":        roleEntry.Name,
+		"ttl":         ttl,
+		"max_ttl":     roleEntry.MaxTTL,
+	})
+
+	resp.Secret.TTL = ttl
+
+	if roleEntry.MaxTTL > 0 {
+		resp.Secret.MaxTTL = roleEntry.MaxTTL
+	}
+
+	return resp, nil
+}
+
+// overrideVars returns the variables to override from the config and env
+// fields in a stable order, or an error response for invalid names
+func overrideVars(config map[string]string, env map[string]string) ([]balenaOverrideVar, *logical.Response) {
+	var vars []balenaOverrideVar
+	for _, set := range []struct {
+		resource string
+		values   map[string]string
+	}{
+		{deviceConfigVariableResource, config},
+		{deviceEnvironmentVarResource, env},
+	} {
+		names := make([]string, 0, len(set.values))
+		for name := range set.values {
+			if !envVarNameRegex.MatchString(name) {
+				return nil, logical.ErrorResponse("invalid variable name %q", name)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			vars = append(vars, balenaOverrideVar{
+				Resource: set.resource,
+				Name:     name,
+				Value:    set.values[name],
+			})
+		}
+	}
+
+	if len(vars) == 0 {
+		return nil, logical.ErrorResponse("at least one config or env variable is required")
+	}
+
+	return vars, nil
+}
+
+const pathDeviceOverrideHelpSyn = `
+Temporarily override device configuration and environment variables.
+`
+
+var pathDeviceOverrideHelpDesc = fmt.Sprintf(`
+This path sets the "config" (%s) and "env" (%s) variables on the device
+given as "device_uuid", or on every device in "fleet" carrying "tag",
+using the role's balena key and limited by the role's "allowed_fleets" and
+"allowed_device_uuids". The previous values are recorded, and when the
+lease is revoked or expires they are restored and variables that did not
+exist before are removed. A variable of a device can only be held by one
+override at a time. If the override fails part way and the variables cannot
+be restored right away, the restore is retried in the background.
+`, deviceConfigVariableResource, deviceEnvironmentVarResource)
@@ -0,0 +1,187 @@
+package balenakeys
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDeviceOverride overrides an existing config variable and a new env
+// variable on a device, and checks both are restored on revocation.
+func TestDeviceOverride(t *testing.T) {
+	var mu sync.Mutex
+	failWrites := 0
+	vars := map[string]map[string]interface{}{
+		"device_config_variable(7)": {"id": 7, "name": "BALENA_SUPERVISOR_LOCAL_MODE", "value": "0"},
+	}
+
+	listVars := func(resource string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			d := []map[string]interface{}{}
+			for key, v := range vars {
+				if strings.HasPrefix(key, resource+"(") && strings.Contains(r.URL.RawQuery, "%27"+v["name"].(string)+"%27") {
+					d = append(d, v)
+				}
+			}
+			testJSON(map[string]interface{}{"d": d})(w, r)
+		}
+	}
+
+	setVar := func(key string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if failWrites > 0 {
+				failWrites--
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			if _, ok := vars[key]; !ok {
+				require.EqualValues(t, 1001, body["device"])
+				vars[key] = map[string]interface{}{"id": 8, "name": body["name"]}
+			}
+			vars[key]["value"] = body["value"]
+
+			testJSON(nil)(w, r)
+		}
+	}
+
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/device": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{
+				"id":                      1001,
+				"uuid":                    "0123456789abcdef0123456789abcdef",
+				"belongs_to__application": []map[string]interface{}{{"id": 42, "slug": "myorg/myfleet"}},
+			}},
+		}),
+		"GET v6/device_config_variable":       listVars("device_config_variable"),
+		"GET v6/device_environment_variable":  listVars("device_environment_variable"),
+		"PATCH v6/device_config_variable(7)":  setVar("device_config_variable(7)"),
+		"POST v6/device_environment_variable": setVar("device_environment_variable(8)"),
+		"DELETE v6/device_environment_variable(8)": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			delete(vars, "device_environment_variable(8)")
+			testJSON(nil)(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":         "test-key",
+		"allowed_device_uuids": "0123456789abcdef0123456789abcdef",
+	})
+
+	t.Run("No Variables", func(t *testing.T) {
+		resp, err := testDeviceOverride(t, b, s, map[string]interface{}{
+			"device_uuid": "0123456789abcdef0123456789abcdef",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Invalid Variable Name", func(t *testing.T) {
+		resp, err := testDeviceOverride(t, b, s, map[string]interface{}{
+			"device_uuid": "0123456789abcdef0123456789abcdef",
+			"env":         map[string]interface{}{"NOT-VALID": "1"},
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Device Not Allowed", func(t *testing.T) {
+		resp, err := testDeviceOverride(t, b, s, map[string]interface{}{
+			"device_uuid": "fedcba9876543210fedcba9876543210",
+			"env":         map[string]interface{}{"LOG_LEVEL": "debug"},
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	resp, err := testDeviceOverride(t, b, s, map[string]interface{}{
+		"device_uuid": "0123456789abcdef0123456789abcdef",
+		"config":      map[string]interface{}{"BALENA_SUPERVISOR_LOCAL_MODE": "1"},
+		"env":         map[string]interface{}{"LOG_LEVEL": "debug"},
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, []string{"0123456789abcdef0123456789abcdef"}, resp.Data["devices"])
+	require.Equal(t, "1", vars["device_config_variable(7)"]["value"])
+	require.Equal(t, "debug", vars["device_environment_variable(8)"]["value"])
+
+	t.Run("Variable Already Overridden", func(t *testing.T) {
+		second, err := testDeviceOverride(t, b, s, map[string]interface{}{
+			"device_uuid": "0123456789abcdef0123456789abcdef",
+			"env":         map[string]interface{}{"LOG_LEVEL": "info"},
+		})
+		require.NoError(t, err)
+		require.True(t, second.IsError())
+		require.Equal(t, "debug", vars["device_environment_variable(8)"]["value"])
+	})
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+	require.Equal(t, "0", vars["device_config_variable(7)"]["value"])
+	require.NotContains(t, vars, "device_environment_variable(8)")
+
+	keys, err := s.List(context.Background(), deviceOverrideStoragePrefix)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	t.Run("Orphaned Override", func(t *testing.T) {
+		// both the override and the restore right after it fail
+		failWrites = 2
+		_, err := testDeviceOverride(t, b, s, map[string]interface{}{
+			"device_uuid": "0123456789abcdef0123456789abcdef",
+			"config":      map[string]interface{}{"BALENA_SUPERVISOR_LOCAL_MODE": "1"},
+		})
+		require.Error(t, err)
+
+		keys, err := s.List(context.Background(), deviceOverrideStoragePrefix)
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+
+		// the restore needs the role's key
+		resp, err := testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		// the variable changed even though balena reported the write failed
+		vars["device_config_variable(7)"]["value"] = "1"
+		require.NoError(t, b.reconcileDeviceOverrides(context.Background(), s))
+		require.Equal(t, "0", vars["device_config_variable(7)"]["value"])
+
+		keys, err = s.List(context.Background(), deviceOverrideStoragePrefix)
+		require.NoError(t, err)
+		require.Empty(t, keys)
+	})
+}
+
+// Utility function to override device variables and return any errors
+func testDeviceOverride(t *testing.T, b *balenaBackend, s logical.Storage, data map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "device-override/" + roleName,
+		Data:      data,
+		Storage:   s,
+	})
+}
@@ -0,0 +1,466 @@
+package balenakeys
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// maxManagedVarLength bounds generated values to what fits comfortably in
+// a balena environment variable
+const maxManagedVarLength = 4096
+
+// toResponseData returns the managed variable definition as the data of
+// a read response
+func (v *balenaManagedVar) toResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"role":            v.Role,
+		"fleet":           v.Fleet,
+		"device_uuid":     v.DeviceUUID,
+		"var_name":        v.VarName,
+		"length":          v.Length,
+		"charset":         v.Charset,
+		"rotation_period": v.RotationPeriod.Seconds(),
+		"canary_tag":      v.CanaryTag,
+		"canary_period":   v.CanaryPeriod.Seconds(),
+		"canary_timeout":  v.CanaryTimeout.Seconds(),
+	}
+}
+
+// pathManagedVar extends the Vault API with endpoints to define balena
+// environment variables whose values Vault generates and rotates.
+func pathManagedVar(b *balenaBackend) []*framework.Path {
+	nameField := map[string]*framework.FieldSchema{
+		"name": {
+			Type:        framework.TypeLowerCaseString,
+			Description: "Name of the managed variable",
+			Required:    true,
+		},
+	}
+
+	return []*framework.Path{
+		{
+			Pattern: managedVarStoragePrefix + framework.GenericNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": nameField["name"],
+				"role": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Role whose balena key, allowed_fleets and allowed_device_uuids are used to write the variable",
+				},
+				"fleet": {
+					Type:        framework.TypeString,
+					Description: "Slug or ID of the fleet to set the variable on",
+				},
+				"device_uuid": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "UUID of a single device to set the variable on instead of the whole fleet",
+				},
+				"var_name": {
+					Type:        framework.TypeString,
+					Description: "Name of the balena environment variable",
+				},
+				"length": {
+					Type:        framework.TypeInt,
+					Description: fmt.Sprintf("Length of generated values. Defaults to %d", defaultManagedVarLength),
+				},
+				"charset": {
+					Type:        framework.TypeString,
+					Description: "Characters generated values are made of. Defaults to letters and digits",
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Time between rotations. If not set or set to 0, values are only rotated on request",
+				},
+				"canary_tag": {
+					Type:        framework.TypeString,
+					Description: "Tag, as key or key=value, selecting the devices in fleet that get a new value first",
+				},
+				"canary_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Minimum time canary devices run a new value before the whole fleet gets it. Defaults to 5m",
+				},
+				"canary_timeout": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Time after which a rotation is aborted if canary devices are not online. Defaults to 1h",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathManagedVarRead,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathManagedVarWrite,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathManagedVarWrite,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathManagedVarDelete,
+				},
+			},
+			ExistenceCheck:  b.pathManagedVarExistenceCheck,
+			HelpSynopsis:    pathManagedVarHelpSyn,
+			HelpDescription: pathManagedVarHelpDesc,
+		},
+		{
+			Pattern: managedVarStoragePrefix + framework.GenericNameRegex("name") + "/status$",
+			Fields:  nameField,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathManagedVarStatusRead,
+				},
+			},
+			HelpSynopsis:    pathManagedVarStatusHelpSyn,
+			HelpDescription: pathManagedVarStatusHelpDesc,
+		},
+		{
+			Pattern: managedVarStoragePrefix + framework.GenericNameRegex("name") + "/value$",
+			Fields:  nameField,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathManagedVarValueRead,
+				},
+			},
+			HelpSynopsis:    pathManagedVarValueHelpSyn,
+			HelpDescription: pathManagedVarValueHelpDesc,
+		},
+		{
+			Pattern: managedVarStoragePrefix + framework.GenericNameRegex("name") + "/rotate$",
+			Fields:  nameField,
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathManagedVarRotate,
+				},
+			},
+			HelpSynopsis:    pathManagedVarRotateHelpSyn,
+			HelpDescription: pathManagedVarRotateHelpDesc,
+		},
+		{
+			Pattern: managedVarStoragePrefix + "?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathManagedVarList,
+				},
+			},
+			HelpSynopsis:    pathManagedVarHelpSyn,
+			HelpDescription: pathManagedVarHelpDesc,
+		},
+	}
+}
+
+// pathManagedVarExistenceCheck verifies if the managed variable exists.
+func (b *balenaBackend) pathManagedVarExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	v, err := getManagedVar(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, fmt.Errorf("existence check failed: %w", err)
+	}
+
+	return v != nil, nil
+}
+
+// pathManagedVarRead returns a managed variable definition
+func (b *balenaBackend) pathManagedVarRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	v, err := getManagedVar(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{Data: v.toResponseData()}, nil
+}
+
+// pathManagedVarWrite creates or updates a managed variable definition.
+// Its first value is generated by the next run of the periodic function.
+func (b *balenaBackend) pathManagedVarWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	b.managedVarLock.Lock()
+	defer b.managedVarLock.Unlock()
+
+	v, err := getManagedVar(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		v = &balenaManagedVar{
+			Name:          name,
+			Length:        defaultManagedVarLength,
+			Charset:       defaultManagedVarCharset,
+			CanaryPeriod:  defaultManagedVarCanaryPeriod,
+			CanaryTimeout: defaultManagedVarCanaryTimeout,
+		}
+	}
+
+	if role, ok := d.GetOk("role"); ok {
+		v.Role = role.(string)
+	}
+
+	if fleet, ok := d.GetOk("fleet"); ok {
+		v.Fleet = fleet.(string)
+	}
+
+	if deviceUUID, ok := d.GetOk("device_uuid"); ok {
+		v.DeviceUUID = deviceUUID.(string)
+	}
+
+	if varName, ok := d.GetOk("var_name"); ok {
+		v.VarName = varName.(string)
+	}
+
+	if length, ok := d.GetOk("length"); ok {
+		v.Length = length.(int)
+	}
+
+	if charset, ok := d.GetOk("charset"); ok {
+		v.Charset = charset.(string)
+	}
+
+	if period, ok := d.GetOk("rotation_period"); ok {
+		v.RotationPeriod = time.Duration(period.(int)) * time.Second
+	}
+
+	if tag, ok := d.GetOk("canary_tag"); ok {
+		v.CanaryTag = tag.(string)
+	}
+
+	if period, ok := d.GetOk("canary_period"); ok {
+		v.CanaryPeriod = time.Duration(period.(int)) * time.Second
+	}
+
+	if timeout, ok := d.GetOk("canary_timeout"); ok {
+		v.CanaryTimeout = time.Duration(timeout.(int)) * time.Second
+	}
+
+	switch {
+	case v.Role == "":
+		return logical.ErrorResponse("missing role"), nil
+	case v.Fleet == "":
+		return logical.ErrorResponse("missing fleet"), nil
+	case !envVarNameRegex.MatchString(v.VarName):
+		return logical.ErrorResponse("var_name must be a valid variable name"), nil
+	case v.Length <= 0 || v.Length > maxManagedVarLength:
+		return logical.ErrorResponse("length must be between 1 and %d", maxManagedVarLength), nil
+	case v.Charset == "":
+		return logical.ErrorResponse("charset must not be empty"), nil
+	case v.DeviceUUID != "" && !deviceUUIDRegex.MatchString(v.DeviceUUID):
+		return logical.ErrorResponse("invalid device_uuid %q", v.DeviceUUID), nil
+	case v.DeviceUUID != "" && v.CanaryTag != "":
+		return logical.ErrorResponse("canary_tag cannot be used with device_uuid"), nil
+	case v.CanaryTimeout < v.CanaryPeriod:
+		return logical.ErrorResponse("canary_timeout must not be shorter than canary_period"), nil
+	}
+
+	role, err := b.getRole(ctx, req.Storage, v.Role)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if role == nil {
+		return logical.ErrorResponse("role %q not found", v.Role), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(managedVarStoragePrefix+name, v)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// pathManagedVarDelete removes a managed variable and its state, after
+// removing the values of a rotation in its canary stage. The variable
+// itself is left in place.
+func (b *balenaBackend) pathManagedVarDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	b.managedVarLock.Lock()
+	defer b.managedVarLock.Unlock()
+
+	state, err := getManagedVarState(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.Canary != nil {
+		role, err := b.getRole(ctx, req.Storage, state.Canary.Role)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving role: %w", err)
+		}
+
+		if role != nil {
+			client, err := b.getClient(ctx, req.Storage, role.BalenaApiKey)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := restoreDeviceOverride(ctx, client, state.Canary); err != nil {
+				return nil, fmt.Errorf("error removing canary values: %w", err)
+			}
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, managedVarStoragePrefix+name); err != nil {
+		return nil, err
+	}
+
+	if err := req.Storage.Delete(ctx, managedVarStateStoragePrefix+name); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// pathManagedVarStatusRead returns the rotation state of a managed
+// variable, without its values
+func (b *balenaBackend) pathManagedVarStatusRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	v, err := getManagedVar(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		return logical.ErrorResponse("managed variable %q not found", name), nil
+	}
+
+	state, err := getManagedVarState(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{Data: state.toResponseData()}, nil
+}
+
+// pathManagedVarValueRead returns the current value of a managed variable,
+// and the value canary devices run during a rotation
+func (b *balenaBackend) pathManagedVarValueRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	v, err := getManagedVar(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		return logical.ErrorResponse("managed variable %q not found", name), nil
+	}
+
+	state, err := getManagedVarState(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.Version == 0 && state.Stage == "" {
+		return logical.ErrorResponse("managed variable %q has no value yet", name), nil
+	}
+
+	data := map[string]interface{}{
+		"var_name": v.VarName,
+		"value":    state.Value,
+		"version":  state.Version,
+	}
+	if state.Stage == managedVarStageCanary {
+		data["pending_value"] = state.Pending
+	}
+
+	return &logical.Response{Data: data}, nil
+}
+
+// pathManagedVarRotate starts a rotation of a managed variable right away
+func (b *balenaBackend) pathManagedVarRotate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	b.managedVarLock.Lock()
+	defer b.managedVarLock.Unlock()
+
+	v, err := getManagedVar(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		return logical.ErrorResponse("managed variable %q not found", name), nil
+	}
+
+	state, err := getManagedVarState(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.Stage != "" {
+		return logical.ErrorResponse("managed variable %q is already being rotated", name), nil
+	}
+
+	if err := b.rotateManagedVar(ctx, req.Storage, v, state); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{Data: state.toResponseData()}, nil
+}
+
+// pathManagedVarList lists the managed variables
+func (b *balenaBackend) pathManagedVarList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, managedVarStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(names), nil
+}
+
+const (
+	pathManagedVarHelpSyn  = `Generate and rotate balena environment variables.`
+	pathManagedVarHelpDesc = `
+A managed variable is a balena environment variable named "var_name"
+whose value Vault generates from "length" characters of "charset". It is
+set on "fleet", or only on "device_uuid" when set, with the balena key of
+"role" and within its "allowed_fleets" and "allowed_device_uuids".
+
+The periodic function sets the first value, and a new one every
+"rotation_period" after the last successful rotation. A failed rotation
+is tried again after a few minutes.
+
+With "canary_tag", a new value is first set as a device variable on the
+devices in the fleet carrying the tag. Once they have run it for
+"canary_period" and are all online, it is set on the whole fleet and the
+canary device variables are removed again. If they are not all online by
+"canary_timeout", the rotation is aborted and the canary devices go back
+to the old value. A rotation doesn't start its canary stage while a
+device override holds the variable on one of the canary devices, and
+device overrides of the variable are refused during the canary stage.
+
+Deleting a managed variable stops its rotation and leaves the balena
+variable in place.
+`
+	pathManagedVarStatusHelpSyn  = `Read the rotation status of a managed variable.`
+	pathManagedVarStatusHelpDesc = `
+Returns the version of the current value, when the variable was last
+rotated, the error of the last attempt if it failed and when it is
+retried, and the canary devices of a rotation in its canary stage.
+Values are not returned.
+`
+	pathManagedVarValueHelpSyn  = `Read the value of a managed variable.`
+	pathManagedVarValueHelpDesc = `
+Returns the current value of the managed variable and its version.
+During the canary stage of a rotation, the new value run by the canary
+devices is returned as "pending_value".
+`
+	pathManagedVarRotateHelpSyn  = `Rotate a managed variable now.`
+	pathManagedVarRotateHelpDesc = `
+Starts a rotation of the managed variable without waiting for its
+"rotation_period". With "canary_tag" the rotation finishes in a later
+run of the periodic function.
+`
+)
@@ -0,0 +1,239 @@
+package balenakeys
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestManagedVar rotates a fleet variable through a canary device against
+// a fake balena API, holding the rotation until the canary is online.
+func TestManagedVar(t *testing.T) {
+	var mu sync.Mutex
+	online := false
+	fleetVars := map[string]string{}
+	deviceVars := map[string]string{}
+
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/application": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{"id": 42, "slug": "myorg/myfleet"}},
+		}),
+		"GET v6/device": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			testJSON(map[string]interface{}{
+				"d": []map[string]interface{}{{
+					"id":                      1001,
+					"uuid":                    "0123456789abcdef0123456789abcdef",
+					"is_online":               online,
+					"belongs_to__application": []map[string]interface{}{{"id": 42, "slug": "myorg/myfleet"}},
+				}},
+			})(w, r)
+		},
+		"GET v6/device_environment_variable": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			d := []map[string]interface{}{}
+			if value, ok := deviceVars["MQTT_PASSWORD"]; ok {
+				d = append(d, map[string]interface{}{"id": 9, "name": "MQTT_PASSWORD", "value": value})
+			}
+			testJSON(map[string]interface{}{"d": d})(w, r)
+		},
+		"POST v6/device_environment_variable": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			require.EqualValues(t, 1001, body["device"])
+			deviceVars[body["name"].(string)] = body["value"].(string)
+
+			testJSON(nil)(w, r)
+		},
+		"DELETE v6/device_environment_variable(9)": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			delete(deviceVars, "MQTT_PASSWORD")
+			testJSON(nil)(w, r)
+		},
+		"GET v6/application_environment_variable": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			d := []map[string]interface{}{}
+			if value, ok := fleetVars["MQTT_PASSWORD"]; ok {
+				d = append(d, map[string]interface{}{"id": 5, "name": "MQTT_PASSWORD", "value": value})
+			}
+			testJSON(map[string]interface{}{"d": d})(w, r)
+		},
+		"POST v6/application_environment_variable": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			require.EqualValues(t, 42, body["application"])
+			fleetVars[body["name"].(string)] = body["value"].(string)
+
+			testJSON(nil)(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":   "test-key",
+		"allowed_fleets": "myorg/myfleet",
+	})
+
+	t.Run("Invalid Variable Name", func(t *testing.T) {
+		resp, err := testManagedVarRequest(t, b, s, logical.CreateOperation, "", map[string]interface{}{
+			"role":     roleName,
+			"fleet":    "myorg/myfleet",
+			"var_name": "NOT-VALID",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	resp, err := testManagedVarRequest(t, b, s, logical.CreateOperation, "", map[string]interface{}{
+		"role":          roleName,
+		"fleet":         "myorg/myfleet",
+		"var_name":      "MQTT_PASSWORD",
+		"length":        16,
+		"charset":       "ab",
+		"canary_tag":    "canary",
+		"canary_period": 0,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	t.Run("No Value Yet", func(t *testing.T) {
+		resp, err := testManagedVarRequest(t, b, s, logical.ReadOperation, "/value", nil)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Canary Device Overridden", func(t *testing.T) {
+		held := &balenaOverride{
+			ID:   "held",
+			Role: roleName,
+			Devices: []balenaOverrideDevice{{
+				ID:   1001,
+				UUID: "0123456789abcdef0123456789abcdef",
+				Vars: []balenaOverrideVar{{Resource: deviceEnvironmentVarResource, Name: "MQTT_PASSWORD"}},
+			}},
+		}
+		require.NoError(t, putDeviceOverride(context.Background(), s, held))
+
+		require.NoError(t, b.reconcileManagedVars(context.Background(), s))
+		require.Empty(t, deviceVars)
+
+		resp, err := testManagedVarRequest(t, b, s, logical.ReadOperation, "/status", nil)
+		require.NoError(t, err)
+		require.Contains(t, resp.Data["last_error"], "active override")
+
+		require.NoError(t, s.Delete(context.Background(), deviceOverrideStoragePrefix+held.ID))
+		require.NoError(t, putManagedVarState(context.Background(), s, "mqtt", &balenaManagedVarState{}))
+	})
+
+	// the first run sets the new value on the canary device only, and keeps
+	// waiting while the canary is offline
+	for i := 0; i < 2; i++ {
+		require.NoError(t, b.reconcileManagedVars(context.Background(), s))
+	}
+	require.Len(t, deviceVars["MQTT_PASSWORD"], 16)
+	require.Regexp(t, "^[ab]+$", deviceVars["MQTT_PASSWORD"])
+	require.Empty(t, fleetVars)
+
+	resp, err = testManagedVarRequest(t, b, s, logical.ReadOperation, "/status", nil)
+	require.NoError(t, err)
+	require.Equal(t, managedVarStageCanary, resp.Data["stage"])
+	require.Equal(t, []string{"0123456789abcdef0123456789abcdef"}, resp.Data["canary_devices"])
+	require.NotContains(t, resp.Data, "value")
+
+	// overrides of the variable are refused while the canary holds it
+	device, _, err := overriddenVar(context.Background(), s,
+		[]balenaDevice{{ID: 1001, UUID: "0123456789abcdef0123456789abcdef"}},
+		[]balenaOverrideVar{{Resource: deviceEnvironmentVarResource, Name: "MQTT_PASSWORD"}})
+	require.NoError(t, err)
+	require.Equal(t, "0123456789abcdef0123456789abcdef", device)
+
+	resp, err = testManagedVarRequest(t, b, s, logical.ReadOperation, "/value", nil)
+	require.NoError(t, err)
+	pending := resp.Data["pending_value"]
+	require.Equal(t, deviceVars["MQTT_PASSWORD"], pending)
+
+	mu.Lock()
+	online = true
+	mu.Unlock()
+
+	require.NoError(t, b.reconcileManagedVars(context.Background(), s))
+	require.Equal(t, pending, fleetVars["MQTT_PASSWORD"])
+	require.NotContains(t, deviceVars, "MQTT_PASSWORD")
+
+	resp, err = testManagedVarRequest(t, b, s, logical.ReadOperation, "/value", nil)
+	require.NoError(t, err)
+	require.Equal(t, pending, resp.Data["value"])
+	require.Equal(t, 1, resp.Data["version"])
+	require.NotContains(t, resp.Data, "pending_value")
+
+	resp, err = testManagedVarRequest(t, b, s, logical.UpdateOperation, "/rotate", nil)
+	require.NoError(t, err)
+	require.Equal(t, managedVarStageCanary, resp.Data["stage"])
+
+	t.Run("Already Rotating", func(t *testing.T) {
+		resp, err := testManagedVarRequest(t, b, s, logical.UpdateOperation, "/rotate", nil)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+// TestManagedVarDue checks that rotations are scheduled from the last
+// successful rotation, with failed attempts retried after a backoff.
+func TestManagedVarDue(t *testing.T) {
+	now := time.Now()
+	v := &balenaManagedVar{RotationPeriod: 24 * time.Hour}
+
+	for name, tc := range map[string]struct {
+		state *balenaManagedVarState
+		due   bool
+	}{
+		"Never Rotated":    {&balenaManagedVarState{}, true},
+		"Rotated Recently": {&balenaManagedVarState{LastRotatedAt: now.Add(-time.Hour)}, false},
+		"Period Elapsed":   {&balenaManagedVarState{LastRotatedAt: now.Add(-25 * time.Hour)}, true},
+		"Canary Stage":     {&balenaManagedVarState{Stage: managedVarStageCanary}, false},
+		"Failed, Backing Off": {&balenaManagedVarState{
+			LastRotatedAt: now.Add(-25 * time.Hour),
+			LastAttemptAt: now.Add(-time.Minute),
+			RetryAt:       now.Add(managedVarRetryBackoff - time.Minute),
+		}, false},
+		"Failed, Retry Due": {&balenaManagedVarState{
+			LastRotatedAt: now.Add(-25 * time.Hour),
+			LastAttemptAt: now.Add(-time.Hour),
+			RetryAt:       now.Add(managedVarRetryBackoff - time.Hour),
+		}, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.due, tc.state.due(v, now))
+		})
+	}
+}
+
+// Utility function to make a request to the mqtt managed variable
+func testManagedVarRequest(t *testing.T, b *balenaBackend, s logical.Storage, op logical.Operation, suffix string, data map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      managedVarStoragePrefix + "mqtt" + suffix,
+		Data:      data,
+		Storage:   s,
+	})
+}
@@ -0,0 +1,263 @@
+package balenakeys
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"go.einride.tech/balena"
+)
+
+const (
+	// registrationKeyTTL bounds the provisioning key used to register a
+	// single device, which is deleted right after registration
+	registrationKeyTTL  = 10 * time.Minute
+	registrationKeyDesc = "Vault device preregistration"
+)
+
+// balenaRegisteredDevice holds what balena returns for a preregistered device
+// together with the key the device will authenticate with
+type balenaRegisteredDevice struct {
+	ID           int    `json:"id"`
+	UUID         string `json:"uuid"`
+	DeviceApiKey string `json:"api_key"`
+}
+
+// pathProvision extends the Vault API with a `/provision`
+// endpoint that preregisters a device in a role's fleet.
+func pathProvision(b *balenaBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "provision/" + roleNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathProvisionWrite,
+			},
+		},
+		HelpSynopsis:    pathProvisionHelpSyn,
+		HelpDescription: pathProvisionHelpDesc,
+	}
+}
+
+// pathProvisionWrite preregisters a device in the role's fleet and returns a
+// config.json for it
+func (b *balenaBackend) pathProvisionWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleEntry, resp, err := b.getProvisioningRole(ctx, req.Storage, d.Get("name").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// everything the config.json needs is checked before the device is
+	// registered, so a bad config does not leave a device behind
+	endpoints, err := deviceEndpoints(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fleet, err := getFleet(ctx, client, roleEntry.Fleet)
+	if err != nil {
+		return nil, err
+	}
+
+	if fleet == nil {
+		return logical.ErrorResponse("fleet %q not found", roleEntry.Fleet), nil
+	}
+
+	device, err := preregisterDevice(ctx, client, fleet.ID, roleEntry.DeviceType)
+	if err != nil {
+		return nil, err
+	}
+	b.noteOwnDevice(ctx, req.Storage, fleet.ID, device.ID)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"uuid":      device.UUID,
+			"device_id": device.ID,
+			"fleet":     fleet.Slug,
+			"config":    newDeviceConfig(endpoints, fleet, roleEntry.DeviceType, device),
+		},
+	}, nil
+}
+
+// getProvisioningRole returns a role that can preregister devices, or an
+// error response explaining why the role cannot be used
+func (b *balenaBackend) getProvisioningRole(ctx context.Context, s logical.Storage, name string) (*balenaRoleEntry, *logical.Response, error) {
+	roleEntry, err := b.getRole(ctx, s, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return nil, logical.ErrorResponse("role %q not found", name), nil
+	}
+
+	if roleEntry.Fleet == "" || roleEntry.DeviceType == "" {
+		return nil, logical.ErrorResponse("role %q needs fleet and device_type to provision devices", name), nil
+	}
+
+	resp, err := b.checkIssuance(ctx, s, roleEntry)
+	if resp != nil || err != nil {
+		return nil, resp, err
+	}
+
+	return roleEntry, nil, nil
+}
+
+// deviceEndpoints returns the endpoints of the configured balena
+// installation that go into a device's config.json
+func deviceEndpoints(config *balenaConfig) (*balenaEndpoints, error) {
+	if config == nil {
+		return nil, errors.New("backend is not configured")
+	}
+
+	return endpointsFromURL(config.URL)
+}
+
+// newDeviceConfig builds the config.json a device needs to join its fleet
+func newDeviceConfig(endpoints *balenaEndpoints, fleet *balenaFleet, deviceType string, device *balenaRegisteredDevice) map[string]interface{} {
+	return map[string]interface{}{
+		"applicationId":         fleet.ID,
+		"applicationName":       fleet.Slug,
+		"deviceType":            deviceType,
+		"deviceId":              device.ID,
+		"uuid":                  device.UUID,
+		"deviceApiKey":          device.DeviceApiKey,
+		"apiEndpoint":           endpoints.API,
+		"registryEndpoint":      endpoints.Registry,
+		"vpnEndpoint":           endpoints.VPN,
+		"vpnPort":               443,
+		"deltaEndpoint":         endpoints.Delta,
+		"listenPort":            48484,
+		"appUpdatePollInterval": 900000,
+		"registered_at":         time.Now().UnixMilli(),
+	}
+}
+
+// preregisterDevice registers a new device in a fleet with a generated UUID
+// and device API key. A short-lived provisioning key authorizes the
+// registration and is deleted again afterwards.
+func preregisterDevice(ctx context.Context, c *balenaClient, fleetID int, deviceType string) (*balenaRegisteredDevice, error) {
+	userID, err := whoami(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	provisioningKey, err := createProvisioningToken(ctx, c, fleetID, "", registrationKeyDesc, time.Now().Add(registrationKeyTTL))
+	if err != nil {
+		return nil, err
+	}
+	// the key also expires on its own, so cleanup is best effort
+	defer deleteToken(ctx, c, provisioningKey.KeyName)
+
+	return registerDevice(ctx, c, userID, fleetID, deviceType, provisioningKey.Token)
+}
+
+// registerDevice registers a new device in a fleet with a generated UUID and
+// device API key, authorized by the given provisioning key
+func registerDevice(ctx context.Context, c *balenaClient, userID int, fleetID int, deviceType string, provisioningKey string) (*balenaRegisteredDevice, error) {
+	type balenaBody struct {
+		User        int    `json:"user,omitempty"`
+		Application int    `json:"application"`
+		UUID        string `json:"uuid"`
+		DeviceType  string `json:"device_type"`
+		ApiKey      string `json:"api_key"`
+	}
+
+	deviceUUID, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceApiKey, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.NewRequest(ctx, "POST", "device/register", "apikey="+provisioningKey, balenaBody{
+		User:        userID,
+		Application: fleetID,
+		UUID:        deviceUUID,
+		DeviceType:  deviceType,
+		ApiKey:      deviceApiKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var device balenaRegisteredDevice
+	if err := c.Do(req, &device); err != nil {
+		// the request URL carries the provisioning key, so keep it out of the error
+		var apiErr *balena.ErrorResponse
+		if errors.As(err, &apiErr) {
+			return nil, fmt.Errorf("error registering balena device: status %d", apiErr.Response.StatusCode)
+		}
+		return nil, errors.New("error registering balena device")
+	}
+
+	device.UUID = deviceUUID
+	device.DeviceApiKey = deviceApiKey
+
+	return &device, nil
+}
+
+// whoami returns the ID of the balena user the client authenticates as
+func whoami(ctx context.Context, c *balenaClient) (int, error) {
+	var user struct {
+		ID       int    `json:"id"`
+		Username string `json:"username"`
+	}
+
+	req, err := c.NewRequest(ctx, "GET", "user/v1/whoami", "", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.Do(req, &user); err != nil {
+		return 0, fmt.Errorf("error getting balena user: %w", err)
+	}
+
+	return user.ID, nil
+}
+
+// randomHex returns n random bytes encoded as hex, which is how balena
+// generates device UUIDs and keys
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating random value: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+const pathProvisionHelpSyn = `
+Preregister a device in a role's fleet and return its config.json.
+`
+
+const pathProvisionHelpDesc = `
+This path registers a new device in the fleet of the given role, using
+the role's "fleet" and "device_type". The device UUID and device API key
+are generated for the device, and the response contains a complete
+config.json for it, with the endpoints derived from the configured
+balena API URL. The device is not leased and stays registered.
+`
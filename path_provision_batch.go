@@ -0,0 +1,477 @@
+package balenakeys
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	provisionBatchStoragePrefix = "provision-batch/"
+
+	// maxProvisionBatchCount is the size of a production lot. A batch that
+	// large may outlast a single request, and is then finished by resuming it
+	maxProvisionBatchCount = 500
+
+	batchFormatJSON = "json"
+	batchFormatTar  = "tar"
+	batchFormatZip  = "zip"
+)
+
+// balenaProvisionBatch tracks the progress of a bulk preregistration so an
+// interrupted batch can be resumed. The config of each device is stored in
+// its own entry, see provisionBatchDevicePath.
+type balenaProvisionBatch struct {
+	ID        string    `json:"id"`
+	Role      string    `json:"role"`
+	Count     int       `json:"count"`
+	Completed int       `json:"completed"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// complete reports whether every device of the batch has been preregistered
+func (p *balenaProvisionBatch) complete() bool {
+	return p.Completed >= p.Count
+}
+
+// provisionBatchDevicePath returns the storage path of the config of the
+// n-th device of a batch
+func provisionBatchDevicePath(batchID string, n int) string {
+	return fmt.Sprintf("%s%s/%d", provisionBatchStoragePrefix, batchID, n)
+}
+
+// toResponseData returns the progress of a batch without its device configs
+func (p *balenaProvisionBatch) toResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"batch_id":   p.ID,
+		"role":       p.Role,
+		"count":      p.Count,
+		"completed":  p.Completed,
+		"created_by": p.CreatedBy,
+		"created_at": p.CreatedAt,
+		"updated_at": p.UpdatedAt,
+	}
+}
+
+// pathProvisionBatch extends the Vault API with endpoints to
+// preregister many devices at once and to track those batches.
+func pathProvisionBatch(b *balenaBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "provision-batch/" + roleNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the role",
+					Required:    true,
+				},
+				"count": {
+					Type:        framework.TypeInt,
+					Description: "Number of devices to preregister",
+				},
+				"batch_id": {
+					Type:        framework.TypeString,
+					Description: "ID of an interrupted batch to resume",
+				},
+				"format": {
+					Type:          framework.TypeString,
+					Description:   "Output format: json for a list of configs, or a base64 encoded tar or zip archive",
+					Default:       batchFormatJSON,
+					AllowedValues: []interface{}{batchFormatJSON, batchFormatTar, batchFormatZip},
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathProvisionBatchWrite,
+				},
+			},
+			HelpSynopsis:    pathProvisionBatchHelpSyn,
+			HelpDescription: pathProvisionBatchHelpDesc,
+		},
+		{
+			Pattern: "provision-batches/" + framework.GenericNameRegex("batch_id"),
+			Fields: map[string]*framework.FieldSchema{
+				"batch_id": {
+					Type:        framework.TypeString,
+					Description: "ID of the batch",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathProvisionBatchRead,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathProvisionBatchDelete,
+				},
+			},
+			HelpSynopsis:    pathProvisionBatchesHelpSyn,
+			HelpDescription: pathProvisionBatchesHelpDesc,
+		},
+		{
+			Pattern: "provision-batches/?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathProvisionBatchList,
+				},
+			},
+			HelpSynopsis:    pathProvisionBatchesHelpSyn,
+			HelpDescription: pathProvisionBatchesHelpDesc,
+		},
+	}
+}
+
+// pathProvisionBatchWrite starts or resumes a batch and preregisters devices
+// until the batch is complete, saving progress after every device
+func (b *balenaBackend) pathProvisionBatchWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	format := d.Get("format").(string)
+
+	switch format {
+	case batchFormatJSON, batchFormatTar, batchFormatZip:
+	default:
+		return logical.ErrorResponse("format must be one of json, tar or zip"), nil
+	}
+
+	roleEntry, resp, err := b.getProvisioningRole(ctx, req.Storage, name)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	var batch *balenaProvisionBatch
+	if batchID := d.Get("batch_id").(string); batchID != "" {
+		batch, err = getProvisionBatch(ctx, req.Storage, batchID)
+		if err != nil {
+			return nil, err
+		}
+		if batch == nil {
+			return logical.ErrorResponse("batch %q not found", batchID), nil
+		}
+		if batch.Role != roleEntry.Name {
+			return logical.ErrorResponse("batch %q belongs to role %q", batchID, batch.Role), nil
+		}
+	} else {
+		count := d.Get("count").(int)
+		if count <= 0 || count > maxProvisionBatchCount {
+			return logical.ErrorResponse("count must be between 1 and %d", maxProvisionBatchCount), nil
+		}
+
+		now := time.Now().UTC()
+		batch = &balenaProvisionBatch{
+			ID:        uuid.New().String(),
+			Role:      roleEntry.Name,
+			Count:     count,
+			CreatedBy: req.DisplayName,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if err := putProvisionBatch(ctx, req.Storage, batch); err != nil {
+			return nil, err
+		}
+	}
+
+	if !batch.complete() {
+		if err := b.runProvisionBatch(ctx, req.Storage, roleEntry, batch); err != nil {
+			return logical.ErrorResponse("batch %q interrupted after %d of %d devices, write again with batch_id=%s to resume: %s", batch.ID, batch.Completed, batch.Count, batch.ID, err), nil
+		}
+	}
+
+	configs, err := getProvisionBatchConfigs(ctx, req.Storage, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	data := batch.toResponseData()
+	data["format"] = format
+
+	switch format {
+	case batchFormatJSON:
+		data["configs"] = configs
+	default:
+		archive, err := batchArchive(format, configs)
+		if err != nil {
+			return nil, err
+		}
+		data["archive"] = base64.StdEncoding.EncodeToString(archive)
+	}
+
+	return &logical.Response{Data: data}, nil
+}
+
+// runProvisionBatch preregisters the remaining devices of a batch. A single
+// provisioning key authorizes the whole run.
+func (b *balenaBackend) runProvisionBatch(ctx context.Context, s logical.Storage, role *balenaRoleEntry, batch *balenaProvisionBatch) error {
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	endpoints, err := deviceEndpoints(config)
+	if err != nil {
+		return err
+	}
+
+	client, err := b.getClient(ctx, s, role.BalenaApiKey)
+	if err != nil {
+		return err
+	}
+
+	fleet, err := getFleet(ctx, client, role.Fleet)
+	if err != nil {
+		return err
+	}
+
+	if fleet == nil {
+		return fmt.Errorf("fleet %q not found", role.Fleet)
+	}
+
+	userID, err := whoami(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	provisioningKey, err := createProvisioningToken(ctx, client, fleet.ID, "", registrationKeyDesc, time.Now().Add(registrationKeyTTL))
+	if err != nil {
+		return err
+	}
+	// the key also expires on its own, so cleanup is best effort
+	defer deleteToken(ctx, client, provisioningKey.KeyName)
+
+	for !batch.complete() {
+		device, err := registerDevice(ctx, client, userID, fleet.ID, role.DeviceType, provisioningKey.Token)
+		if err != nil {
+			return err
+		}
+		b.noteOwnDevice(ctx, s, fleet.ID, device.ID)
+
+		entry, err := logical.StorageEntryJSON(provisionBatchDevicePath(batch.ID, batch.Completed), newDeviceConfig(endpoints, fleet, role.DeviceType, device))
+		if err == nil {
+			err = s.Put(ctx, entry)
+		}
+		if err != nil {
+			// a device whose config was never saved cannot be handed out
+			if delErr := deleteDevice(ctx, client, device.ID); delErr != nil {
+				b.Logger().Error("error deleting unsaved preregistered device", "device_id", device.ID, "error", delErr)
+			}
+			return err
+		}
+
+		// a config saved without the count is overwritten on resume, so
+		// only that one device could end up registered twice
+		batch.Completed++
+		batch.UpdatedAt = time.Now().UTC()
+		if err := putProvisionBatch(ctx, s, batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pathProvisionBatchRead returns the progress of a batch
+func (b *balenaBackend) pathProvisionBatchRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	batch, err := getProvisionBatch(ctx, req.Storage, d.Get("batch_id").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if batch == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: batch.toResponseData(),
+	}, nil
+}
+
+// pathProvisionBatchDelete removes a batch and the device keys it holds from
+// storage. The preregistered devices stay registered in balena.
+func (b *balenaBackend) pathProvisionBatchDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	batchID := d.Get("batch_id").(string)
+
+	devices, err := req.Storage.List(ctx, provisionBatchStoragePrefix+batchID+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range devices {
+		if err := req.Storage.Delete(ctx, provisionBatchStoragePrefix+batchID+"/"+n); err != nil {
+			return nil, fmt.Errorf("error deleting provision batch device: %w", err)
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, provisionBatchStoragePrefix+batchID); err != nil {
+		return nil, fmt.Errorf("error deleting provision batch: %w", err)
+	}
+
+	return nil, nil
+}
+
+// pathProvisionBatchList lists the IDs of stored batches
+func (b *balenaBackend) pathProvisionBatchList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, provisionBatchStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// the device configs of a batch are listed as "<id>/"
+	batchIDs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry, "/") {
+			batchIDs = append(batchIDs, entry)
+		}
+	}
+
+	return logical.ListResponse(batchIDs), nil
+}
+
+// batchArchive packs one config.json per device into a tar or zip archive,
+// each under a directory named after the device UUID
+func batchArchive(format string, configs []map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var tw *tar.Writer
+	var zw *zip.Writer
+	if format == batchFormatTar {
+		tw = tar.NewWriter(&buf)
+	} else {
+		zw = zip.NewWriter(&buf)
+	}
+
+	now := time.Now()
+	for _, config := range configs {
+		content, err := json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+		name := fmt.Sprintf("%v/config.json", config["uuid"])
+
+		if tw != nil {
+			if err := tw.WriteHeader(&tar.Header{
+				Name:    name,
+				Mode:    0o600,
+				Size:    int64(len(content)),
+				ModTime: now,
+			}); err != nil {
+				return nil, err
+			}
+			if _, err := tw.Write(content); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: now,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+	}
+
+	if tw != nil {
+		if err := tw.Close(); err != nil {
+			return nil, err
+		}
+	} else if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// getProvisionBatch gets a batch from the Vault storage API
+func getProvisionBatch(ctx context.Context, s logical.Storage, batchID string) (*balenaProvisionBatch, error) {
+	entry, err := s.Get(ctx, provisionBatchStoragePrefix+batchID)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var batch balenaProvisionBatch
+	if err := entry.DecodeJSON(&batch); err != nil {
+		return nil, fmt.Errorf("error reading provision batch: %w", err)
+	}
+	return &batch, nil
+}
+
+// getProvisionBatchConfigs returns the configs of the devices a batch has
+// preregistered so far, in order
+func getProvisionBatchConfigs(ctx context.Context, s logical.Storage, batch *balenaProvisionBatch) ([]map[string]interface{}, error) {
+	configs := make([]map[string]interface{}, 0, batch.Completed)
+	for n := 0; n < batch.Completed; n++ {
+		entry, err := s.Get(ctx, provisionBatchDevicePath(batch.ID, n))
+		if err != nil {
+			return nil, err
+		}
+
+		if entry == nil {
+			return nil, fmt.Errorf("provision batch %q is missing device %d", batch.ID, n)
+		}
+
+		var config map[string]interface{}
+		if err := entry.DecodeJSON(&config); err != nil {
+			return nil, fmt.Errorf("error reading provision batch device: %w", err)
+		}
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// putProvisionBatch adds a batch to the Vault storage API
+func putProvisionBatch(ctx context.Context, s logical.Storage, batch *balenaProvisionBatch) error {
+	entry, err := logical.StorageEntryJSON(provisionBatchStoragePrefix+batch.ID, batch)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+const pathProvisionBatchHelpSyn = `
+Preregister many devices in a role's fleet in one call.
+`
+
+const pathProvisionBatchHelpDesc = `
+This path preregisters "count" devices, at most 500, in the fleet of the
+given role and returns their config.json files, either as a JSON list or as a base64
+encoded tar or zip archive with one "<uuid>/config.json" per device.
+
+Progress is saved after every device. If a batch is interrupted, the
+error names its "batch_id", and writing again with that "batch_id"
+resumes where it stopped. Large batches can take longer than Vault's
+maximum request duration, in which case they are finished by resuming
+them until the configs are returned.
+`
+
+const pathProvisionBatchesHelpSyn = `
+Manage bulk device preregistration batches.
+`
+
+const pathProvisionBatchesHelpDesc = `
+This path lists stored batches and reads their progress. Deleting a batch
+removes the stored device configs, including their device API keys, but
+leaves the devices registered in balena.
+`
@@ -0,0 +1,142 @@
+package balenakeys
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestProvisionBatch preregisters a batch of devices against a fake
+// balena API that fails part way, then resumes the batch.
+func TestProvisionBatch(t *testing.T) {
+	registered := 0
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/application": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{"id": 42, "slug": "myorg/myfleet"}},
+		}),
+		"GET user/v1/whoami":                       testJSON(map[string]interface{}{"id": 7}),
+		"POST api-key/application/42/provisioning": testJSON("provisioning-key"),
+		"GET v6/api_key":                           testJSON(map[string]interface{}{"d": []interface{}{}}),
+		"POST device/register": func(w http.ResponseWriter, r *http.Request) {
+			registered++
+			if registered == 3 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			testJSON(map[string]interface{}{"id": 1000 + registered, "uuid": body["uuid"]})(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey": "test-key",
+		"fleet":        "myorg/myfleet",
+		"device_type":  "raspberrypi4-64",
+	})
+
+	var batchID string
+
+	t.Run("Interrupted Batch", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "provision-batch/" + roleName,
+			Data:      map[string]interface{}{"count": 4},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.NotContains(t, resp.Error().Error(), "provisioning-key")
+		message := resp.Error().Error()
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "provision-batches/",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Len(t, resp.Data["keys"], 1)
+
+		batchID = resp.Data["keys"].([]string)[0]
+		require.Contains(t, message, batchID)
+
+		devices, err := s.List(context.Background(), provisionBatchStoragePrefix+batchID+"/")
+		require.NoError(t, err)
+		require.Len(t, devices, 2)
+	})
+
+	t.Run("Resume Batch As Tar", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "provision-batch/" + roleName,
+			Data:      map[string]interface{}{"batch_id": batchID, "format": "tar"},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, 4, resp.Data["completed"])
+
+		archive, err := base64.StdEncoding.DecodeString(resp.Data["archive"].(string))
+		require.NoError(t, err)
+
+		files := 0
+		tr := tar.NewReader(bytes.NewReader(archive))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			require.True(t, strings.HasSuffix(hdr.Name, "/config.json"))
+			files++
+		}
+		require.Equal(t, 4, files)
+	})
+
+	t.Run("Read And Delete Batch", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "provision-batches/" + batchID,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 4, resp.Data["completed"])
+		require.NotContains(t, resp.Data, "configs")
+
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "provision-batches/" + batchID,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+
+		batch, err := getProvisionBatch(context.Background(), s, batchID)
+		require.NoError(t, err)
+		require.Nil(t, batch)
+
+		devices, err := s.List(context.Background(), provisionBatchStoragePrefix+batchID+"/")
+		require.NoError(t, err)
+		require.Empty(t, devices)
+	})
+
+	t.Run("Count Above Maximum", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "provision-batch/" + roleName,
+			Data:      map[string]interface{}{"count": maxProvisionBatchCount + 1},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
@@ -0,0 +1,76 @@
+package balenakeys
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestProvision preregisters a device against a fake balena API
+// and checks the config.json that comes back.
+func TestProvision(t *testing.T) {
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/application": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{"id": 42, "slug": "myorg/myfleet"}},
+		}),
+		"GET user/v1/whoami":                       testJSON(map[string]interface{}{"id": 7}),
+		"POST api-key/application/42/provisioning": testJSON("provisioning-key"),
+		"GET v6/api_key":                           testJSON(map[string]interface{}{"d": []interface{}{}}),
+		"POST device/register": func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "provisioning-key", r.URL.Query().Get("apikey"))
+
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			require.Equal(t, "raspberrypi4-64", body["device_type"])
+
+			testJSON(map[string]interface{}{"id": 1001, "uuid": body["uuid"]})(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey": "test-key",
+		"fleet":        "myorg/myfleet",
+		"device_type":  "raspberrypi4-64",
+	})
+
+	t.Run("Provision Device", func(t *testing.T) {
+		resp, err := testProvision(t, b, s, roleName)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		config := resp.Data["config"].(map[string]interface{})
+		require.Equal(t, 42, config["applicationId"])
+		require.Equal(t, "raspberrypi4-64", config["deviceType"])
+		require.Equal(t, 1001, config["deviceId"])
+		require.Equal(t, srv.URL, config["apiEndpoint"])
+		require.Equal(t, resp.Data["uuid"], config["uuid"])
+		require.Len(t, config["uuid"], 32)
+		require.Len(t, config["deviceApiKey"], 32)
+	})
+
+	t.Run("Role Without Device Type", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, "no-device-type", map[string]interface{}{
+			"balenaApiKey": "test-key",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testProvision(t, b, s, "no-device-type")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+// Utility function to provision a device and return any errors
+func testProvision(t *testing.T, b *balenaBackend, s logical.Storage, name string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "provision/" + name,
+		Storage:   s,
+	})
+}
@@ -0,0 +1,111 @@
+package balenakeys
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathPublicURL extends the Vault API with a `/public-url`
+// endpoint that enables a device's public URL under a lease.
+func pathPublicURL(b *balenaBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "public-url/" + roleNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role",
+				Required:    true,
+			},
+			"device_uuid": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "UUID of the device to enable the public URL of",
+				Required:    true,
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Length of the public URL lease. If not set or set to 0, will use the role's ttl",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathPublicURLWrite,
+			},
+		},
+		HelpSynopsis:    pathPublicURLHelpSyn,
+		HelpDescription: pathPublicURLHelpDesc,
+	}
+}
+
+// pathPublicURLWrite turns on a device's public URL until the returned
+// lease ends
+func (b *balenaBackend) pathPublicURLWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleEntry, resp, err := b.getIssuingRole(ctx, req.Storage, d.Get("name").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	ttl := b.leaseTTL(d, roleEntry)
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	device, resp, err := roleDevice(ctx, client, roleEntry, d.Get("device_uuid").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	publicURL, err := devicePublicURL(config, device.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.enablePublicURL(ctx, req.Storage, client, device.ID); err != nil {
+		return nil, err
+	}
+
+	resp = b.Secret(balenaPublicURLType).Response(map[string]interface{}{
+		"url":         publicURL,
+		"device_uuid": device.UUID,
+	}, map[string]interface{}{
+		"device_id": device.ID,
+		"role":      roleEntry.Name,
+		"ttl":       ttl,
+		"max_ttl":   roleEntry.MaxTTL,
+	})
+
+	resp.Secret.TTL = ttl
+
+	if roleEntry.MaxTTL > 0 {
+		resp.Secret.MaxTTL = roleEntry.MaxTTL
+	}
+
+	if err := trackRoleLease(ctx, req.Storage, resp); err != nil {
+		if relErr := b.releasePublicURL(ctx, req.Storage, client, device.ID); relErr != nil {
+			b.Logger().Error("error removing untracked public url", "device_id", device.ID, "error", relErr)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+const pathPublicURLHelpSyn = `
+Enable a device's public URL under a lease.
+`
+
+const pathPublicURLHelpDesc = `
+This path turns on the public URL of the device given as "device_uuid",
+using the role's balena key and limited by the role's "allowed_fleets"
+and "allowed_device_uuids". The response contains the public URL. The URL
+is turned off again once every lease on the device has been revoked or has
+expired, unless it was already on before the first of them.
+`
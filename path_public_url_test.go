@@ -0,0 +1,127 @@
+package balenakeys
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPublicURL turns a device's public URL on and off again
+// against a fake balena API.
+func TestPublicURL(t *testing.T) {
+	var accessible []bool
+	wasAccessible := false
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/device": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{
+				"id":                      1001,
+				"uuid":                    "0123456789abcdef0123456789abcdef",
+				"belongs_to__application": []map[string]interface{}{{"id": 42, "slug": "myorg/myfleet"}},
+			}},
+		}),
+		"GET v6/device(1001)": func(w http.ResponseWriter, r *http.Request) {
+			testJSON(map[string]interface{}{
+				"d": []map[string]interface{}{{"is_web_accessible": wasAccessible}},
+			})(w, r)
+		},
+		"PATCH v6/device(1001)": func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]bool
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			accessible = append(accessible, body["is_web_accessible"])
+
+			testJSON(nil)(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":         "test-key",
+		"allowed_device_uuids": "0123456789abcdef0123456789abcdef",
+	})
+
+	t.Run("Device Not Allowed", func(t *testing.T) {
+		resp, err := testPublicURL(t, b, s, "fedcba9876543210fedcba9876543210")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	resp, err := testPublicURL(t, b, s, "0123456789abcdef0123456789abcdef")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, "https://0123456789abcdef0123456789abcdef.devices.127.0.0.1", resp.Data["url"])
+	require.Equal(t, []bool{true}, accessible)
+
+	t.Run("Role Delete Refused", func(t *testing.T) {
+		resp, err := testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	require.NoError(t, testRevokePublicURL(t, b, s, resp))
+	require.Equal(t, []bool{true, false}, accessible)
+
+	t.Run("Overlapping Leases", func(t *testing.T) {
+		accessible = nil
+
+		first, err := testPublicURL(t, b, s, "0123456789abcdef0123456789abcdef")
+		require.NoError(t, err)
+		require.False(t, first.IsError())
+
+		second, err := testPublicURL(t, b, s, "0123456789abcdef0123456789abcdef")
+		require.NoError(t, err)
+		require.False(t, second.IsError())
+
+		require.NoError(t, testRevokePublicURL(t, b, s, first))
+		require.Equal(t, []bool{true, true}, accessible)
+
+		require.NoError(t, testRevokePublicURL(t, b, s, second))
+		require.Equal(t, []bool{true, true, false}, accessible)
+	})
+
+	t.Run("Enabled Before Lease", func(t *testing.T) {
+		accessible = nil
+		wasAccessible = true
+
+		resp, err := testPublicURL(t, b, s, "0123456789abcdef0123456789abcdef")
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		require.NoError(t, testRevokePublicURL(t, b, s, resp))
+		require.Equal(t, []bool{true}, accessible)
+
+		entry, err := s.Get(context.Background(), publicURLStoragePath(1001))
+		require.NoError(t, err)
+		require.Nil(t, entry)
+	})
+}
+
+// Utility function to revoke a public URL lease and return any errors
+func testRevokePublicURL(t *testing.T, b *balenaBackend, s logical.Storage, resp *logical.Response) error {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	if err != nil {
+		return err
+	}
+	if resp != nil && resp.IsError() {
+		return resp.Error()
+	}
+	return nil
+}
+
+// Utility function to enable a device's public URL and return any errors
+func testPublicURL(t *testing.T, b *balenaBackend, s logical.Storage, deviceUUID string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "public-url/" + roleName,
+		Data:      map[string]interface{}{"device_uuid": deviceUUID},
+		Storage:   s,
+	})
+}
@@ -0,0 +1,177 @@
+package balenakeys
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathReleasePin extends the Vault API with a `/release-pin`
+// endpoint that pins devices to a release under a lease.
+func pathReleasePin(b *balenaBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "release-pin/" + roleNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role",
+				Required:    true,
+			},
+			"commit": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Full or abbreviated commit of the release to pin the devices to",
+				Required:    true,
+			},
+			"device_uuid": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "UUID of the device to pin",
+			},
+			"fleet": {
+				Type:        framework.TypeString,
+				Description: "Slug or ID of the fleet to select devices by tag in",
+			},
+			"tag": {
+				Type:        framework.TypeString,
+				Description: "Tag, as key or key=value, selecting the devices in fleet to pin",
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Length of the release pin lease. If not set or set to 0, will use the role's ttl",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathReleasePinWrite,
+			},
+		},
+		HelpSynopsis:    pathReleasePinHelpSyn,
+		HelpDescription: pathReleasePinHelpDesc,
+	}
+}
+
+// pathReleasePinWrite records the current pins of the selected devices,
+// then pins them to the requested release until the lease ends
+func (b *balenaBackend) pathReleasePinWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	commit := strings.TrimSpace(d.Get("commit").(string))
+	if !releaseCommitRegex.MatchString(commit) {
+		return logical.ErrorResponse("commit must be a full or abbreviated release commit hash"), nil
+	}
+
+	roleEntry, resp, err := b.getIssuingRole(ctx, req.Storage, d.Get("name").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	ttl := b.leaseTTL(d, roleEntry)
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, resp, err := roleDevices(ctx, client, roleEntry, d.Get("device_uuid").(string), d.Get("fleet").(string), d.Get("tag").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	// the selected devices always share a fleet, either the single
+	// device's or the one the tag was looked up in
+	fleet := devices[0].fleet()
+	release, err := getFleetRelease(ctx, client, fleet.ID, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	if release == nil {
+		return logical.ErrorResponse("no successful release with commit %q in fleet %q", commit, fleet.Slug), nil
+	}
+
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+
+	// a second pin would record the first one's release as the device's
+	// previous pin, and whichever lease ended first would undo the other
+	pinned, err := pinnedDevice(ctx, req.Storage, devices)
+	if err != nil {
+		return nil, err
+	}
+
+	if pinned != "" {
+		return logical.ErrorResponse("device %q already has an active release pin", pinned), nil
+	}
+
+	pin := &balenaReleasePin{
+		ID:        uuid.New().String(),
+		Role:      roleEntry.Name,
+		ReleaseID: release.ID,
+		Commit:    release.Commit,
+	}
+	if err := recordReleasePin(ctx, client, pin, devices); err != nil {
+		return nil, err
+	}
+
+	// the previous pins are stored before anything changes, so a failed
+	// apply can always be undone
+	if err := putReleasePin(ctx, req.Storage, pin); err != nil {
+		return nil, err
+	}
+
+	if err := applyReleasePin(ctx, client, pin); err != nil {
+		if restoreErr := restoreReleasePin(ctx, client, pin); restoreErr != nil {
+			b.Logger().Error("error restoring partially applied release pin, will retry", "pin_id", pin.ID, "error", restoreErr)
+
+			// no lease will revoke the pin, so the periodic function
+			// restores it instead
+			pin.Orphaned = true
+			if putErr := putReleasePin(ctx, req.Storage, pin); putErr != nil {
+				b.Logger().Error("error marking release pin for restore", "pin_id", pin.ID, "error", putErr)
+			}
+			return nil, err
+		}
+		if delErr := req.Storage.Delete(ctx, releasePinStoragePrefix+pin.ID); delErr != nil {
+			b.Logger().Error("error removing release pin", "pin_id", pin.ID, "error", delErr)
+		}
+		return nil, err
+	}
+
+	deviceUUIDs := make([]string, 0, len(devices))
+	for _, device := range devices {
+		deviceUUIDs = append(deviceUUIDs, device.UUID)
+	}
+
+	resp = b.Secret(balenaReleasePinType).Response(map[string]interface{}{
+		"devices": deviceUUIDs,
+		"commit":  release.Commit,
+	}, map[string]interface{}{
+		"pin_id":  pin.ID,
+		"role":    roleEntry.Name,
+		"ttl":     ttl,
+		"max_ttl": roleEntry.MaxTTL,
+	})
+
+	resp.Secret.TTL = ttl
+
+	if roleEntry.MaxTTL > 0 {
+		resp.Secret.MaxTTL = roleEntry.MaxTTL
+	}
+
+	return resp, nil
+}
+
+const pathReleasePinHelpSyn = `
+Temporarily pin devices to a release.
+`
+
+const pathReleasePinHelpDesc = `
+This path pins the device given as "device_uuid", or every device in
+"fleet" carrying "tag", to the successful release with "commit", using the
+role's balena key and limited by the role's "allowed_fleets" and
+"allowed_device_uuids". The release each device was pinned to before, or
+whether it tracked the fleet's latest release, is recorded and restored
+when the lease is revoked or expires. A device can only be held by one
+release pin at a time. If pinning fails part way and the devices cannot be
+restored right away, the restore is retried in the background.
+`
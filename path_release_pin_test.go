@@ -0,0 +1,133 @@
+package balenakeys
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestReleasePin pins a device to a release and checks its previous pin is
+// restored on revocation, against a fake balena API.
+func TestReleasePin(t *testing.T) {
+	var pins []interface{}
+	failPatches := 0
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/device": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{
+				"id":                      1001,
+				"uuid":                    "0123456789abcdef0123456789abcdef",
+				"belongs_to__application": []map[string]interface{}{{"id": 42, "slug": "myorg/myfleet"}},
+			}},
+		}),
+		"GET v6/device(1001)": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{
+				"is_pinned_on__release": map[string]interface{}{"__id": 5},
+			}},
+		}),
+		"GET v6/release": func(w http.ResponseWriter, r *http.Request) {
+			d := []map[string]interface{}{}
+			if r.URL.Query().Get("$filter") == "(belongs_to__application eq 42) and (status eq 'success') and startswith(commit,'abcdef1')" {
+				d = append(d, map[string]interface{}{"id": 7, "commit": "abcdef1234567890abcdef1234567890"})
+			}
+			testJSON(map[string]interface{}{"d": d})(w, r)
+		},
+		"PATCH v6/device(1001)": func(w http.ResponseWriter, r *http.Request) {
+			if failPatches > 0 {
+				failPatches--
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			pins = append(pins, body["is_pinned_on__release"])
+
+			testJSON(nil)(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":   "test-key",
+		"allowed_fleets": "myorg/myfleet",
+	})
+
+	t.Run("Invalid Commit", func(t *testing.T) {
+		resp, err := testReleasePin(t, b, s, "0123456789abcdef0123456789abcdef", "latest")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Release Not Found", func(t *testing.T) {
+		resp, err := testReleasePin(t, b, s, "0123456789abcdef0123456789abcdef", "1234567")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Empty(t, pins)
+	})
+
+	resp, err := testReleasePin(t, b, s, "0123456789abcdef0123456789abcdef", "abcdef1")
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, "abcdef1234567890abcdef1234567890", resp.Data["commit"])
+	require.Equal(t, []interface{}{float64(7)}, pins)
+
+	t.Run("Device Already Pinned", func(t *testing.T) {
+		second, err := testReleasePin(t, b, s, "0123456789abcdef0123456789abcdef", "abcdef1")
+		require.NoError(t, err)
+		require.True(t, second.IsError())
+		require.Equal(t, []interface{}{float64(7)}, pins)
+	})
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+	require.Equal(t, []interface{}{float64(7), float64(5)}, pins)
+
+	keys, err := s.List(context.Background(), releasePinStoragePrefix)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	t.Run("Orphaned Pin", func(t *testing.T) {
+		pins = nil
+
+		// both the pin and the restore right after it fail
+		failPatches = 2
+		_, err := testReleasePin(t, b, s, "0123456789abcdef0123456789abcdef", "abcdef1")
+		require.Error(t, err)
+		require.Empty(t, pins)
+
+		keys, err := s.List(context.Background(), releasePinStoragePrefix)
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+
+		// the restore needs the role's key
+		resp, err := testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		require.NoError(t, b.reconcileReleasePins(context.Background(), s))
+		require.Equal(t, []interface{}{float64(5)}, pins)
+
+		keys, err = s.List(context.Background(), releasePinStoragePrefix)
+		require.NoError(t, err)
+		require.Empty(t, keys)
+	})
+}
+
+// Utility function to pin a device to a release and return any errors
+func testReleasePin(t *testing.T, b *balenaBackend, s logical.Storage, deviceUUID string, commit string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "release-pin/" + roleName,
+		Data:      map[string]interface{}{"device_uuid": deviceUUID, "commit": commit},
+		Storage:   s,
+	})
+}
@@ -0,0 +1,272 @@
+package balenakeys
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	roleVersionStoragePrefix = "role-version/"
+
+	// maxRoleVersions is how many earlier versions of a role are kept
+	maxRoleVersions = 20
+)
+
+// pathRoleVersions extends the Vault API with endpoints to
+// list the earlier versions of a role and to roll a role
+// back to one of them.
+func pathRoleVersions(b *balenaBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "role/" + roleNameRegex("name") + "/versions/?$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the role",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathRoleVersionsList,
+				},
+			},
+			HelpSynopsis:    pathRoleVersionsHelpSynopsis,
+			HelpDescription: pathRoleVersionsHelpDescription,
+		},
+		{
+			Pattern: "role/" + roleNameRegex("name") + "/rollback$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the role",
+					Required:    true,
+				},
+				"version": {
+					Type:        framework.TypeInt,
+					Description: "Version of the role to restore",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRoleRollback,
+				},
+			},
+			HelpSynopsis:    pathRoleRollbackHelpSynopsis,
+			HelpDescription: pathRoleRollbackHelpDescription,
+		},
+	}
+}
+
+// pathRoleVersionsList lists every version of a role, including the current one,
+// together with who wrote each version and when
+func (b *balenaBackend) pathRoleVersionsList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	current, err := b.getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if current == nil {
+		return nil, nil
+	}
+
+	versions, err := listRoleVersions(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(versions)+1)
+	keyInfo := make(map[string]interface{}, len(versions)+1)
+	for _, entry := range append(versions, current) {
+		key := strconv.Itoa(entry.Version)
+		keys = append(keys, key)
+		keyInfo[key] = map[string]interface{}{
+			"updated_by":        entry.UpdatedBy,
+			"updated_by_entity": entry.UpdatedByEntity,
+			"updated_at":        entry.UpdatedAt,
+			"current":           entry == current,
+		}
+	}
+
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+// pathRoleRollback makes an earlier version of a role current again. The
+// rollback is itself recorded as a new version.
+func (b *balenaBackend) pathRoleRollback(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	version := d.Get("version").(int)
+
+	current, err := b.getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if current == nil {
+		return logical.ErrorResponse("role %q not found", name), nil
+	}
+
+	if version == current.Version {
+		return logical.ErrorResponse("version %d is already the current version", version), nil
+	}
+
+	target, err := getRoleVersion(ctx, req.Storage, name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if target == nil {
+		return logical.ErrorResponse("version %d of role %q not found", version, name), nil
+	}
+
+	if err := target.validate(); err != nil {
+		return logical.ErrorResponse("version %d of role %q can't be restored: %s", version, name, err), nil
+	}
+
+	if err := b.replaceRole(ctx, req, current, target); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: target.toResponseData(),
+	}, nil
+}
+
+// roleVersionPath returns the storage path of an earlier role version
+func roleVersionPath(name string, version int) string {
+	return roleVersionStoragePrefix + name + "/" + strconv.Itoa(version)
+}
+
+// setRoleVersion adds an earlier version of a role to the Vault storage API
+func setRoleVersion(ctx context.Context, s logical.Storage, roleEntry *balenaRoleEntry) error {
+	entry, err := logical.StorageEntryJSON(roleVersionPath(roleEntry.Name, roleEntry.Version), roleEntry)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// pruneRoleVersions removes the oldest earlier versions of a role beyond
+// maxRoleVersions
+func pruneRoleVersions(ctx context.Context, s logical.Storage, name string) error {
+	keys, err := s.List(ctx, roleVersionStoragePrefix+name+"/")
+	if err != nil {
+		return err
+	}
+
+	versions := make([]int, 0, len(keys))
+	for _, key := range keys {
+		version, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	if len(versions) <= maxRoleVersions {
+		return nil
+	}
+
+	sort.Ints(versions)
+	for _, version := range versions[:len(versions)-maxRoleVersions] {
+		if err := s.Delete(ctx, roleVersionPath(name, version)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getRoleVersion gets an earlier version of a role from the Vault storage API
+func getRoleVersion(ctx context.Context, s logical.Storage, name string, version int) (*balenaRoleEntry, error) {
+	entry, err := s.Get(ctx, roleVersionPath(name, version))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var role balenaRoleEntry
+	if err := entry.DecodeJSON(&role); err != nil {
+		return nil, fmt.Errorf("error reading role version: %w", err)
+	}
+	return &role, nil
+}
+
+// listRoleVersions returns the earlier versions of a role, oldest first
+func listRoleVersions(ctx context.Context, s logical.Storage, name string) ([]*balenaRoleEntry, error) {
+	keys, err := s.List(ctx, roleVersionStoragePrefix+name+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]*balenaRoleEntry, 0, len(keys))
+	for _, key := range keys {
+		version, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+
+		role, err := getRoleVersion(ctx, s, name, version)
+		if err != nil {
+			return nil, err
+		}
+		if role != nil {
+			versions = append(versions, role)
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+
+	return versions, nil
+}
+
+// deleteRoleVersions removes the version history of a role
+func deleteRoleVersions(ctx context.Context, s logical.Storage, name string) error {
+	keys, err := s.List(ctx, roleVersionStoragePrefix+name+"/")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		// nested roles keep their own history
+		if strings.HasSuffix(key, "/") {
+			continue
+		}
+		if err := s.Delete(ctx, roleVersionStoragePrefix+name+"/"+key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const (
+	pathRoleVersionsHelpSynopsis    = `List the versions of a balena role.`
+	pathRoleVersionsHelpDescription = `
+Every write to a role keeps the previous role as a numbered version, up
+to the 20 most recent ones. This path lists all versions, including the
+current one, together with who wrote each version and when.
+`
+
+	pathRoleRollbackHelpSynopsis    = `Restore an earlier version of a balena role.`
+	pathRoleRollbackHelpDescription = `
+This path makes the given version of the role current again. The rollback
+is recorded as a new version, so it can itself be undone. A version that
+would no longer be accepted as a role write can't be restored.
+`
+)
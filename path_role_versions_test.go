@@ -0,0 +1,112 @@
+package balenakeys
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRoleVersions uses a mock backend to check that role
+// writes are versioned and can be rolled back.
+func TestRoleVersions(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	t.Run("Write Role Twice", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"balenaApiKey": "test-key",
+			"ttl":          "60",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleUpdate(t, b, s, map[string]interface{}{
+			"balenaApiKey": "test-key",
+			"ttl":          "120",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleRead(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, 2, resp.Data["version"])
+		require.Equal(t, float64(120), resp.Data["ttl"])
+	})
+
+	t.Run("List Versions", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "role/" + roleName + "/versions/",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"1", "2"}, resp.Data["keys"])
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		resp, err := testRoleRollback(t, b, s, 1)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, 3, resp.Data["version"])
+		require.Equal(t, float64(60), resp.Data["ttl"])
+	})
+
+	t.Run("Rollback Missing Version", func(t *testing.T) {
+		resp, err := testRoleRollback(t, b, s, 10)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Rollback Invalid Version", func(t *testing.T) {
+		require.NoError(t, setRoleVersion(context.Background(), s, &balenaRoleEntry{
+			Name:                 roleName,
+			BalenaApiKey:         "test-key",
+			CredentialType:       provisioningKeyCredentialType,
+			CacheRefreshFraction: defaultCacheRefreshFraction,
+			Version:              9,
+		}))
+
+		resp, err := testRoleRollback(t, b, s, 9)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "fleet is required")
+
+		require.NoError(t, s.Delete(context.Background(), roleVersionPath(roleName, 9)))
+	})
+
+	t.Run("History Capped", func(t *testing.T) {
+		for i := 0; i < maxRoleVersions; i++ {
+			resp, err := testTokenRoleUpdate(t, b, s, map[string]interface{}{
+				"balenaApiKey": "test-key",
+			})
+			require.NoError(t, err)
+			require.Nil(t, resp)
+		}
+
+		versions, err := listRoleVersions(context.Background(), s, roleName)
+		require.NoError(t, err)
+		require.Len(t, versions, maxRoleVersions)
+		require.Equal(t, 3, versions[0].Version)
+	})
+
+	t.Run("Delete Removes Versions", func(t *testing.T) {
+		_, err := testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+
+		versions, err := listRoleVersions(context.Background(), s, roleName)
+		require.NoError(t, err)
+		require.Empty(t, versions)
+	})
+}
+
+// Utility function to roll a role back and return any errors
+func testRoleRollback(t *testing.T, b *balenaBackend, s logical.Storage, version int) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "role/" + roleName + "/rollback",
+		Data:      map[string]interface{}{"version": version},
+		Storage:   s,
+	})
+}
@@ -2,13 +2,56 @@ package balenakeys
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/hashicorp/go-secure-stdlib/strutil"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+const (
+	userKeyCredentialType         = "user_key"
+	deviceKeyCredentialType       = "device_key"
+	provisioningKeyCredentialType = "provisioning_key"
+	sshKeyCredentialType          = "ssh_key"
+	registryCredentialType        = "registry_token"
+	fleetAccessCredentialType     = "fleet_access"
+	teamAccessCredentialType      = "team_access"
+	openBalenaUserCredentialType  = "openbalena_user"
+	ephemeralDeviceCredentialType = "ephemeral_device"
+	ephemeralFleetCredentialType  = "ephemeral_fleet"
+)
+
+// credentialTypes lists the kinds of credentials a role can issue
+var credentialTypes = []string{
+	userKeyCredentialType,
+	deviceKeyCredentialType,
+	provisioningKeyCredentialType,
+	sshKeyCredentialType,
+	registryCredentialType,
+	fleetAccessCredentialType,
+	teamAccessCredentialType,
+	openBalenaUserCredentialType,
+	ephemeralDeviceCredentialType,
+	ephemeralFleetCredentialType,
+}
+
+// roleNameSegments matches one or more slash separated name segments,
+// so roles can be nested such as "factory/line-3"
+const roleNameSegments = `\w(([\w-.]+)?\w)?(/\w(([\w-.]+)?\w)?)*`
+
+// reservedRoleNameSegments cannot end a nested role name, as they are the
+// version endpoints of the parent role
+var reservedRoleNameSegments = []string{"versions", "rollback"}
+
+// roleNameRegex returns a named capture group for a role name
+func roleNameRegex(name string) string {
+	return "(?P<" + name + ">" + roleNameSegments + ")"
+}
+
 // balenaRoleEntry defines the data required
 // for a Vault role to access and call the balena
 // token endpoints
@@ -22,6 +65,151 @@ type balenaRoleEntry struct {
 	KeyDesc      string        `json:"key_desc,omitempty"`
 	TTL          time.Duration `json:"ttl"`
 	MaxTTL       time.Duration `json:"max_ttl"`
+
+	// CredentialType selects what creds issues for the role, such as a
+	// full user key or a key scoped to one device.
+	CredentialType string `json:"credential_type"`
+
+	// AllowedFleets and AllowedDeviceUUIDs limit the devices a role can
+	// issue credentials for. Empty lists allow every fleet or device.
+	AllowedFleets      []string `json:"allowed_fleets,omitempty"`
+	AllowedDeviceUUIDs []string `json:"allowed_device_uuids,omitempty"`
+
+	// Fleet is the slug or ID of the fleet a provisioning_key role issues
+	// keys for. SingleUse keys are revoked once a device has registered.
+	Fleet     string `json:"fleet,omitempty"`
+	SingleUse bool   `json:"single_use,omitempty"`
+
+	// DeviceType is the device type slug used when the role
+	// preregisters devices in its fleet.
+	DeviceType string `json:"device_type,omitempty"`
+
+	// RegistryRepositories lists the container registry repositories a
+	// registry_token role may scope tokens to, and RegistryPush allows
+	// pushing to them as well as pulling.
+	RegistryRepositories []string `json:"registry_repositories,omitempty"`
+	RegistryPush         bool     `json:"registry_push,omitempty"`
+
+	// MembershipRole is the fleet membership role a fleet_access role grants
+	// to the balena user named in the requesting entity's EntityMetadataKey.
+	MembershipRole    string `json:"membership_role,omitempty"`
+	EntityMetadataKey string `json:"entity_metadata_key,omitempty"`
+
+	// Organization and Team name the organization team a team_access
+	// role adds the entity's balena user to.
+	Organization string `json:"organization,omitempty"`
+	Team         string `json:"team,omitempty"`
+
+	// Organizations are the handles of the organizations an openbalena_user
+	// role adds its temporary users to, with OrganizationRole membership.
+	Organizations    []string `json:"organizations,omitempty"`
+	OrganizationRole string   `json:"organization_role,omitempty"`
+	UserEmailDomain  string   `json:"user_email_domain,omitempty"`
+
+	// FleetNameTemplate names the fleets an ephemeral_fleet role creates in
+	// Organization, which get the variables of TemplateFleet.
+	FleetNameTemplate string `json:"fleet_name_template,omitempty"`
+	TemplateFleet     string `json:"template_fleet,omitempty"`
+
+	// CacheCredentials hands out a shared, already-issued key until it
+	// reaches CacheRefreshFraction of its lifetime.
+	CacheCredentials     bool    `json:"cache_credentials"`
+	CacheRefreshFraction float64 `json:"cache_refresh_fraction,omitempty"`
+
+	// PoolSize keys are kept pre-created so creds never waits on balena.
+	PoolSize    int           `json:"pool_size,omitempty"`
+	PoolMinWarm int           `json:"pool_min_warm,omitempty"`
+	PoolMaxAge  time.Duration `json:"pool_max_age,omitempty"`
+
+	// Disabled stops the role from issuing new credentials while keeping
+	// its configuration and existing leases.
+	Disabled bool `json:"disabled"`
+
+	// Version metadata records who wrote this version of the role and when.
+	Version         int       `json:"version"`
+	UpdatedBy       string    `json:"updated_by,omitempty"`
+	UpdatedByEntity string    `json:"updated_by_entity,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// validate checks that the settings of the role fit together. It is run on
+// every write and on rollbacks, as an earlier version may no longer be valid.
+func (r *balenaRoleEntry) validate() error {
+	if r.MaxTTL != 0 && r.TTL > r.MaxTTL {
+		return errors.New("ttl cannot be greater than max_ttl")
+	}
+
+	if !strutil.StrListContains(credentialTypes, r.CredentialType) {
+		return fmt.Errorf("credential_type must be one of %s", strings.Join(credentialTypes, ", "))
+	}
+
+	switch r.CredentialType {
+	case provisioningKeyCredentialType:
+		if r.Fleet == "" {
+			return fmt.Errorf("fleet is required for %s roles", provisioningKeyCredentialType)
+		}
+	case ephemeralDeviceCredentialType:
+		if r.Fleet == "" || r.DeviceType == "" {
+			return fmt.Errorf("fleet and device_type are required for %s roles", ephemeralDeviceCredentialType)
+		}
+	case registryCredentialType:
+		if len(r.RegistryRepositories) == 0 {
+			return fmt.Errorf("registry_repositories is required for %s roles", registryCredentialType)
+		}
+	case fleetAccessCredentialType:
+		if len(r.AllowedFleets) == 0 {
+			return fmt.Errorf("allowed_fleets is required for %s roles", fleetAccessCredentialType)
+		}
+	case ephemeralFleetCredentialType:
+		if !orgHandleRegex.MatchString(r.Organization) || r.DeviceType == "" {
+			return fmt.Errorf("organization and device_type are required for %s roles", ephemeralFleetCredentialType)
+		}
+	case teamAccessCredentialType:
+		if !orgHandleRegex.MatchString(r.Organization) || r.Team == "" {
+			return fmt.Errorf("organization and team are required for %s roles", teamAccessCredentialType)
+		}
+	}
+
+	if r.OrganizationRole != "" && !strutil.StrListContains(organizationRoles, r.OrganizationRole) {
+		return fmt.Errorf("organization_role must be one of %s", strings.Join(organizationRoles, ", "))
+	}
+
+	for _, handle := range r.Organizations {
+		if !orgHandleRegex.MatchString(handle) {
+			return fmt.Errorf("invalid organization %q", handle)
+		}
+	}
+
+	if r.MembershipRole != "" && !strutil.StrListContains(membershipRoles, r.MembershipRole) {
+		return fmt.Errorf("membership_role must be one of %s", strings.Join(membershipRoles, ", "))
+	}
+
+	if r.CacheRefreshFraction <= 0 || r.CacheRefreshFraction > 1 {
+		return errors.New("cache_refresh_fraction must be greater than 0 and at most 1")
+	}
+
+	if r.PoolSize < 0 || r.PoolMinWarm < 0 || r.PoolMaxAge < 0 {
+		return errors.New("pool_size, pool_min_warm and pool_max_age cannot be negative")
+	}
+
+	if r.PoolMinWarm > r.PoolSize {
+		return errors.New("pool_min_warm cannot be greater than pool_size")
+	}
+
+	if r.CredentialType != userKeyCredentialType && (r.CacheCredentials || r.PoolSize > 0) {
+		return fmt.Errorf("cache_credentials and pool_size are only supported for %s roles", userKeyCredentialType)
+	}
+
+	return nil
+}
+
+// poolMinWarm returns the number of warm keys below which the pool is
+// refilled, defaulting to the pool size
+func (r *balenaRoleEntry) poolMinWarm() int {
+	if r.PoolMinWarm > 0 {
+		return r.PoolMinWarm
+	}
+	return r.PoolSize
 }
 
 // toResponseData returns response data for a role
@@ -30,6 +218,41 @@ func (r *balenaRoleEntry) toResponseData() map[string]interface{} {
 		"name":    r.Name,
 		"ttl":     r.TTL.Seconds(),
 		"max_ttl": r.MaxTTL.Seconds(),
+
+		"credential_type":      r.CredentialType,
+		"allowed_fleets":       r.AllowedFleets,
+		"allowed_device_uuids": r.AllowedDeviceUUIDs,
+		"fleet":                r.Fleet,
+		"single_use":           r.SingleUse,
+		"device_type":          r.DeviceType,
+
+		"registry_repositories": r.RegistryRepositories,
+		"registry_push":         r.RegistryPush,
+
+		"membership_role":     r.MembershipRole,
+		"entity_metadata_key": r.EntityMetadataKey,
+		"organization":        r.Organization,
+		"team":                r.Team,
+
+		"organizations":     r.Organizations,
+		"organization_role": r.OrganizationRole,
+		"user_email_domain": r.UserEmailDomain,
+
+		"fleet_name_template": r.FleetNameTemplate,
+		"template_fleet":      r.TemplateFleet,
+
+		"cache_credentials":      r.CacheCredentials,
+		"cache_refresh_fraction": r.CacheRefreshFraction,
+
+		"pool_size":     r.PoolSize,
+		"pool_min_warm": r.PoolMinWarm,
+		"pool_max_age":  r.PoolMaxAge.Seconds(),
+
+		"disabled": r.Disabled,
+
+		"version":    r.Version,
+		"updated_by": r.UpdatedBy,
+		"updated_at": r.UpdatedAt,
 	}
 	return respData
 }
@@ -42,7 +265,7 @@ func (r *balenaRoleEntry) toResponseData() map[string]interface{} {
 func pathRole(b *balenaBackend) []*framework.Path {
 	return []*framework.Path{
 		{
-			Pattern: "role/" + framework.GenericNameRegex("name"),
+			Pattern: "role/" + roleNameRegex("name"),
 			Fields: map[string]*framework.FieldSchema{
 				"name": {
 					Type:        framework.TypeLowerCaseString,
@@ -66,6 +289,101 @@ func pathRole(b *balenaBackend) []*framework.Path {
 					Type:        framework.TypeDurationSecond,
 					Description: "Maximum time for role. If not set or set to 0. will use system default",
 				},
+				"credential_type": {
+					Type:          framework.TypeString,
+					Description:   "Type of credential issued by the role: user_key, device_key, provisioning_key, ssh_key, registry_token, fleet_access, team_access, openbalena_user, ephemeral_device or ephemeral_fleet. Defaults to user_key",
+					Default:       userKeyCredentialType,
+					AllowedValues: []interface{}{userKeyCredentialType, deviceKeyCredentialType, provisioningKeyCredentialType, sshKeyCredentialType, registryCredentialType, fleetAccessCredentialType, teamAccessCredentialType, openBalenaUserCredentialType, ephemeralDeviceCredentialType, ephemeralFleetCredentialType},
+				},
+				"fleet": {
+					Type:        framework.TypeString,
+					Description: "Slug or ID of the fleet the role issues provisioning keys for",
+				},
+				"single_use": {
+					Type:        framework.TypeBool,
+					Description: "Revoke a provisioning key once a device has registered in the fleet with it",
+				},
+				"device_type": {
+					Type:        framework.TypeString,
+					Description: "Device type slug of devices preregistered in the role's fleet",
+				},
+				"registry_repositories": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Registry repositories a registry_token role may issue tokens for. Supports a trailing * glob",
+				},
+				"registry_push": {
+					Type:        framework.TypeBool,
+					Description: "Allow registry tokens to push to the repositories as well as pull",
+				},
+				"membership_role": {
+					Type:        framework.TypeString,
+					Description: "Fleet membership role a fleet_access role grants: developer, operator or observer. Defaults to observer",
+				},
+				"entity_metadata_key": {
+					Type:        framework.TypeString,
+					Description: "Vault entity metadata key holding the balena username for fleet_access and team_access roles. Defaults to balena_username",
+				},
+				"organization": {
+					Type:        framework.TypeString,
+					Description: "Handle of the organization owning the team of a team_access role",
+				},
+				"team": {
+					Type:        framework.TypeString,
+					Description: "Name of the organization team a team_access role grants membership of",
+				},
+				"organizations": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Handles of the organizations an openbalena_user role adds its users to",
+				},
+				"organization_role": {
+					Type:        framework.TypeString,
+					Description: "Organization membership role of openbalena_user users: member or administrator. Defaults to member",
+				},
+				"user_email_domain": {
+					Type:        framework.TypeString,
+					Description: "Email domain of openbalena_user users. Defaults to openbalena.local",
+				},
+				"fleet_name_template": {
+					Type:        framework.TypeString,
+					Description: "Name of fleets created by ephemeral_fleet roles, with {{suffix}} and {{random}} placeholders. Defaults to preview-{{random}}",
+				},
+				"template_fleet": {
+					Type:        framework.TypeString,
+					Description: "Slug or ID of a fleet whose variables are copied into fleets created by ephemeral_fleet roles",
+				},
+				"allowed_fleets": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Fleet slugs or IDs the role may issue device credentials for. Empty allows every fleet",
+				},
+				"allowed_device_uuids": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Device UUIDs the role may issue device credentials for. Empty allows every device",
+				},
+				"cache_credentials": {
+					Type:        framework.TypeBool,
+					Description: "Return a shared, cached balena key from creds instead of creating a new key on every read",
+				},
+				"cache_refresh_fraction": {
+					Type:        framework.TypeFloat,
+					Description: "Fraction of the cached key's lifetime after which a new key is created. Defaults to 0.5",
+					Default:     defaultCacheRefreshFraction,
+				},
+				"pool_size": {
+					Type:        framework.TypeInt,
+					Description: "Number of pre-created balena keys to keep in the role's pool. 0 disables the pool",
+				},
+				"pool_min_warm": {
+					Type:        framework.TypeInt,
+					Description: "Refill the pool once fewer than this many keys are left. Defaults to pool_size",
+				},
+				"pool_max_age": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Maximum time a key may wait in the pool before it is deleted. Defaults to 24h",
+				},
+				"disabled": {
+					Type:        framework.TypeBool,
+					Description: "Refuse to issue new credentials from this role. Renewal and revocation keep working",
+				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
 				logical.ReadOperation: &framework.PathOperation{
@@ -85,7 +403,17 @@ func pathRole(b *balenaBackend) []*framework.Path {
 			HelpDescription: pathRoleHelpDescription,
 		},
 		{
-			Pattern: "role/?$",
+			Pattern: "role/(?P<prefix>" + roleNameSegments + "/)?$",
+			Fields: map[string]*framework.FieldSchema{
+				"prefix": {
+					Type:        framework.TypeString,
+					Description: "Only list roles nested under this prefix",
+				},
+				"recursive": {
+					Type:        framework.TypeBool,
+					Description: "List the full names of all nested roles instead of one level",
+				},
+			},
 
 			Operations: map[logical.Operation]framework.OperationHandler{
 				logical.ListOperation: &framework.PathOperation{
@@ -101,7 +429,18 @@ func pathRole(b *balenaBackend) []*framework.Path {
 
 // pathRolesList makes a request to Vault storage to retrieve a list of roles for the backend
 func (b *balenaBackend) pathRolesList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	entries, err := req.Storage.List(ctx, "role/")
+	prefix := d.Get("prefix").(string)
+
+	if d.Get("recursive").(bool) {
+		names, err := listRoles(ctx, req.Storage, prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		return logical.ListResponse(names), nil
+	}
+
+	entries, err := req.Storage.List(ctx, "role/"+prefix)
 	if err != nil {
 		return nil, err
 	}
@@ -132,6 +471,12 @@ func (b *balenaBackend) pathRolesWrite(ctx context.Context, req *logical.Request
 		return logical.ErrorResponse("missing role name"), nil
 	}
 
+	// "role/<name>/versions" and "role/<name>/rollback" would shadow a
+	// nested role of that name
+	if i := strings.LastIndex(name, "/"); i >= 0 && strutil.StrListContains(reservedRoleNameSegments, name[i+1:]) {
+		return logical.ErrorResponse("the last segment of a nested role name cannot be %q", name[i+1:]), nil
+	}
+
 	bToken := d.Get("balenaApiKey").(string)
 
 	if bToken == "" {
@@ -143,8 +488,12 @@ func (b *balenaBackend) pathRolesWrite(ctx context.Context, req *logical.Request
 		return nil, err
 	}
 
+	var previous *balenaRoleEntry
 	if roleEntry == nil {
 		roleEntry = &balenaRoleEntry{}
+	} else {
+		prev := *roleEntry
+		previous = &prev
 	}
 
 	roleEntry.Name = name
@@ -162,27 +511,233 @@ func (b *balenaBackend) pathRolesWrite(ctx context.Context, req *logical.Request
 		roleEntry.MaxTTL = time.Duration(d.Get("max_ttl").(int)) * time.Second
 	}
 
-	if roleEntry.MaxTTL != 0 && roleEntry.TTL > roleEntry.MaxTTL {
-		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
+	if credentialTypeRaw, ok := d.GetOk("credential_type"); ok {
+		roleEntry.CredentialType = credentialTypeRaw.(string)
+	} else if roleEntry.CredentialType == "" {
+		roleEntry.CredentialType = d.Get("credential_type").(string)
+	}
+
+	if fleetsRaw, ok := d.GetOk("allowed_fleets"); ok {
+		roleEntry.AllowedFleets = fleetsRaw.([]string)
+	}
+
+	if devicesRaw, ok := d.GetOk("allowed_device_uuids"); ok {
+		roleEntry.AllowedDeviceUUIDs = devicesRaw.([]string)
+	}
+
+	if fleetRaw, ok := d.GetOk("fleet"); ok {
+		roleEntry.Fleet = fleetRaw.(string)
+	}
+
+	if singleUseRaw, ok := d.GetOk("single_use"); ok {
+		roleEntry.SingleUse = singleUseRaw.(bool)
+	}
+
+	if deviceTypeRaw, ok := d.GetOk("device_type"); ok {
+		roleEntry.DeviceType = deviceTypeRaw.(string)
+	}
+
+	if templateRaw, ok := d.GetOk("fleet_name_template"); ok {
+		roleEntry.FleetNameTemplate = templateRaw.(string)
+	}
+
+	if templateFleetRaw, ok := d.GetOk("template_fleet"); ok {
+		roleEntry.TemplateFleet = templateFleetRaw.(string)
+	}
+
+	if repositoriesRaw, ok := d.GetOk("registry_repositories"); ok {
+		roleEntry.RegistryRepositories = repositoriesRaw.([]string)
+	}
+
+	if pushRaw, ok := d.GetOk("registry_push"); ok {
+		roleEntry.RegistryPush = pushRaw.(bool)
+	}
+
+	if membershipRoleRaw, ok := d.GetOk("membership_role"); ok {
+		roleEntry.MembershipRole = membershipRoleRaw.(string)
+	}
+
+	if metadataKeyRaw, ok := d.GetOk("entity_metadata_key"); ok {
+		roleEntry.EntityMetadataKey = metadataKeyRaw.(string)
+	}
+
+	if organizationRaw, ok := d.GetOk("organization"); ok {
+		roleEntry.Organization = organizationRaw.(string)
+	}
+
+	if teamRaw, ok := d.GetOk("team"); ok {
+		roleEntry.Team = teamRaw.(string)
+	}
+
+	if roleEntry.CredentialType == fleetAccessCredentialType && roleEntry.MembershipRole == "" {
+		roleEntry.MembershipRole = "observer"
+	}
+
+	if roleEntry.CredentialType == ephemeralFleetCredentialType && roleEntry.FleetNameTemplate == "" {
+		roleEntry.FleetNameTemplate = defaultFleetNameTemplate
+	}
+
+	if organizationsRaw, ok := d.GetOk("organizations"); ok {
+		roleEntry.Organizations = organizationsRaw.([]string)
+	}
+
+	if orgRoleRaw, ok := d.GetOk("organization_role"); ok {
+		roleEntry.OrganizationRole = orgRoleRaw.(string)
+	}
+
+	if emailDomainRaw, ok := d.GetOk("user_email_domain"); ok {
+		roleEntry.UserEmailDomain = emailDomainRaw.(string)
+	}
+
+	if (roleEntry.CredentialType == fleetAccessCredentialType || roleEntry.CredentialType == teamAccessCredentialType) && roleEntry.EntityMetadataKey == "" {
+		roleEntry.EntityMetadataKey = defaultEntityMetadataKey
+	}
+
+	if cacheRaw, ok := d.GetOk("cache_credentials"); ok {
+		roleEntry.CacheCredentials = cacheRaw.(bool)
+	}
+
+	if fractionRaw, ok := d.GetOk("cache_refresh_fraction"); ok {
+		roleEntry.CacheRefreshFraction = fractionRaw.(float64)
+	} else if roleEntry.CacheRefreshFraction == 0 {
+		roleEntry.CacheRefreshFraction = d.Get("cache_refresh_fraction").(float64)
+	}
+
+	if disabledRaw, ok := d.GetOk("disabled"); ok {
+		roleEntry.Disabled = disabledRaw.(bool)
 	}
 
-	if err := setRole(ctx, req.Storage, name, roleEntry); err != nil {
+	if poolSizeRaw, ok := d.GetOk("pool_size"); ok {
+		roleEntry.PoolSize = poolSizeRaw.(int)
+	}
+
+	if minWarmRaw, ok := d.GetOk("pool_min_warm"); ok {
+		roleEntry.PoolMinWarm = minWarmRaw.(int)
+	}
+
+	if maxAgeRaw, ok := d.GetOk("pool_max_age"); ok {
+		roleEntry.PoolMaxAge = time.Duration(maxAgeRaw.(int)) * time.Second
+	} else if roleEntry.PoolMaxAge == 0 {
+		roleEntry.PoolMaxAge = defaultPoolMaxAge
+	}
+
+	if err := roleEntry.validate(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if err := b.replaceRole(ctx, req, previous, roleEntry); err != nil {
 		return nil, err
 	}
 
 	return nil, nil
 }
 
+// replaceRole stores roleEntry as the new current version of the role,
+// keeping previous in the role's version history
+func (b *balenaBackend) replaceRole(ctx context.Context, req *logical.Request, previous *balenaRoleEntry, roleEntry *balenaRoleEntry) error {
+	// a changed account key invalidates any key cached or pooled under the
+	// old one, and keys cached or pooled by options now turned off are no
+	// longer handed out
+	if previous != nil {
+		changedKey := previous.BalenaApiKey != roleEntry.BalenaApiKey
+		if changedKey || (previous.CacheCredentials && !roleEntry.CacheCredentials) {
+			if err := b.retireCachedTokens(ctx, req.Storage, previous); err != nil {
+				return err
+			}
+		}
+		if changedKey || roleEntry.PoolSize == 0 {
+			if err := b.drainKeyPool(ctx, req.Storage, previous); err != nil {
+				return err
+			}
+		}
+	}
+
+	roleEntry.Version = 1
+	if previous != nil {
+		if err := setRoleVersion(ctx, req.Storage, previous); err != nil {
+			return err
+		}
+		if err := pruneRoleVersions(ctx, req.Storage, previous.Name); err != nil {
+			return err
+		}
+		roleEntry.Version = previous.Version + 1
+	}
+
+	roleEntry.UpdatedBy = req.DisplayName
+	roleEntry.UpdatedByEntity = req.EntityID
+	roleEntry.UpdatedAt = time.Now().UTC()
+
+	return setRole(ctx, req.Storage, roleEntry.Name, roleEntry)
+}
+
 // pathRolesDelete makes a request to Vault storage to delete a role
 func (b *balenaBackend) pathRolesDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	err := req.Storage.Delete(ctx, "role/"+d.Get("name").(string))
+	name := d.Get("name").(string)
+
+	roleEntry, err := b.getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// revoking what the role handed out needs the role's balena key
+	inUse, err := b.roleInUse(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if inUse != "" {
+		return logical.ErrorResponse("role %q can't be deleted yet: %s", name, inUse), nil
+	}
+
+	if roleEntry != nil {
+		if err := b.deleteCachedTokens(ctx, req.Storage, roleEntry); err != nil {
+			return nil, err
+		}
+		if err := b.drainKeyPool(ctx, req.Storage, roleEntry); err != nil {
+			return nil, err
+		}
+	}
+
+	err = req.Storage.Delete(ctx, "role/"+name)
 	if err != nil {
 		return nil, fmt.Errorf("error deleting balena role: %w", err)
 	}
 
+	if err := deleteRoleVersions(ctx, req.Storage, name); err != nil {
+		return nil, fmt.Errorf("error deleting balena role versions: %w", err)
+	}
+
+	if err := b.deleteRevokedTeamGrants(ctx, req.Storage, name); err != nil {
+		return nil, fmt.Errorf("error deleting balena role team grants: %w", err)
+	}
+
 	return nil, nil
 }
 
+// listRoles returns the full names of all roles nested under prefix,
+// descending into every level of the hierarchy
+func listRoles(ctx context.Context, s logical.Storage, prefix string) ([]string, error) {
+	entries, err := s.List(ctx, "role/"+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry, "/") {
+			nested, err := listRoles(ctx, s, prefix+entry)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, nested...)
+			continue
+		}
+		names = append(names, prefix+entry)
+	}
+
+	return names, nil
+}
+
 // setRole adds the role to the Vault storage API
 func setRole(ctx context.Context, s logical.Storage, name string, roleEntry *balenaRoleEntry) error {
 	entry, err := logical.StorageEntryJSON("role/"+name, roleEntry)
@@ -229,8 +784,69 @@ const (
 	pathRoleHelpDescription = `
 This path allows you to read and write roles used to generate balena tokens.
 You can configure a role to manage a user's token by setting the username field.
+
+The "credential_type" field selects what the creds endpoint issues:
+"user_key" creates a full balena user API key, and "device_key" creates
+an API key for a single device given as "device_uuid". Device keys can be
+limited to "allowed_fleets" and "allowed_device_uuids". A "provisioning_key"
+role issues provisioning keys for "fleet" that expire with their lease, and
+with "single_use" set a key is revoked once a device has registered with it.
+As balena does not record which key registered a device, each new device in
+the fleet revokes the oldest outstanding key issued before it registered.
+Devices registered through Vault itself do not use up a key.
+An "ssh_key" role registers an SSH public key on the role's balena user for
+the length of the lease. A "registry_token" role exchanges the role's key
+for a container registry token scoped to "registry_repositories", with
+push access when "registry_push" is set. A "fleet_access" role makes the
+balena user named in the requesting entity's "entity_metadata_key" metadata
+a "membership_role" member of "allowed_fleets" for the length of the lease.
+Overlapping leases share the membership, which is removed when the last of
+them ends, and memberships made outside of Vault are left alone.
+A "team_access" role adds the same user to "team" of "organization" until
+the lease ends, and a periodic check restores or removes the membership
+if it is changed by hand. On openBalena, an "openbalena_user" role creates
+a temporary user in "organizations" that is deleted with the lease. An
+"ephemeral_device" role registers a throwaway device of "device_type" in
+"fleet" that is deleted from balena when the lease ends, and an
+"ephemeral_fleet" role creates a fleet named from "fleet_name_template" in
+"organization", copying the variables of "template_fleet", together with a
+provisioning key scoped to the fleet.
+Roles with both "fleet" and "device_type" can preregister devices through
+the provision endpoint.
+
+Setting "cache_credentials" makes the creds endpoint hand out the same
+balena key to every caller until the key has used "cache_refresh_fraction"
+of its lifetime. Each read still gets its own lease, and the key is only
+deleted from balena once it has been replaced and all of its leases are gone.
+Turning "cache_credentials" off again retires the cached key the same way.
+Deleting the role deletes its cached keys right away, while leases of
+uncached keys are revoked with the key itself once the role is gone.
+Other credentials are removed from balena with the role's key, so a role
+can't be deleted while leases of them are still outstanding.
+
+Setting "pool_size" keeps that many keys pre-created. The creds endpoint
+renames a pooled key for the caller instead of creating one, and a periodic
+function refills the pool once fewer than "pool_min_warm" keys are left.
+Keys that wait longer than "pool_max_age" are deleted, and setting
+"pool_size" back to 0 deletes the keys left in the pool.
+
+Every write keeps the previous role as a numbered version that can be
+listed at "role/<name>/versions" and restored with "role/<name>/rollback".
+Only the 20 most recent earlier versions are kept.
+
+Setting "disabled" stops the role from issuing new credentials without
+losing its configuration. Existing leases can still be renewed and revoked.
+
+Role names can be nested with slashes, such as "factory/line-3", so that
+policies can grant "creds/factory/*". Because of the version endpoints,
+the last segment of a role name cannot be "versions" or "rollback".
 `
 
 	pathRoleListHelpSynopsis    = `List the existing roles in balena backend`
-	pathRoleListHelpDescription = `Roles will be listed by the role name.`
+	pathRoleListHelpDescription = `
+Roles will be listed by the role name. Role names can be nested with
+slashes, such as "factory/line-3". Listing "role/factory/" shows the next
+level below "factory", and setting "recursive" lists the full names of all
+nested roles.
+`
 )
@@ -2,9 +2,12 @@ package balenakeys
 
 import (
 	"context"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/require"
@@ -85,6 +88,312 @@ func TestUserRole(t *testing.T) {
 	})
 }
 
+// TestUserRoleCache checks the cached credentials options of a role.
+func TestUserRoleCache(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	t.Run("Create Cached Role", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"balenaApiKey":      "test-key",
+			"cache_credentials": true,
+		})
+
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleRead(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, true, resp.Data["cache_credentials"])
+		require.Equal(t, defaultCacheRefreshFraction, resp.Data["cache_refresh_fraction"])
+	})
+
+	t.Run("Invalid Refresh Fraction", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"balenaApiKey":           "test-key",
+			"cache_refresh_fraction": 1.5,
+		})
+
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Refresh Due", func(t *testing.T) {
+		now := time.Now()
+		cached := &balenaCachedToken{
+			CreatedAt: now.Add(-30 * time.Minute),
+			ExpiresAt: now.Add(30 * time.Minute),
+		}
+
+		require.False(t, cached.refreshDue(now, 0.75))
+		require.True(t, cached.refreshDue(now, 0.5))
+	})
+
+	t.Run("Cache Turned Off", func(t *testing.T) {
+		require.NoError(t, putCachedToken(context.Background(), s, roleName, &balenaCachedToken{
+			KeyName:   "cached",
+			CreatedAt: time.Now(),
+			ExpiresAt: time.Now().Add(time.Hour),
+			Leases:    1,
+		}))
+
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"balenaApiKey":      "test-key",
+			"cache_credentials": false,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		cached, err := getCachedToken(context.Background(), s, roleName, "cached")
+		require.NoError(t, err)
+		require.True(t, cached.Retired)
+	})
+}
+
+// TestUserRolePool checks the key pool options of a role and
+// how pooled keys are checked out of storage.
+func TestUserRolePool(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	t.Run("Create Pooled Role", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"balenaApiKey":  "test-key",
+			"pool_size":     5,
+			"pool_min_warm": 2,
+		})
+
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleRead(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, 5, resp.Data["pool_size"])
+		require.Equal(t, 2, resp.Data["pool_min_warm"])
+		require.Equal(t, defaultPoolMaxAge.Seconds(), resp.Data["pool_max_age"])
+	})
+
+	t.Run("Min Warm Above Pool Size", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"balenaApiKey":  "test-key",
+			"pool_size":     1,
+			"pool_min_warm": 2,
+		})
+
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Next Skips Aged Keys", func(t *testing.T) {
+		role, err := b.getRole(context.Background(), s, roleName)
+		require.NoError(t, err)
+
+		now := time.Now()
+		for name, created := range map[string]time.Time{
+			"aged":  now.Add(-2 * defaultPoolMaxAge),
+			"young": now.Add(-time.Minute),
+		} {
+			entry, err := logical.StorageEntryJSON(pooledTokenPath(roleName, name), &balenaPooledToken{
+				KeyName:   name,
+				CreatedAt: created,
+			})
+			require.NoError(t, err)
+			require.NoError(t, s.Put(context.Background(), entry))
+		}
+
+		pooled, err := b.nextPooledToken(context.Background(), s, role)
+		require.NoError(t, err)
+		require.Equal(t, "young", pooled.KeyName)
+
+		require.NoError(t, s.Delete(context.Background(), pooledTokenPath(roleName, "young")))
+
+		pooled, err = b.nextPooledToken(context.Background(), s, role)
+		require.NoError(t, err)
+		require.Nil(t, pooled)
+	})
+}
+
+// TestKeyPoolCheckout checks that a pooled key is handed out renamed and
+// only once, that a key failing to rename is deleted in balena
+// instead of leaking, and that turning the pool off drains it.
+func TestKeyPoolCheckout(t *testing.T) {
+	ids := map[string]int{"pooled-bad": 1, "pooled-ok": 2}
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/api_key": func(w http.ResponseWriter, r *http.Request) {
+			for name, id := range ids {
+				if strings.Contains(r.URL.Query().Get("$filter"), "'"+name+"'") {
+					testJSON(map[string]interface{}{"d": []map[string]interface{}{{"id": id, "name": name}}})(w, r)
+					return
+				}
+			}
+			testJSON(map[string]interface{}{"d": []interface{}{}})(w, r)
+		},
+		"PATCH v6/api_key(1)": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		},
+		"PATCH v6/api_key(2)":  testJSON(nil),
+		"DELETE v6/api_key(1)": testJSON(nil),
+		"DELETE v6/api_key(2)": testJSON(nil),
+	})
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey": "test-key",
+		"pool_size":    2,
+	})
+
+	role, err := b.getRole(context.Background(), s, roleName)
+	require.NoError(t, err)
+
+	now := time.Now()
+	for name, created := range map[string]time.Time{
+		"pooled-bad": now.Add(-2 * time.Minute),
+		"pooled-ok":  now.Add(-time.Minute),
+	} {
+		entry, err := logical.StorageEntryJSON(pooledTokenPath(roleName, name), &balenaPooledToken{
+			Token:     "token-" + name,
+			KeyName:   name,
+			CreatedAt: created,
+		})
+		require.NoError(t, err)
+		require.NoError(t, s.Put(context.Background(), entry))
+	}
+
+	t.Run("Rename Fails", func(t *testing.T) {
+		token, err := b.checkoutPooledToken(context.Background(), s, role, "renamed", "desc")
+		require.NoError(t, err)
+		require.Nil(t, token)
+		require.True(t, srv.called("DELETE v6/api_key(1)"))
+
+		entry, err := s.Get(context.Background(), pooledTokenPath(roleName, "pooled-bad"))
+		require.NoError(t, err)
+		require.Nil(t, entry)
+	})
+
+	t.Run("Rename Succeeds", func(t *testing.T) {
+		token, err := b.checkoutPooledToken(context.Background(), s, role, "renamed", "desc")
+		require.NoError(t, err)
+		require.Equal(t, "token-pooled-ok", token.Token)
+		require.Equal(t, "renamed", token.KeyName)
+
+		token, err = b.checkoutPooledToken(context.Background(), s, role, "renamed", "desc")
+		require.NoError(t, err)
+		require.Nil(t, token)
+	})
+
+	t.Run("Pool Turned Off", func(t *testing.T) {
+		entry, err := logical.StorageEntryJSON(pooledTokenPath(roleName, "pooled-ok"), &balenaPooledToken{
+			KeyName:   "pooled-ok",
+			CreatedAt: time.Now(),
+		})
+		require.NoError(t, err)
+		require.NoError(t, s.Put(context.Background(), entry))
+
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"balenaApiKey": "test-key",
+			"pool_size":    0,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.True(t, srv.called("DELETE v6/api_key(2)"))
+
+		pool, err := listPooledTokens(context.Background(), s, roleName)
+		require.NoError(t, err)
+		require.Empty(t, pool)
+	})
+}
+
+// TestNestedRoles checks that role names can be nested with
+// slashes and listed one level at a time or recursively.
+func TestNestedRoles(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	for _, name := range []string{"factory/line-3", "factory/line-4", "office"} {
+		resp, err := testTokenRoleCreate(t, b, s, name, map[string]interface{}{
+			"balenaApiKey": "test-key",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	}
+
+	t.Run("List Top Level", func(t *testing.T) {
+		resp, err := testTokenRoleList(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, []string{"factory/", "office"}, resp.Data["keys"])
+	})
+
+	t.Run("List Prefix", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "role/factory/",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"line-3", "line-4"}, resp.Data["keys"])
+	})
+
+	t.Run("Reserved Last Segment", func(t *testing.T) {
+		for _, name := range []string{"factory/versions", "factory/rollback"} {
+			resp, err := testTokenRoleCreate(t, b, s, name, map[string]interface{}{
+				"balenaApiKey": "test-key",
+			})
+			require.True(t, err != nil || resp.IsError(), name)
+
+			role, err := b.getRole(context.Background(), s, name)
+			require.NoError(t, err)
+			require.Nil(t, role, name)
+		}
+	})
+
+	t.Run("List Recursive", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "role/",
+			Data:      map[string]interface{}{"recursive": true},
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"factory/line-3", "factory/line-4", "office"}, resp.Data["keys"])
+	})
+
+	t.Run("Read Nested Role", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "role/factory/line-3",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "factory/line-3", resp.Data["name"])
+	})
+}
+
+// TestProvisioningKeyRole checks that provisioning key roles
+// must be bound to a fleet.
+func TestProvisioningKeyRole(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	t.Run("Missing Fleet", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"balenaApiKey":    "test-key",
+			"credential_type": provisioningKeyCredentialType,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create With Fleet", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"balenaApiKey":    "test-key",
+			"credential_type": provisioningKeyCredentialType,
+			"fleet":           "myorg/myfleet",
+			"single_use":      true,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleRead(t, b, s)
+		require.NoError(t, err)
+		require.Equal(t, "myorg/myfleet", resp.Data["fleet"])
+		require.Equal(t, true, resp.Data["single_use"])
+	})
+}
+
 // Utility function to create a role while, returning any response (including errors)
 func testTokenRoleCreate(t *testing.T, b *balenaBackend, s logical.Storage, name string, d map[string]interface{}) (*logical.Response, error) {
 	t.Helper()
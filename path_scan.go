@@ -0,0 +1,143 @@
+package balenakeys
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathScan extends the Vault API with a `/scan` endpoint that reports
+// balena environment variables holding plaintext credentials.
+func pathScan(b *balenaBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "scan/" + roleNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role whose balena key is used to scan",
+				Required:    true,
+			},
+			"fleet": {
+				Type:        framework.TypeString,
+				Description: "Slug or ID of a single fleet to scan. If not set, every fleet the role allows is scanned",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathScanRead,
+			},
+		},
+		HelpSynopsis:    pathScanHelpSyn,
+		HelpDescription: pathScanHelpDesc,
+	}
+}
+
+// pathScanRead scans the environment variables of the role's fleets and
+// reports the ones that look like credentials, without their values
+func (b *balenaBackend) pathScanRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	roleEntry, err := b.getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return logical.ErrorResponse("role %q not found", name), nil
+	}
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fleets, resp, err := scanFleets(ctx, client, roleEntry, d.Get("fleet").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	owners, err := getScanOwners(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	findings := []balenaScanFinding{}
+	scanned, unowned := 0, 0
+	for _, fleet := range fleets {
+		fleetFindings, fleetScanned, err := scanFleet(ctx, client, fleet, owners)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range fleetFindings {
+			if f.Owner == "" {
+				unowned++
+			}
+		}
+		findings = append(findings, fleetFindings...)
+		scanned += fleetScanned
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"fleets":   len(fleets),
+			"scanned":  scanned,
+			"flagged":  len(findings),
+			"unowned":  unowned,
+			"findings": findings,
+		},
+	}, nil
+}
+
+// scanFleets returns the fleets to scan: the requested one, the role's
+// allowed fleets, or every fleet the role's key can see
+func scanFleets(ctx context.Context, c *balenaClient, role *balenaRoleEntry, fleetName string) ([]balenaFleet, *logical.Response, error) {
+	names := role.AllowedFleets
+	if fleetName != "" {
+		names = []string{fleetName}
+	}
+
+	if len(names) == 0 {
+		fleets, err := listFleets(ctx, c)
+		return fleets, nil, err
+	}
+
+	var fleets []balenaFleet
+	for _, name := range names {
+		fleet, err := getFleet(ctx, c, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if fleet == nil {
+			return nil, logical.ErrorResponse("fleet %q not found", name), nil
+		}
+
+		if !fleetAllowed(role.AllowedFleets, *fleet) {
+			return nil, logical.ErrorResponse("fleet %q is not allowed by role %q", fleet.Slug, role.Name), nil
+		}
+
+		fleets = append(fleets, *fleet)
+	}
+
+	return fleets, nil, nil
+}
+
+const pathScanHelpSyn = `
+Report balena environment variables that hold plaintext credentials.
+`
+
+const pathScanHelpDesc = `
+This path uses the role's balena key to read the fleet, service, device
+and device service environment variables of "fleet", or of every fleet
+in the role's "allowed_fleets" (every fleet the key can see if that is
+empty). Values that contain a private key, match a well-known credential
+format, or are long high-entropy strings are reported with the reasons
+they were flagged. Values themselves are never returned.
+
+Each finding names its "owner", the sync or managed variable in this
+backend that manages it. Findings without an owner only live in balena
+and are candidates to move into Vault.
+`
@@ -0,0 +1,222 @@
+package balenakeys
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// pathSupportAccess extends the Vault API with a `/support-access`
+// endpoint that grants balena support access under a lease.
+func pathSupportAccess(b *balenaBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "support-access/" + roleNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role",
+				Required:    true,
+			},
+			"device_uuid": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "UUID of the device to grant support access to",
+			},
+			"fleet": {
+				Type:        framework.TypeString,
+				Description: "Slug or ID of the fleet to grant support access to",
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Length of the support access lease. If not set or set to 0, will use the role's ttl",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathSupportAccessWrite,
+			},
+		},
+		HelpSynopsis:    pathSupportAccessHelpSyn,
+		HelpDescription: pathSupportAccessHelpDesc,
+	}
+}
+
+// pathSupportAccessWrite grants balena support access to a device or fleet
+// until the end of the returned lease
+func (b *balenaBackend) pathSupportAccessWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	deviceUUID := d.Get("device_uuid").(string)
+	fleetName := d.Get("fleet").(string)
+
+	if (deviceUUID == "") == (fleetName == "") {
+		return logical.ErrorResponse("exactly one of device_uuid and fleet is required"), nil
+	}
+
+	roleEntry, resp, err := b.getIssuingRole(ctx, req.Storage, name)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	ttl := b.leaseTTL(d, roleEntry)
+
+	client, err := b.getClient(ctx, req.Storage, roleEntry.BalenaApiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var target, targetName string
+	var targetID int
+	if deviceUUID != "" {
+		device, resp, err := roleDevice(ctx, client, roleEntry, deviceUUID)
+		if resp != nil || err != nil {
+			return resp, err
+		}
+		target, targetID, targetName = supportTargetDevice, device.ID, device.UUID
+	} else {
+		fleet, err := getFleet(ctx, client, fleetName)
+		if err != nil {
+			return nil, err
+		}
+
+		if fleet == nil {
+			return logical.ErrorResponse("fleet %q not found", fleetName), nil
+		}
+
+		if !fleetAllowed(roleEntry.AllowedFleets, *fleet) {
+			return logical.ErrorResponse("fleet %q is not allowed by role %q", fleet.Slug, roleEntry.Name), nil
+		}
+		target, targetID, targetName = supportTargetFleet, fleet.ID, fleet.Slug
+	}
+
+	b.supportLock.Lock()
+	defer b.supportLock.Unlock()
+
+	// another lease's access would be restored as granted before this one
+	grant, err := getSupportGrant(ctx, req.Storage, target, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if grant != nil {
+		return logical.ErrorResponse("support access to %s %q is already granted by a lease of role %q", target, targetName, grant.Role), nil
+	}
+
+	// access granted before the lease is restored when the lease ends
+	previous, err := getSupportAccess(ctx, client, target, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	previousUntil := ""
+	if previous != nil && previous.After(time.Now()) {
+		previousUntil = previous.UTC().Format(time.RFC3339)
+	} else {
+		previous = nil
+	}
+
+	until := laterSupportAccess(time.Now().Add(ttl), previous)
+	if err := setSupportAccess(ctx, client, target, targetID, &until); err != nil {
+		return nil, err
+	}
+
+	// don't leave the access behind without a lease
+	restore := func() {
+		if err := setSupportAccess(ctx, client, target, targetID, previous); err != nil {
+			b.Logger().Error("error removing untracked support access", target, targetName, "error", err)
+		}
+	}
+
+	if err := putSupportGrant(ctx, req.Storage, target, targetID, &balenaSupportGrant{
+		Role:     roleEntry.Name,
+		IssuedAt: time.Now(),
+	}); err != nil {
+		restore()
+		return nil, err
+	}
+
+	resp = b.Secret(balenaSupportAccessType).Response(map[string]interface{}{
+		target:             targetName,
+		"accessible_until": until.UTC().Format(time.RFC3339),
+	}, map[string]interface{}{
+		"target":         target,
+		"target_id":      targetID,
+		"previous_until": previousUntil,
+		"role":           roleEntry.Name,
+		"ttl":            ttl,
+		"max_ttl":        roleEntry.MaxTTL,
+	})
+
+	resp.Secret.TTL = ttl
+
+	if roleEntry.MaxTTL > 0 {
+		resp.Secret.MaxTTL = roleEntry.MaxTTL
+	}
+
+	if err := trackRoleLease(ctx, req.Storage, resp); err != nil {
+		restore()
+		if delErr := req.Storage.Delete(ctx, supportGrantPath(target, targetID)); delErr != nil {
+			b.Logger().Error("error removing untracked support access grant", target, targetName, "error", delErr)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// getIssuingRole returns a role that may issue new leases, or an error
+// response explaining why it cannot
+func (b *balenaBackend) getIssuingRole(ctx context.Context, s logical.Storage, name string) (*balenaRoleEntry, *logical.Response, error) {
+	roleEntry, err := b.getRole(ctx, s, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return nil, logical.ErrorResponse("role %q not found", name), nil
+	}
+
+	resp, err := b.checkIssuance(ctx, s, roleEntry)
+	if resp != nil || err != nil {
+		return nil, resp, err
+	}
+
+	return roleEntry, nil, nil
+}
+
+// leaseTTL returns the TTL of a lease issued by a path with a "ttl" field,
+// falling back to the role's and then the mount's default, and capped at
+// the role's max TTL
+func (b *balenaBackend) leaseTTL(d *framework.FieldData, role *balenaRoleEntry) time.Duration {
+	ttl := role.TTL
+	if ttlRaw, ok := d.GetOk("ttl"); ok {
+		ttl = time.Duration(ttlRaw.(int)) * time.Second
+	}
+
+	if ttl <= 0 {
+		ttl = b.System().DefaultLeaseTTL()
+	}
+
+	if role.MaxTTL > 0 && ttl > role.MaxTTL {
+		ttl = role.MaxTTL
+	}
+
+	return ttl
+}
+
+const pathSupportAccessHelpSyn = `
+Grant balena support access to a device or fleet under a lease.
+`
+
+const pathSupportAccessHelpDesc = `
+This path grants balena support access to the device given as
+"device_uuid" or the fleet given as "fleet", using the role's balena key
+and limited by the role's "allowed_fleets" and "allowed_device_uuids".
+Access is granted until the end of the returned lease. Renewing the lease
+extends the access, and revoking it removes the access immediately. Access
+that was already granted before the lease is never shortened, and its
+expiry is restored when the lease is revoked. Only one lease at a time can
+grant support access to a device or fleet; renew it instead of requesting
+another one.
+`
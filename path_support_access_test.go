@@ -0,0 +1,145 @@
+package balenakeys
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSupportAccess grants, extends and removes support access to a
+// device against a fake balena API.
+func TestSupportAccess(t *testing.T) {
+	var until []interface{}
+	var previous interface{}
+	srv := newTestBalenaServer(t, map[string]http.HandlerFunc{
+		"GET v6/device(1001)": func(w http.ResponseWriter, r *http.Request) {
+			testJSON(map[string]interface{}{
+				"d": []map[string]interface{}{{"is_accessible_by_support_until__date": previous}},
+			})(w, r)
+		},
+		"GET v6/device": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{
+				"id":                      1001,
+				"uuid":                    "0123456789abcdef0123456789abcdef",
+				"belongs_to__application": []map[string]interface{}{{"id": 42, "slug": "myorg/myfleet"}},
+			}},
+		}),
+		"PATCH v6/device(1001)": func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			until = append(until, body["is_accessible_by_support_until__date"])
+
+			testJSON(nil)(w, r)
+		},
+	})
+
+	b, s := testBackendWithServer(t, srv, map[string]interface{}{
+		"balenaApiKey":   "test-key",
+		"allowed_fleets": "myorg/myfleet",
+		"ttl":            3600,
+		"max_ttl":        7200,
+	})
+
+	t.Run("Target Required", func(t *testing.T) {
+		resp, err := testSupportAccess(t, b, s, map[string]interface{}{})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	resp, err := testSupportAccess(t, b, s, map[string]interface{}{
+		"device_uuid": "0123456789abcdef0123456789abcdef",
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	require.Equal(t, time.Hour, resp.Secret.TTL)
+	require.Len(t, until, 1)
+	require.NotNil(t, until[0])
+
+	// internal data reaches renew and revoke after a round trip through storage
+	internalData, err := json.Marshal(resp.Secret.InternalData)
+	require.NoError(t, err)
+	secret := resp.Secret
+	secret.InternalData = nil
+	require.NoError(t, json.Unmarshal(internalData, &secret.InternalData))
+	secret.IssueTime = time.Now()
+
+	t.Run("Overlapping Lease", func(t *testing.T) {
+		resp, err := testSupportAccess(t, b, s, map[string]interface{}{
+			"device_uuid": "0123456789abcdef0123456789abcdef",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Len(t, until, 1)
+	})
+
+	t.Run("Role Delete Refused", func(t *testing.T) {
+		resp, err := testTokenRoleDelete(t, b, s)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Renew", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RenewOperation,
+			Secret:    secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Len(t, until, 2)
+		require.NotNil(t, until[1])
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Len(t, until, 3)
+		require.Nil(t, until[2])
+	})
+
+	t.Run("Restore Earlier Access", func(t *testing.T) {
+		earlier := time.Now().Add(30 * 24 * time.Hour).UTC().Truncate(time.Second)
+		previous = earlier.Format(time.RFC3339)
+		until = nil
+
+		resp, err := testSupportAccess(t, b, s, map[string]interface{}{
+			"device_uuid": "0123456789abcdef0123456789abcdef",
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, earlier.Format(time.RFC3339), resp.Data["accessible_until"])
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    resp.Secret,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Len(t, until, 2)
+		restored, err := time.Parse(balenaTimeFormat, until[1].(string))
+		require.NoError(t, err)
+		require.True(t, earlier.Equal(restored))
+	})
+}
+
+// Utility function to grant support access and return any errors
+func testSupportAccess(t *testing.T, b *balenaBackend, s logical.Storage, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "support-access/" + roleName,
+		Data:      d,
+		Storage:   s,
+	})
+}
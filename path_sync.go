@@ -0,0 +1,302 @@
+package balenakeys
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// toResponseData returns the sync definition as the data of a read response
+func (s *balenaSync) toResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"role":       s.Role,
+		"kv_mount":   s.KVMount,
+		"kv_path":    s.KVPath,
+		"kv_version": s.KVVersion,
+		"fleet":      s.Fleet,
+		"service":    s.Service,
+	}
+}
+
+// pathSync extends the Vault API with endpoints to define which KV
+// secrets are synced into balena environment variables.
+func pathSync(b *balenaBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "sync/" + framework.GenericNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the sync",
+					Required:    true,
+				},
+				"role": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Role whose balena key and allowed_fleets are used to write the variables",
+				},
+				"kv_mount": {
+					Type:        framework.TypeString,
+					Description: "Mount path of the KV secrets engine. Defaults to secret",
+				},
+				"kv_path": {
+					Type:        framework.TypeString,
+					Description: "Path of the KV secret within the mount",
+				},
+				"kv_version": {
+					Type:          framework.TypeInt,
+					Description:   "Version of the KV secrets engine, 1 or 2. Defaults to 2",
+					AllowedValues: []interface{}{1, 2},
+				},
+				"fleet": {
+					Type:        framework.TypeString,
+					Description: "Slug or ID of the fleet to set the variables on",
+				},
+				"service": {
+					Type:        framework.TypeString,
+					Description: "Name of the fleet's service to set the variables on. If not set, fleet variables are used",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathSyncRead,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathSyncWrite,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathSyncWrite,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathSyncDelete,
+				},
+			},
+			ExistenceCheck:  b.pathSyncExistenceCheck,
+			HelpSynopsis:    pathSyncHelpSyn,
+			HelpDescription: pathSyncHelpDesc,
+		},
+		{
+			Pattern: "sync/" + framework.GenericNameRegex("name") + "/status$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the sync",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathSyncStatusRead,
+				},
+			},
+			HelpSynopsis:    pathSyncStatusHelpSyn,
+			HelpDescription: pathSyncStatusHelpDesc,
+		},
+		{
+			Pattern: "sync/?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathSyncList,
+				},
+			},
+			HelpSynopsis:    pathSyncHelpSyn,
+			HelpDescription: pathSyncHelpDesc,
+		},
+	}
+}
+
+// pathSyncExistenceCheck verifies if the sync exists.
+func (b *balenaBackend) pathSyncExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	sync, err := getSync(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, fmt.Errorf("existence check failed: %w", err)
+	}
+
+	return sync != nil, nil
+}
+
+// pathSyncRead returns a sync definition
+func (b *balenaBackend) pathSyncRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	sync, err := getSync(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if sync == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{Data: sync.toResponseData()}, nil
+}
+
+// pathSyncWrite creates or updates a sync definition. The variables are
+// written by the next run of the periodic function.
+func (b *balenaBackend) pathSyncWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	b.syncLock.Lock()
+	defer b.syncLock.Unlock()
+
+	sync, err := getSync(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if sync == nil {
+		sync = &balenaSync{Name: name, KVMount: "secret", KVVersion: 2}
+	}
+
+	previousFleet, previousService := sync.Fleet, sync.Service
+
+	if role, ok := d.GetOk("role"); ok {
+		sync.Role = role.(string)
+	}
+
+	if mount, ok := d.GetOk("kv_mount"); ok {
+		sync.KVMount = strings.Trim(mount.(string), "/")
+	}
+
+	if path, ok := d.GetOk("kv_path"); ok {
+		sync.KVPath = strings.Trim(path.(string), "/")
+	}
+
+	if version, ok := d.GetOk("kv_version"); ok {
+		sync.KVVersion = version.(int)
+	}
+
+	if fleet, ok := d.GetOk("fleet"); ok {
+		sync.Fleet = fleet.(string)
+	}
+
+	if service, ok := d.GetOk("service"); ok {
+		sync.Service = service.(string)
+	}
+
+	switch {
+	case sync.Role == "":
+		return logical.ErrorResponse("missing role"), nil
+	case sync.KVMount == "" || sync.KVPath == "":
+		return logical.ErrorResponse("missing kv_mount or kv_path"), nil
+	case sync.KVVersion != 1 && sync.KVVersion != 2:
+		return logical.ErrorResponse("kv_version must be 1 or 2"), nil
+	case sync.Fleet == "":
+		return logical.ErrorResponse("missing fleet"), nil
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if !kvPathAllowed(config, sync.KVMount, sync.KVPath) {
+		return logical.ErrorResponse("kv secret %s/%s is not allowed by allowed_kv_paths", sync.KVMount, sync.KVPath), nil
+	}
+
+	role, err := b.getRole(ctx, req.Storage, sync.Role)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %w", err)
+	}
+
+	if role == nil {
+		return logical.ErrorResponse("role %q not found", sync.Role), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(syncStoragePrefix+name, sync)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	// the variables managed on the old target are not the new target's
+	if sync.Fleet != previousFleet || sync.Service != previousService {
+		if err := req.Storage.Delete(ctx, syncStatusStoragePrefix+name); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// pathSyncDelete removes a sync definition and its status. Variables the
+// sync wrote are left in place.
+func (b *balenaBackend) pathSyncDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	b.syncLock.Lock()
+	defer b.syncLock.Unlock()
+
+	if err := req.Storage.Delete(ctx, syncStoragePrefix+name); err != nil {
+		return nil, err
+	}
+
+	if err := req.Storage.Delete(ctx, syncStatusStoragePrefix+name); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// pathSyncStatusRead returns the outcome of the last run of a sync
+func (b *balenaBackend) pathSyncStatusRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	sync, err := getSync(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if sync == nil {
+		return logical.ErrorResponse("sync %q not found", name), nil
+	}
+
+	status, err := getSyncStatus(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{Data: status.toResponseData()}, nil
+}
+
+// pathSyncList lists the sync definitions
+func (b *balenaBackend) pathSyncList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, syncStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(names), nil
+}
+
+const (
+	pathSyncHelpSyn  = `Sync Vault KV secrets into balena environment variables.`
+	pathSyncHelpDesc = `
+A sync maps the KV secret at "kv_path" in the "kv_mount" KV secrets
+engine to the environment variables of "fleet", or of its "service" when
+set. Each key of the secret becomes a variable of the same name.
+
+The periodic function reads the secret through the Vault API using the
+"vault_addr" and "vault_token" set in the config, and writes the
+variables with the balena key of "role", within its "allowed_fleets".
+The secret must match the config's "allowed_kv_paths", as writing a sync
+lets the caller read the secret back from balena.
+Variables are created and updated to match the secret. A variable is
+deleted when its key is removed from the secret, but only if the sync
+wrote it before, so variables managed by hand are left alone.
+
+Deleting a sync stops it and leaves its variables in place. Changing the
+"fleet" or "service" of a sync likewise leaves the variables of the old
+target in place, and the sync starts over on the new one.
+`
+	pathSyncStatusHelpSyn  = `Read the status of a KV secret sync.`
+	pathSyncStatusHelpDesc = `
+Returns when the sync last ran and last succeeded, the error of the last
+run if it failed, the variables the sync manages, how many variables the
+last run created, updated and deleted, and when the config's
+"vault_token" expires unless it can be renewed.
+`
+)
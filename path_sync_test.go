@@ -0,0 +1,225 @@
+package balenakeys
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSync syncs a KV secret into fleet variables against a fake Vault and
+// balena API, adopting an existing variable, creating and then deleting
+// another, and leaving a variable managed by hand alone.
+func TestSync(t *testing.T) {
+	var mu sync.Mutex
+	kv := map[string]interface{}{"API_KEY": "new-key", "DB_URL": "postgres://db"}
+	vars := map[int]map[string]interface{}{
+		1: {"id": 1, "name": "API_KEY", "value": "old-key"},
+		2: {"id": 2, "name": "OTHER", "value": "by-hand"},
+	}
+	tokenTTL, renewals := 600, 0
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		require.Equal(t, "s.synctoken", r.Header.Get("X-Vault-Token"))
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			testJSON(map[string]interface{}{
+				"data": map[string]interface{}{"ttl": tokenTTL, "creation_ttl": 3600, "renewable": true},
+			})(w, r)
+		case "/v1/auth/token/renew-self":
+			renewals++
+			tokenTTL = 3600
+			testJSON(map[string]interface{}{
+				"auth": map[string]interface{}{"client_token": "s.synctoken", "lease_duration": 3600, "renewable": true},
+			})(w, r)
+		default:
+			require.Equal(t, "/v1/secret/data/myapp", r.URL.Path)
+			testJSON(map[string]interface{}{
+				"data": map[string]interface{}{"data": kv, "metadata": map[string]interface{}{}},
+			})(w, r)
+		}
+	}))
+	t.Cleanup(vault.Close)
+
+	varByName := func(name string) map[string]interface{} {
+		for _, v := range vars {
+			if v["name"] == name {
+				return v
+			}
+		}
+		return nil
+	}
+
+	handlers := map[string]http.HandlerFunc{
+		"GET v6/application": testJSON(map[string]interface{}{
+			"d": []map[string]interface{}{{"id": 42, "slug": "myorg/myfleet"}},
+		}),
+		"GET v6/application_environment_variable": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			require.Equal(t, "application eq 42", r.URL.Query().Get("$filter"))
+			d := []map[string]interface{}{}
+			for _, v := range vars {
+				d = append(d, v)
+			}
+			testJSON(map[string]interface{}{"d": d})(w, r)
+		},
+		"POST v6/application_environment_variable": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			require.EqualValues(t, 42, body["application"])
+			vars[3] = map[string]interface{}{"id": 3, "name": body["name"], "value": body["value"]}
+
+			testJSON(nil)(w, r)
+		},
+	}
+	for id := 1; id <= 3; id++ {
+		id := id
+		handlers[fmt.Sprintf("PATCH v6/application_environment_variable(%d)", id)] = func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			vars[id]["value"] = body["value"]
+
+			testJSON(nil)(w, r)
+		}
+		handlers[fmt.Sprintf("DELETE v6/application_environment_variable(%d)", id)] = func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			delete(vars, id)
+			testJSON(nil)(w, r)
+		}
+	}
+
+	b, s := testBackendWithServer(t, newTestBalenaServer(t, handlers), map[string]interface{}{
+		"balenaApiKey":   "test-key",
+		"allowed_fleets": "myorg/myfleet",
+	})
+
+	t.Run("Missing Role", func(t *testing.T) {
+		resp, err := testSyncWrite(t, b, s, map[string]interface{}{
+			"role":    "missing",
+			"kv_path": "myapp",
+			"fleet":   "myorg/myfleet",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("KV Path Not Allowed", func(t *testing.T) {
+		resp, err := testSyncWrite(t, b, s, map[string]interface{}{
+			"role":    roleName,
+			"kv_path": "myapp",
+			"fleet":   "myorg/myfleet",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+		"allowed_kv_paths": "secret/myapp",
+	}))
+
+	resp, err := testSyncWrite(t, b, s, map[string]interface{}{
+		"role":    roleName,
+		"kv_path": "myapp",
+		"fleet":   "myorg/myfleet",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	t.Run("Not Configured", func(t *testing.T) {
+		require.Error(t, b.reconcileSyncs(context.Background(), s))
+	})
+
+	require.NoError(t, testConfigUpdate(t, b, s, map[string]interface{}{
+		"vault_addr":  vault.URL,
+		"vault_token": "s.synctoken",
+	}))
+
+	require.NoError(t, b.reconcileSyncs(context.Background(), s))
+	require.Equal(t, "new-key", varByName("API_KEY")["value"])
+	require.Equal(t, "postgres://db", varByName("DB_URL")["value"])
+	require.Equal(t, "by-hand", varByName("OTHER")["value"])
+
+	status := testSyncStatus(t, b, s)
+	require.Equal(t, true, status["in_sync"])
+	require.Equal(t, []string{"API_KEY", "DB_URL"}, status["managed"])
+	require.Equal(t, 1, status["created"])
+	require.Equal(t, 1, status["updated"])
+	require.Equal(t, 1, renewals)
+	require.False(t, status["token_expires_at"].(time.Time).IsZero())
+
+	mu.Lock()
+	delete(kv, "DB_URL")
+	mu.Unlock()
+
+	require.NoError(t, b.reconcileSyncs(context.Background(), s))
+	require.Nil(t, varByName("DB_URL"))
+	require.Equal(t, "by-hand", varByName("OTHER")["value"])
+
+	status = testSyncStatus(t, b, s)
+	require.Equal(t, []string{"API_KEY"}, status["managed"])
+	require.Equal(t, 1, status["deleted"])
+
+	t.Run("Target Changed", func(t *testing.T) {
+		resp, err := testSyncWrite(t, b, s, map[string]interface{}{"kv_version": 2})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Equal(t, []string{"API_KEY"}, testSyncStatus(t, b, s)["managed"])
+
+		resp, err = testSyncWrite(t, b, s, map[string]interface{}{"service": "main"})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Equal(t, []string{}, testSyncStatus(t, b, s)["managed"])
+	})
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "sync/",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"myapp"}, resp.Data["keys"])
+}
+
+// Utility function to write the myapp sync and return any errors
+func testSyncWrite(t *testing.T, b *balenaBackend, s logical.Storage, data map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "sync/myapp",
+		Data:      data,
+		Storage:   s,
+	})
+}
+
+// Utility function to read the status of the myapp sync
+func testSyncStatus(t *testing.T, b *balenaBackend, s logical.Storage) map[string]interface{} {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "sync/myapp/status",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+	return resp.Data
+}